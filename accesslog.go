@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Names of the built-in access log formats.
+const (
+	DefaultAccessLog  = "default"  // space separated fields, as written by earlier versions
+	CombinedAccessLog = "combined" // Apache combined log format
+	JSONAccessLog     = "json"     // one JSON object per line
+)
+
+// AccessLogFormat is the format of access log entries. It is the name of a
+// built-in format, or a text/template that is executed with an
+// AccessLogEntry, e.g. "{{.RemoteAddr}} {{.Key}} {{.MappingType}}".
+type AccessLogFormat struct {
+	Name string
+	tmpl *template.Template // nil for built-in formats
+}
+
+// ParseAccessLogFormat returns the access log format of the given name or
+// template. An empty string is the default format.
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch s {
+	case "":
+		return AccessLogFormat{Name: DefaultAccessLog}, nil
+
+	case DefaultAccessLog, CombinedAccessLog, JSONAccessLog:
+		return AccessLogFormat{Name: s}, nil
+	}
+
+	tmpl, err := template.New("accessLog").Parse(s)
+	if err != nil {
+		return AccessLogFormat{}, fmt.Errorf("Invalid access log format: %v", err)
+	}
+
+	// unknown fields are only reported when the template is executed
+	if err := tmpl.Execute(ioutil.Discard, &AccessLogEntry{}); err != nil {
+		return AccessLogFormat{}, fmt.Errorf("Invalid access log format: %v", err)
+	}
+
+	return AccessLogFormat{Name: s, tmpl: tmpl}, nil
+}
+
+func (f AccessLogFormat) MarshalJSON() ([]byte, error) {
+	if f.Name == "" {
+		return json.Marshal(DefaultAccessLog)
+	}
+
+	return json.Marshal(f.Name)
+}
+
+func (f *AccessLogFormat) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := ParseAccessLogFormat(s)
+	if err != nil {
+		return err
+	}
+
+	*f = v
+	return nil
+}
+
+// An AccessLogEntry describes a request served by one of the listeners.
+type AccessLogEntry struct {
+	Time         time.Time     `json:"time"` // start of the request
+	Listener     string        `json:"listener"`
+	RemoteAddr   string        `json:"remoteAddr"`
+	ForwardedFor string        `json:"forwardedFor,omitempty"` // X-Forwarded-For header
+	User         string        `json:"user,omitempty"`         // name of the management API token
+	Method       string        `json:"method"`
+	Host         string        `json:"host"`
+	URL          string        `json:"url"`
+	Proto        string        `json:"proto"`
+	Status       int           `json:"status"`
+	Size         int           `json:"size"`
+	Referer      string        `json:"referer,omitempty"`
+	UserAgent    string        `json:"userAgent,omitempty"`
+	Location     string        `json:"location,omitempty"`
+	Duration     time.Duration `json:"duration"`
+	Key          string        `json:"key,omitempty"`         // mapping key built from the request
+	Mapping      string        `json:"mapping,omitempty"`     // key of the matched mapping
+	MappingType  string        `json:"mappingType,omitempty"` // exact, prefix, regexp or default
+}
+
+// MarshalJSON encodes the duration of the request in seconds.
+func (e *AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type entry AccessLogEntry
+	return json.Marshal(&struct {
+		*entry
+		Duration float64 `json:"duration"`
+	}{(*entry)(e), e.Duration.Seconds()})
+}
+
+// newAccessLogEntry returns the entry of a request before it is served.
+func newAccessLogEntry(listener string, r *http.Request, start time.Time) *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:         start,
+		Listener:     listener,
+		RemoteAddr:   r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Method:       r.Method,
+		Host:         r.Host,
+		URL:          r.URL.String(),
+		Proto:        r.Proto,
+		Referer:      r.Referer(),
+		UserAgent:    r.UserAgent(),
+	}
+}
+
+// mappingType returns the type of a matched mapping for the access log: exact,
+// prefix, regexp or default if no request key matched.
+func mappingType(m *Mapping, hc *HostConfig, keys []string) string {
+	if m.Key == hc.DefaultKey {
+		matched := false
+		for _, key := range keys {
+			if key == m.Key {
+				matched = true
+			}
+		}
+		if !matched {
+			return "default"
+		}
+	}
+
+	if m.Type == ExactMapping {
+		return "exact"
+	}
+
+	return string(m.Type)
+}
+
+type accessLogContextKey struct{}
+
+// withAccessLogEntry returns a copy of the request with the given access log
+// entry, so that handlers can add the details of the request.
+func withAccessLogEntry(r *http.Request, e *AccessLogEntry) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, e))
+}
+
+// requestAccessLogEntry returns the access log entry of a request. Changes are
+// discarded if the request is not logged.
+func requestAccessLogEntry(r *http.Request) *AccessLogEntry {
+	if e, ok := r.Context().Value(accessLogContextKey{}).(*AccessLogEntry); ok {
+		return e
+	}
+
+	return &AccessLogEntry{}
+}
+
+// An AccessLogger writes an entry for each request in the configured format.
+type AccessLogger struct {
+	Format AccessLogFormat
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLogger returns an AccessLogger that writes to the file at path, or
+// to stdout if the path is "-".
+func NewAccessLogger(path string, format AccessLogFormat) (*AccessLogger, error) {
+	w, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAccessLogger(w, format), nil
+}
+
+func newAccessLogger(w io.Writer, format AccessLogFormat) *AccessLogger {
+	return &AccessLogger{Format: format, w: w}
+}
+
+// Log writes an entry to the access log.
+func (l *AccessLogger) Log(e *AccessLogEntry) {
+	b := &bytes.Buffer{}
+	switch l.Format.Name {
+	case CombinedAccessLog:
+		writeCombinedLog(b, e)
+
+	case JSONAccessLog:
+		enc := json.NewEncoder(b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(e); err != nil {
+			b.Reset()
+			writeDefaultLog(b, e)
+		}
+
+	case "", DefaultAccessLog:
+		writeDefaultLog(b, e)
+
+	default:
+		if err := l.Format.tmpl.Execute(b, e); err != nil {
+			b.Reset()
+			writeDefaultLog(b, e)
+		} else if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+			b.WriteString("\n")
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b.Bytes())
+}
+
+func writeDefaultLog(b *bytes.Buffer, e *AccessLogEntry) {
+	fmt.Fprintf(b,
+		"%s %s %s %s %s %d %d %s %s %d\n",
+		e.Time.Format("2006/01/02 15:04:05.000000"),
+		e.RemoteAddr,
+		e.Method,
+		e.URL,
+		e.Proto,
+		e.Status,
+		e.Size,
+		loggable(e.Referer),
+		loggable(e.Location),
+		e.Duration.Nanoseconds())
+}
+
+// writeCombinedLog writes an entry in the Apache combined log format.
+func writeCombinedLog(b *bytes.Buffer, e *AccessLogEntry) {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	size := "-"
+	if e.Size > 0 {
+		size = fmt.Sprintf("%d", e.Size)
+	}
+
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+	}
+
+	fmt.Fprintf(b,
+		"%s - %s [%s] %s %d %s %s %s\n",
+		host,
+		loggable(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(e.Method+" "+e.URL+" "+e.Proto),
+		e.Status,
+		size,
+		quote(e.Referer),
+		quote(e.UserAgent))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &AccessLogEntry{
+		Time:        time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+		Listener:    "redirect",
+		RemoteAddr:  "10.0.0.1:1234",
+		Method:      "GET",
+		Host:        "example.com",
+		URL:         "/a?b=c",
+		Proto:       "HTTP/1.1",
+		Status:      308,
+		Size:        18,
+		UserAgent:   `curl "7"`,
+		Location:    "/okay",
+		Duration:    1500 * time.Millisecond,
+		Key:         "/a",
+		Mapping:     "/a",
+		MappingType: "exact",
+	}
+
+	tests := map[string]string{
+		DefaultAccessLog:  "2017/03/04 05:06:07.000000 10.0.0.1:1234 GET /a?b=c HTTP/1.1 308 18 - /okay 1500000000\n",
+		CombinedAccessLog: `10.0.0.1 - - [04/Mar/2017:05:06:07 +0000] "GET /a?b=c HTTP/1.1" 308 18 "-" "curl \"7\""` + "\n",
+		"{{.Key}} {{.MappingType}} {{.UserAgent}}": "/a exact curl \"7\"\n",
+	}
+	for name, expect := range tests {
+		format, err := ParseAccessLogFormat(name)
+		if err != nil {
+			panic(err)
+		}
+
+		b := &bytes.Buffer{}
+		newAccessLogger(b, format).Log(e)
+		if b.String() != expect {
+			t.Errorf("Expected %v access log entry %q, got %q", name, expect, b.String())
+		}
+	}
+
+	b := &bytes.Buffer{}
+	newAccessLogger(b, AccessLogFormat{Name: JSONAccessLog}).Log(e)
+	var v map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		t.Fatalf("Error decoding JSON access log entry %q: %v", b.String(), err)
+	}
+	if v["duration"] != 1.5 || v["mappingType"] != "exact" || v["status"] != float64(308) {
+		t.Errorf("Unexpected JSON access log entry: %v", b.String())
+	}
+
+	for _, s := range []string{"{{.Key", "{{.NoSuchField}}"} {
+		if _, err := ParseAccessLogFormat(s); err == nil {
+			t.Errorf("Expected error parsing access log format %q", s)
+		}
+	}
+}
+
+func TestAccessLogMappings(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		b := &bytes.Buffer{}
+		rt.AccessLogger = newAccessLogger(b, AccessLogFormat{Name: JSONAccessLog})
+		rt.Config().DefaultKey = "default"
+
+		tests := map[string]AccessLogEntry{
+			"/permanent":    {Key: "/permanent", Mapping: "/permanent", MappingType: "exact"},
+			"/prefix/a":     {Key: "/prefix/a", Mapping: "/prefix", MappingType: "prefix"},
+			"/products/123": {Key: "/products/123", Mapping: `^/products/(?P<id>[0-9]+)$`, MappingType: "regexp"},
+			"/not/found":    {Key: "/not/found", Mapping: "default", MappingType: "default"},
+		}
+		for path, expect := range tests {
+			b.Reset()
+			req, err := http.NewRequest("GET", ts.URL+path, nil)
+			if err != nil {
+				panic(err)
+			}
+			req.Header.Set("User-Agent", "test")
+			req.Header.Set("X-Forwarded-For", "192.0.2.1")
+			res, err := testHttpClient().Do(req)
+			if err != nil {
+				panic(err)
+			}
+			res.Body.Close()
+
+			var e struct {
+				Key, Mapping, MappingType, UserAgent, ForwardedFor string
+				Status                                             int
+			}
+			if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+				t.Fatalf("Error decoding access log entry %q: %v", b.String(), err)
+			}
+			if e.Key != expect.Key || e.Mapping != expect.Mapping || e.MappingType != expect.MappingType {
+				t.Errorf("Expected %v to match %v mapping %v with key %v, got %v mapping %v with key %v",
+					path, expect.MappingType, expect.Mapping, expect.Key, e.MappingType, e.Mapping, e.Key)
+			}
+			if e.UserAgent != "test" || e.ForwardedFor != "192.0.2.1" || e.Status != res.StatusCode {
+				t.Errorf("Unexpected access log entry for %v: %v", path, b.String())
+			}
+		}
+	})
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	b := &bytes.Buffer{}
+	rt := &Runtime{
+		Logger:       newLogger(b, TextLog, InfoLevel),
+		AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
+	}
+	rt.SetConfig(&Config{})
+
+	h := WrapHandler(rt, "redirect", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(fmt.Errorf("test failure"))
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %v, got %v", http.StatusInternalServerError, w.Code)
+	}
+
+	s := b.String()
+	for _, expect := range []string{" ERROR Error: test failure ", " url=/fail", "\nstack:\n\tgoroutine ", "TestErrorStackTrace"} {
+		if !strings.Contains(s, expect) {
+			t.Errorf("Expected %q in error log, got:\n%v", expect, s)
+		}
+	}
+}
+
+func TestErrorWithoutTemplate(t *testing.T) {
+	b := &bytes.Buffer{}
+	rt := &Runtime{
+		Logger:       newLogger(b, TextLog, InfoLevel),
+		AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
+	}
+	rt.SetConfig(&Config{})
+
+	h := WrapHandler(rt, "management", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(NewHTTPError(http.StatusForbidden, nil))
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/mappings/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %v, got %v", http.StatusForbidden, w.Code)
+	}
+
+	if body := w.Body.String(); body != "403 Forbidden\n" {
+		t.Errorf("Expected plain text body, got %q", body)
+	}
+
+	if b.Len() > 0 {
+		t.Errorf("Expected nothing logged, got:\n%v", b.String())
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp/syntax"
+	"strings"
+)
+
+// Roles of management API tokens.
+const (
+	ReadRole  = "read"  // may only read mappings, history and statistics
+	WriteRole = "write" // may also add, change and remove mappings
+)
+
+// TokenEnv is the environment variable read by the management client for the
+// management API token if none is given on the command line.
+const TokenEnv = "REDIRECTOR_TOKEN"
+
+var (
+	UnknownRoleError    = fmt.Errorf("Unknown token role")
+	InvalidHashError    = fmt.Errorf("Token hash must be a hex encoded SHA-256 hash")
+	DuplicateTokenError = fmt.Errorf("Duplicate token name")
+)
+
+// An APIToken grants access to the management API. Only the SHA-256 hash of
+// the token is stored in the configuration.
+type APIToken struct {
+	Name     string   `json:"name"`               // recorded as the actor of changes made with the token
+	Hash     Secret   `json:"sha256"`             // hex encoded SHA-256 hash of the token; redacted in JSON
+	Role     string   `json:"role"`               // read or write
+	Prefixes []string `json:"prefixes,omitempty"` // mapping key prefixes the token is limited to; empty for all keys
+}
+
+// APITokens are the tokens accepted by the management API. Authentication is
+// disabled if no tokens are configured.
+type APITokens []*APIToken
+
+// Validate returns an error if any token is not valid.
+func (c APITokens) Validate() error {
+	names := make(map[string]bool, len(c))
+	for _, t := range c {
+		if t.Name == "" {
+			return fmt.Errorf("Token name not specified")
+		}
+
+		if names[t.Name] {
+			return fmt.Errorf("%v: %v", DuplicateTokenError, t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Role != ReadRole && t.Role != WriteRole {
+			return fmt.Errorf("%v for token %v: %v", UnknownRoleError, t.Name, t.Role)
+		}
+
+		if b, err := hex.DecodeString(string(t.Hash)); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%v: %v", InvalidHashError, t.Name)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the token with the given secret, or nil if the secret does not
+// match any token.
+func (c APITokens) Match(secret string) *APIToken {
+	sum := sha256.Sum256([]byte(secret))
+	for _, t := range c {
+		b, err := hex.DecodeString(string(t.Hash))
+		if err != nil {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(sum[:], b) == 1 {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Allows returns true if the token grants the given role.
+func (t *APIToken) Allows(role string) bool {
+	return role == ReadRole || t.Role == WriteRole
+}
+
+// InScope returns true if the token grants access to the given mapping key.
+func (t *APIToken) InScope(key string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range t.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MappingInScope returns true if the token grants access to the given mapping
+// with the given key. A regexp mapping is only in scope if its pattern is
+// anchored at the start of the key and its literal prefix is in scope, as an
+// unanchored pattern can match keys outside of the token prefixes.
+func (t *APIToken) MappingInScope(m *Mapping, key string) bool {
+	if len(t.Prefixes) == 0 || m.Type != RegexpMapping {
+		return t.InScope(key)
+	}
+
+	prefix, ok := regexpPrefix(key)
+	return ok && t.InScope(prefix)
+}
+
+// regexpPrefix returns the literal string that every match of an anchored
+// regular expression starts with. It returns false if the expression is not
+// anchored at the start of the text.
+func regexpPrefix(expr string) (string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+
+	if re.Op == syntax.OpBeginText {
+		return "", true
+	}
+
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+
+	if len(re.Sub) > 1 && re.Sub[1].Op == syntax.OpLiteral && re.Sub[1].Flags&syntax.FoldCase == 0 {
+		return string(re.Sub[1].Rune), true
+	}
+
+	return "", true
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token, as stored in the
+// configuration.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken returns a new random token secret.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Secret is a configuration string that is redacted when encoded.
+type Secret string
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+
+	return json.Marshal("********")
+}
+
+type tokenContextKey struct{}
+
+// withToken returns a copy of the request with the given authenticated token.
+func withToken(r *http.Request, t *APIToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t))
+}
+
+// requestToken returns the authenticated token of a request, or nil if the
+// request was not authenticated.
+func requestToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(tokenContextKey{}).(*APIToken)
+	return t
+}
+
+// authenticate returns the token given in the Authorization header of a
+// request. It panics with 401 if no known token is given, or with 403 if the
+// token does not grant the given role. Requests are not authenticated if no
+// tokens are given, and nil is returned.
+func authenticate(tokens APITokens, w http.ResponseWriter, r *http.Request, role string) *APIToken {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	s := r.Header.Get("Authorization")
+	if !strings.HasPrefix(s, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+PACKAGE_NAME+`"`)
+		panic(NewHTTPErrorf(http.StatusUnauthorized, "No bearer token given"))
+	}
+
+	t := tokens.Match(strings.TrimSpace(strings.TrimPrefix(s, "Bearer ")))
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+PACKAGE_NAME+`", error="invalid_token"`)
+		panic(NewHTTPErrorf(http.StatusUnauthorized, "Invalid bearer token"))
+	}
+
+	if !t.Allows(role) {
+		panic(NewHTTPErrorf(http.StatusForbidden, "Token %v does not grant the %v role", t.Name, role))
+	}
+
+	return t
+}
+
+// checkScope panics with 403 if the token of a request is limited to mapping
+// key prefixes that do not include the given key.
+func checkScope(r *http.Request, key string) {
+	if t := requestToken(r); t != nil && !t.InScope(key) {
+		panic(NewHTTPErrorf(http.StatusForbidden, "Token %v does not grant access to %v", t.Name, key))
+	}
+}
+
+// checkMappingScope panics with 403 if the token of a request does not grant
+// access to the given mapping with the given key.
+func checkMappingScope(r *http.Request, m *Mapping, key string) {
+	if t := requestToken(r); t != nil && !t.MappingInScope(m, key) {
+		panic(NewHTTPErrorf(http.StatusForbidden, "Token %v does not grant access to %v", t.Name, key))
+	}
+}
+
+// checkStoredMappingScope panics with 403 if the token of a request is limited
+// to mapping key prefixes and does not grant access to the mapping currently
+// stored with the given key, such as an unanchored regexp mapping whose key
+// starts with one of the prefixes.
+func checkStoredMappingScope(r *http.Request, db Database, key string) {
+	if t := requestToken(r); t == nil || len(t.Prefixes) == 0 {
+		return
+	}
+
+	m, err := db.GetMapping(key)
+	if err == MappingNotFoundError {
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	checkMappingScope(r, m, key)
+}
+
+// checkUnscoped panics with 403 if the token of a request is limited to any
+// mapping key prefixes.
+func checkUnscoped(r *http.Request) {
+	if t := requestToken(r); t != nil && len(t.Prefixes) > 0 {
+		panic(NewHTTPErrorf(http.StatusForbidden, "Token %v is limited to mapping key prefixes", t.Name))
+	}
+}
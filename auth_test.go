@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPITokensValidate(t *testing.T) {
+	hash := HashToken("secret")
+	tests := []struct {
+		Tokens APITokens
+		OK     bool
+	}{
+		{APITokens{{Name: "deploy", Hash: Secret(hash), Role: WriteRole}}, true},
+		{APITokens{{Name: "deploy", Hash: Secret(hash), Role: ReadRole, Prefixes: []string{"/blog/"}}}, true},
+		{APITokens{{Hash: Secret(hash), Role: WriteRole}}, false},
+		{APITokens{{Name: "deploy", Hash: Secret(hash), Role: "admin"}}, false},
+		{APITokens{{Name: "deploy", Hash: Secret("secret"), Role: WriteRole}}, false},
+		{APITokens{{Name: "deploy", Hash: Secret(hash[:32]), Role: WriteRole}}, false},
+		{APITokens{{Name: "deploy", Hash: Secret(hash), Role: WriteRole}, {Name: "deploy", Hash: Secret(hash), Role: ReadRole}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.Tokens.Validate(); (err == nil) != test.OK {
+			t.Errorf("Expected valid=%v for tokens %v, got: %v", test.OK, i, err)
+		}
+	}
+}
+
+func TestManagementAuth(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		rt.Config().MgmtTokens = APITokens{
+			{Name: "reader", Hash: Secret(HashToken("read-secret")), Role: ReadRole},
+			{Name: "writer", Hash: Secret(HashToken("write-secret")), Role: WriteRole},
+			{Name: "blog", Hash: Secret(HashToken("blog-secret")), Role: WriteRole, Prefixes: []string{"/blog/"}},
+		}
+
+		status := func(token, method, path string) int {
+			client.Token = token
+			res, err := client.do(method, client.endpoint(path, nil), "", nil)
+			if err != nil {
+				panic(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header with status 401")
+			}
+
+			return res.StatusCode
+		}
+
+		tests := []struct {
+			Token  string
+			Method string
+			Path   string
+			Status int
+		}{
+			{"", "GET", "/stats/", http.StatusUnauthorized},
+			{"wrong-secret", "GET", "/stats/", http.StatusUnauthorized},
+			{"read-secret", "GET", "/stats/", http.StatusOK},
+			{"read-secret", "GET", "/mappings/", http.StatusOK},
+			{"read-secret", "DELETE", "/mappings/", http.StatusForbidden},
+			{"blog-secret", "GET", "/mappings/", http.StatusForbidden},
+			{"blog-secret", "GET", "/mappings/?prefix=%2Fblog%2F", http.StatusOK},
+			{"blog-secret", "GET", "/config/", http.StatusForbidden},
+			{"blog-secret", "DELETE", "/mappings/", http.StatusForbidden},
+			{"blog-secret", "GET", "/mappings/%2Fother", http.StatusForbidden},
+			{"blog-secret", "GET", "/mappings/%2Fblog%2Fmissing", http.StatusNotFound},
+			{"writer", "GET", "/stats/", http.StatusUnauthorized},
+		}
+
+		for _, test := range tests {
+			if code := status(test.Token, test.Method, test.Path); code != test.Status {
+				t.Errorf("Expected status %v for %v %v with token %q, got %v", test.Status, test.Method, test.Path, test.Token, code)
+			}
+		}
+
+		client.Token = "read-secret"
+		if err := client.AddMapping(&Mapping{Key: "/blog/post", Destination: "/okay"}); err == nil {
+			t.Errorf("Expected error adding mapping with read token")
+		}
+
+		client.Token = "blog-secret"
+		if err := client.AddMappings([]*Mapping{{Key: "/blog/post", Destination: "/okay"}, {Key: "/other", Destination: "/okay"}}); err == nil {
+			t.Errorf("Expected error adding mapping outside of token prefixes")
+		}
+
+		if err := client.AddMapping(&Mapping{Key: "/blog/post", Destination: "/okay"}); err != nil {
+			t.Fatalf("Error adding mapping with scoped token: %v", err)
+		}
+
+		if err := client.PutMapping("/blog/post", &Mapping{Key: "/other", Destination: "/okay"}, AnyRevision); err == nil {
+			t.Errorf("Expected error renaming mapping outside of token prefixes")
+		}
+
+		// changes are recorded with the name of the token
+		history, err := client.GetHistory("/blog/post")
+		if err != nil {
+			t.Fatalf("Error getting history: %v", err)
+		}
+
+		if len(history) != 1 || history[0].Actor != "blog" {
+			t.Errorf("Expected one change by blog, got %v", history)
+		}
+	})
+}
+
+func TestRegexpMappingScope(t *testing.T) {
+	token := &APIToken{Name: "blog", Prefixes: []string{"/blog/"}}
+	tests := []struct {
+		Key string
+		OK  bool
+	}{
+		{`^/blog/(?P<id>[0-9]+)$`, true},
+		{`\A/blog/posts/.*`, true},
+		{`^/blog/|.*`, false},
+		{`/blog/`, false},
+		{`.*/blog/`, false},
+		{`^/blog`, false},
+		{`^/(?:blog|other)/`, false},
+		{`(?i)^/blog/`, false},
+		{`(?m)^/blog/`, false},
+		{`^`, false},
+		{`^/blog/(`, false},
+	}
+
+	for _, test := range tests {
+		m := &Mapping{Key: test.Key, Type: RegexpMapping}
+		if ok := token.MappingInScope(m, m.Key); ok != test.OK {
+			t.Errorf("Expected in scope=%v for regexp mapping %v, got %v", test.OK, test.Key, ok)
+		}
+	}
+
+	if !(&APIToken{}).MappingInScope(&Mapping{Key: ".*", Type: RegexpMapping}, ".*") {
+		t.Errorf("Expected any regexp mapping in scope of an unscoped token")
+	}
+
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		rt.Config().MgmtTokens = APITokens{
+			{Name: "blog", Hash: Secret(HashToken("blog-secret")), Role: WriteRole, Prefixes: []string{"/blog/"}},
+		}
+		client.Token = "blog-secret"
+
+		if err := client.AddMapping(&Mapping{Key: `/blog/|.*`, Type: RegexpMapping, Destination: "/okay"}); err == nil {
+			t.Errorf("Expected error adding unanchored regexp mapping with scoped token")
+		}
+
+		if err := client.AddMapping(&Mapping{Key: `^/blog/(?P<id>[0-9]+)$`, Type: RegexpMapping, Destination: "/okay"}); err != nil {
+			t.Errorf("Error adding anchored regexp mapping with scoped token: %v", err)
+		}
+
+		// existing unanchored regexp mappings are out of scope, even though
+		// their keys start with a token prefix
+		if err := rt.Database.AddMapping(&Mapping{Key: `/blog/|/admin`, Type: RegexpMapping, Destination: "/okay"}); err != nil {
+			panic(err)
+		}
+
+		if _, err := client.GetMapping(`/blog/|/admin`); err == nil {
+			t.Errorf("Expected error getting unanchored regexp mapping with scoped token")
+		}
+
+		if err := client.PutMapping(`/blog/|/admin`, &Mapping{Key: "/blog/renamed", Destination: "/okay"}, AnyRevision); err == nil {
+			t.Errorf("Expected error renaming unanchored regexp mapping with scoped token")
+		}
+
+		if err := client.AddMapping(&Mapping{Key: `/blog/|/admin`, Destination: "/okay"}); err == nil {
+			t.Errorf("Expected error replacing unanchored regexp mapping with scoped token")
+		}
+
+		if err := client.RemoveMapping(&Mapping{Key: `/blog/|/admin`}); err == nil {
+			t.Errorf("Expected error removing unanchored regexp mapping with scoped token")
+		}
+
+		if m, err := rt.Database.GetMapping(`/blog/|/admin`); err != nil || m.Type != RegexpMapping {
+			t.Errorf("Expected unanchored regexp mapping to be unchanged, got %v, %v", m, err)
+		}
+	})
+}
+
+func TestMgmtTokenRedacted(t *testing.T) {
+	b, err := json.Marshal(&Config{MgmtToken: "secret"})
+	if err != nil {
+		panic(err)
+	}
+
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("Expected management token to be redacted, got: %s", b)
+	}
+
+	hash := HashToken("secret")
+	b, err = json.Marshal(&Config{MgmtTokens: APITokens{{Name: "deploy", Hash: Secret(hash), Role: ReadRole}}})
+	if err != nil {
+		panic(err)
+	}
+
+	if strings.Contains(string(b), hash) {
+		t.Errorf("Expected token hashes to be redacted, got: %s", b)
+	}
+}
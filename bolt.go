@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -9,40 +13,210 @@ import (
 
 var (
 	MAPPINGS_BUCKET = []byte("mappings")
+	PREFIXES_BUCKET = []byte("prefixes") // index of prefix mapping keys
+	REGEXPS_BUCKET  = []byte("regexps")  // index of regexp mapping keys
+	EXPIRY_BUCKET   = []byte("expiry")   // index of mapping keys by expiry time
+	HITS_BUCKET     = []byte("hits")
+	MISSES_BUCKET   = []byte("misses")
+	SEEN_BUCKET     = []byte("seen")    // index of missing keys by time last seen
+	HISTORY_BUCKET  = []byte("history") // changes keyed by mapping key and sequence
+	HOSTS_BUCKET    = []byte("hosts")   // contains a nested namespace bucket per host
 )
 
+// boltBuckets are the buckets created in each namespace.
+var boltBuckets = [][]byte{
+	MAPPINGS_BUCKET,
+	PREFIXES_BUCKET,
+	REGEXPS_BUCKET,
+	EXPIRY_BUCKET,
+	HITS_BUCKET,
+	MISSES_BUCKET,
+	SEEN_BUCKET,
+	HISTORY_BUCKET,
+}
+
+// boltIndexBuckets maps each non-exact mapping type to the bucket that indexes
+// the keys of all mappings of that type.
+var boltIndexBuckets = map[MappingType][]byte{
+	PrefixMapping: PREFIXES_BUCKET,
+	RegexpMapping: REGEXPS_BUCKET,
+}
+
+func init() {
+	RegisterDriver("bolt", &Driver{
+		Open:    OpenBoltDatabase,
+		Options: newBoltOptions,
+	})
+}
+
+// BoltOptions are the database options of the bolt driver.
+type BoltOptions struct {
+	Path    string   `json:"path"`    // path to the database file
+	Timeout Duration `json:"timeout"` // time to wait for a lock on the database file
+}
+
+// newBoltOptions returns the default options of the bolt driver.
+func newBoltOptions(cfg *Config) interface{} {
+	opts := &BoltOptions{
+		Path:    "./redirector.db",
+		Timeout: Duration{3 * time.Second},
+	}
+
+	if cfg.DatabasePath != "" {
+		opts.Path = cfg.DatabasePath
+	}
+
+	return opts
+}
+
 // BoltDatabase implements Database to enable storage of URL mappings in a
 // memory-mapped BoltDB data store.
 type BoltDatabase struct {
-	cfg *Config
-	bdb *bolt.DB
+	cfg        *Config
+	path       string
+	bdb        *bolt.DB
+	ns         []byte               // host namespace or nil for the default namespace
+	namespaces *sync.Map            // namespaces known to exist, shared by all views
+	regexps    *boltRegexpSnapshots // sorted regexp mappings, shared by all views
+}
+
+// boltRegexpSnapshots holds the sorted regexp mappings of each namespace, so
+// that lookups do not decode and sort them for every request. All snapshots
+// are discarded when any regexp mapping is modified. Bolt databases are only
+// opened by a single process, so no other process can modify them.
+type boltRegexpSnapshots struct {
+	mu        sync.Mutex
+	gen       int64                 // incremented when regexp mappings are modified
+	snapshots map[string][]*Mapping // snapshots of the current generation
+}
+
+// get returns the snapshot of the given namespace, if any, and the current
+// generation.
+func (c *boltRegexpSnapshots) get(ns string) ([]*Mapping, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mappings, ok := c.snapshots[ns]
+	return mappings, c.gen, ok
+}
+
+// put stores the snapshot of the given namespace if it was read in the
+// current generation.
+func (c *boltRegexpSnapshots) put(gen int64, ns string, mappings []*Mapping) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen == c.gen {
+		c.snapshots[ns] = mappings
+	}
+}
+
+// invalidate discards all snapshots.
+func (c *boltRegexpSnapshots) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.snapshots = make(map[string][]*Mapping)
+}
+
+// checkBoltDatabase returns an error if the configured bolt database cannot be
+// opened for writing. It does not wait for the file lock held by another
+// process.
+func checkBoltDatabase(cfg *Config) error {
+	opts := newBoltOptions(cfg).(*BoltOptions)
+	if err := decodeDatabaseOptions(cfg, opts); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
 }
 
 func OpenBoltDatabase(cfg *Config) (Database, error) {
-	options := &bolt.Options{
-		Timeout: 3 * time.Second,
+	opts := newBoltOptions(cfg).(*BoltOptions)
+	if err := decodeDatabaseOptions(cfg, opts); err != nil {
+		return nil, err
 	}
 
-	bdb, err := bolt.Open(cfg.DatabasePath, 0600, options)
+	bdb, err := bolt.Open(opts.Path, 0600, &bolt.Options{
+		Timeout: opts.Timeout.Duration,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	bdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(MAPPINGS_BUCKET)
-		if err != nil {
-			return err
+		for _, name := range append(boltBuckets, HOSTS_BUCKET) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
 
 		return nil
 	})
 
 	return &BoltDatabase{
-		cfg: cfg,
-		bdb: bdb,
+		cfg:        cfg,
+		path:       opts.Path,
+		bdb:        bdb,
+		namespaces: &sync.Map{},
+		regexps:    &boltRegexpSnapshots{snapshots: make(map[string][]*Mapping)},
+	}, nil
+}
+
+// Namespace returns a view of the database in which all mappings are stored
+// in a nested bucket of the hosts bucket, named for the given host. The
+// buckets are created if they do not already exist.
+func (db *BoltDatabase) Namespace(name string) (Database, error) {
+	if name == "" {
+		return &BoltDatabase{cfg: db.cfg, path: db.path, bdb: db.bdb, namespaces: db.namespaces, regexps: db.regexps}, nil
+	}
+
+	if _, ok := db.namespaces.Load(name); !ok {
+		if err := db.bdb.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket(HOSTS_BUCKET).CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for _, name := range boltBuckets {
+				if _, err := b.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		db.namespaces.Store(name, true)
+	}
+
+	return &BoltDatabase{
+		cfg:        db.cfg,
+		path:       db.path,
+		bdb:        db.bdb,
+		ns:         []byte(name),
+		namespaces: db.namespaces,
+		regexps:    db.regexps,
 	}, nil
 }
 
+// bucket returns the named bucket within the namespace of the database.
+func (db *BoltDatabase) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if db.ns == nil {
+		return tx.Bucket(name)
+	}
+
+	return tx.Bucket(HOSTS_BUCKET).Bucket(db.ns).Bucket(name)
+}
+
 func (db *BoltDatabase) Close() error {
 	return db.bdb.Close()
 }
@@ -50,14 +224,14 @@ func (db *BoltDatabase) Close() error {
 func (db *BoltDatabase) Stats() (DatabaseStats, error) {
 	stats := DatabaseStats{}
 
-	if fi, err := os.Stat(db.cfg.DatabasePath); err != nil {
+	if fi, err := os.Stat(db.path); err != nil {
 		return DatabaseStats{}, err
 	} else {
 		stats.DiskUsage = fi.Size()
 	}
 
 	if err := db.bdb.View(func(tx *bolt.Tx) error {
-		bdbstats := tx.Bucket(MAPPINGS_BUCKET).Stats()
+		bdbstats := db.bucket(tx, MAPPINGS_BUCKET).Stats()
 		stats.TotalMappings = int64(bdbstats.KeyN)
 		return nil
 	}); err != nil {
@@ -69,7 +243,7 @@ func (db *BoltDatabase) Stats() (DatabaseStats, error) {
 
 func (db *BoltDatabase) get(b, k []byte, v interface{}) error {
 	return db.bdb.View(func(tx *bolt.Tx) error {
-		vb := tx.Bucket(b).Get(k)
+		vb := db.bucket(tx, b).Get(k)
 		if vb == nil {
 			return MappingNotFoundError
 		}
@@ -85,18 +259,151 @@ func (db *BoltDatabase) add(b, k []byte, v interface{}) error {
 			return err
 		}
 
-		return tx.Bucket(b).Put(k, vb)
+		return db.bucket(tx, b).Put(k, vb)
 	})
 }
 
 func (db *BoltDatabase) delete(b, k []byte) error {
 	return db.bdb.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(b).Delete(k)
+		return db.bucket(tx, b).Delete(k)
 	})
 }
 
+// boltTimeKey returns the index key of a key at the given time, such as the
+// expiry time of a mapping. Index keys sort by time.
+func boltTimeKey(t time.Time, key string) []byte {
+	b := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return append(b, key...)
+}
+
+// putMapping stores a mapping and maintains all indexes within the given
+// transaction.
+func (db *BoltDatabase) putMapping(tx *bolt.Tx, m *Mapping) error {
+	vb, err := MarshallBinary(m)
+	if err != nil {
+		return err
+	}
+
+	if err := db.deleteMapping(tx, m.Key); err != nil {
+		return err
+	}
+
+	k := []byte(m.Key)
+	if err := db.bucket(tx, MAPPINGS_BUCKET).Put(k, vb); err != nil {
+		return err
+	}
+
+	if name, ok := boltIndexBuckets[m.Type]; ok {
+		if err := db.bucket(tx, name).Put(k, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	if m.Type == RegexpMapping {
+		tx.OnCommit(db.regexps.invalidate)
+	}
+
+	if m.NotAfter != nil {
+		if err := db.bucket(tx, EXPIRY_BUCKET).Put(boltTimeKey(*m.NotAfter, m.Key), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteMapping deletes a mapping and its index entries within the given
+// transaction.
+func (db *BoltDatabase) deleteMapping(tx *bolt.Tx, key string) error {
+	k := []byte(key)
+	b := db.bucket(tx, MAPPINGS_BUCKET)
+	vb := b.Get(k)
+	if vb == nil {
+		return nil
+	}
+
+	m := &Mapping{}
+	if err := UnmarshallBinary(vb, m); err != nil {
+		return err
+	}
+
+	for _, name := range boltIndexBuckets {
+		if err := db.bucket(tx, name).Delete(k); err != nil {
+			return err
+		}
+	}
+
+	if m.Type == RegexpMapping {
+		tx.OnCommit(db.regexps.invalidate)
+	}
+
+	if m.NotAfter != nil {
+		if err := db.bucket(tx, EXPIRY_BUCKET).Delete(boltTimeKey(*m.NotAfter, key)); err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(k)
+}
+
+// deleteMappingHits deletes the recorded hits of a mapping within the given
+// transaction.
+func (db *BoltDatabase) deleteMappingHits(tx *bolt.Tx, key string) error {
+	return db.bucket(tx, HITS_BUCKET).Delete([]byte(key))
+}
+
 func (db *BoltDatabase) AddMapping(m *Mapping) error {
-	return db.add(MAPPINGS_BUCKET, []byte(m.Key), m)
+	_, err := db.AddMappingIf(m, AnyRevision, "")
+	return err
+}
+
+// AddMappingIf adds or replaces a mapping if the stored mapping matches the
+// given revision, and records the change in the history of the mapping key in
+// the same transaction. The mapping is stored with its normalized key.
+func (db *BoltDatabase) AddMappingIf(m *Mapping, rev int64, actor string) (*MappingChange, error) {
+	key := db.cfg.Normalize.MappingKey(m)
+	var change *MappingChange
+	if err := db.bdb.Update(func(tx *bolt.Tx) error {
+		cur, err := db.getMapping(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := checkRevision(cur, rev); err != nil {
+			return err
+		}
+
+		nextRevision(m, cur)
+		v := *m
+		v.Key = key
+		if err := db.putMapping(tx, &v); err != nil {
+			return err
+		}
+
+		change = newChange(key, cur, &v, actor, *v.Modified)
+		return db.addChange(tx, change)
+	}); err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+// getMapping returns the stored mapping with the given key, or nil if it does
+// not exist.
+func (db *BoltDatabase) getMapping(tx *bolt.Tx, key string) (*Mapping, error) {
+	vb := db.bucket(tx, MAPPINGS_BUCKET).Get([]byte(key))
+	if vb == nil {
+		return nil, nil
+	}
+
+	m := &Mapping{}
+	if err := UnmarshallBinary(vb, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
 }
 
 func (db *BoltDatabase) GetMapping(key string) (*Mapping, error) {
@@ -108,10 +415,79 @@ func (db *BoltDatabase) GetMapping(key string) (*Mapping, error) {
 	return m, nil
 }
 
+// GetPrefixMapping returns the prefix mapping with the longest key that is a
+// prefix of the given key.
+func (db *BoltDatabase) GetPrefixMapping(key string) (*Mapping, error) {
+	m := &Mapping{}
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		c := db.bucket(tx, PREFIXES_BUCKET).Cursor()
+		k := []byte(key)
+		for {
+			// find the greatest indexed key that is less than or equal to k
+			ik, _ := c.Seek(k)
+			if ik == nil {
+				ik, _ = c.Last()
+			} else if !bytes.Equal(ik, k) {
+				ik, _ = c.Prev()
+			}
+			if ik == nil {
+				return MappingNotFoundError
+			}
+
+			if bytes.HasPrefix(k, ik) {
+				vb := db.bucket(tx, MAPPINGS_BUCKET).Get(ik)
+				if vb == nil {
+					return MappingNotFoundError
+				}
+				return UnmarshallBinary(vb, m)
+			}
+
+			// any shorter match must also be a prefix of the common prefix
+			k = []byte(commonPrefix(string(k), string(ik)))
+			if len(k) == 0 {
+				return MappingNotFoundError
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GetRegexpMappings returns all regexp mappings in evaluation order. The
+// sorted mappings are kept in memory until any regexp mapping is modified.
+func (db *BoltDatabase) GetRegexpMappings() ([]*Mapping, error) {
+	mappings, gen, ok := db.regexps.get(string(db.ns))
+	if ok {
+		return copyMappings(mappings), nil
+	}
+
+	mappings = make([]*Mapping, 0)
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, MAPPINGS_BUCKET)
+		return db.bucket(tx, REGEXPS_BUCKET).ForEach(func(k, v []byte) error {
+			m := &Mapping{}
+			if err := UnmarshallBinary(b.Get(k), m); err != nil {
+				return err
+			}
+
+			mappings = append(mappings, m)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sortRegexpMappings(mappings)
+	db.regexps.put(gen, string(db.ns), copyMappings(mappings))
+	return mappings, nil
+}
+
 func (db *BoltDatabase) GetMappings() ([]*Mapping, error) {
 	mappings := make([]*Mapping, 0)
 	if err := db.bdb.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(MAPPINGS_BUCKET)
+		b := db.bucket(tx, MAPPINGS_BUCKET)
 		return b.ForEach(func(k, v []byte) error {
 			m := &Mapping{}
 			if err := UnmarshallBinary(v, m); err != nil {
@@ -129,28 +505,643 @@ func (db *BoltDatabase) GetMappings() ([]*Mapping, error) {
 	return mappings, nil
 }
 
+// ListMappings returns a page of mappings in key order. The cursor of the next
+// page is the key of the last mapping in the page.
+func (db *BoltDatabase) ListMappings(opts ListOptions) ([]*Mapping, string, error) {
+	mappings := make([]*Mapping, 0)
+	next := ""
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		c := db.bucket(tx, MAPPINGS_BUCKET).Cursor()
+		start := []byte(opts.Prefix)
+		if opts.After > opts.Prefix {
+			start = []byte(opts.After)
+		}
+
+		prefix := []byte(opts.Prefix)
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if string(k) <= opts.After {
+				continue
+			}
+
+			if opts.Limit > 0 && len(mappings) == opts.Limit {
+				next = mappings[len(mappings)-1].Key
+				return nil
+			}
+
+			m := &Mapping{}
+			if err := UnmarshallBinary(v, m); err != nil {
+				return err
+			}
+
+			if opts.Match(m) {
+				mappings = append(mappings, m)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return mappings, next, nil
+}
+
 func (db *BoltDatabase) DeleteMapping(key string) error {
-	return db.delete(MAPPINGS_BUCKET, []byte(key))
+	_, err := db.DeleteMappingIf(key, AnyRevision, "")
+	return err
 }
 
-func (db *BoltDatabase) DeleteMappings() (int64, error) {
+// DeleteMappingIf deletes a mapping and its recorded hits if the stored
+// mapping matches the given revision, and records the change in the history of
+// the mapping key in the same transaction.
+func (db *BoltDatabase) DeleteMappingIf(key string, rev int64, actor string) (*MappingChange, error) {
+	var change *MappingChange
+	if err := db.bdb.Update(func(tx *bolt.Tx) error {
+		cur, err := db.getMapping(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if cur == nil {
+			return MappingNotFoundError
+		}
+
+		if err := checkRevision(cur, rev); err != nil {
+			return err
+		}
+
+		change = newChange(key, cur, nil, actor, time.Now())
+		return db.removeMapping(tx, change)
+	}); err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+// removeMapping deletes the previous mapping of a delete change and its
+// recorded hits, and records the change, within the given transaction.
+func (db *BoltDatabase) removeMapping(tx *bolt.Tx, change *MappingChange) error {
+	if err := db.deleteMappingHits(tx, change.Key); err != nil {
+		return err
+	}
+
+	if err := db.deleteMapping(tx, change.Key); err != nil {
+		return err
+	}
+
+	return db.addChange(tx, change)
+}
+
+// DeleteExpiredMappings deletes all mappings that expired before the given
+// time, and records their deletion in the history of each mapping key.
+func (db *BoltDatabase) DeleteExpiredMappings(before time.Time, actor string) (int64, error) {
 	var count int64
 	err := db.bdb.Update(func(tx *bolt.Tx) error {
-		// deleting and recreating a bucket in the same transaction does not
-		// seem to be an effective way to clear a bucket
-		b := tx.Bucket(MAPPINGS_BUCKET)
-		return b.ForEach(func(k, v []byte) error {
-			if err := b.Delete(k); err != nil {
+		limit := boltTimeKey(before, "")
+		keys := make([]string, 0)
+		c := db.bucket(tx, EXPIRY_BUCKET).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.Next() {
+			keys = append(keys, string(k[8:]))
+		}
+
+		now := time.Now()
+		for _, key := range keys {
+			m, err := db.getMapping(tx, key)
+			if err != nil {
+				return err
+			}
+
+			if m == nil {
+				continue
+			}
+
+			if err := db.removeMapping(tx, newChange(key, m, nil, actor, now)); err != nil {
 				return err
 			}
 			count++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// boltDeletePageSize is the number of mappings deleted in each transaction by
+// DeleteMappings.
+var boltDeletePageSize = 1000
+
+// DeleteMappings deletes all mappings in the namespace and their recorded
+// hits, and records their deletion in the history of each mapping key.
+// Mappings are deleted in transactions of up to boltDeletePageSize mappings.
+func (db *BoltDatabase) DeleteMappings(actor string) (int64, error) {
+	var count int64
+	for {
+		var n int
+		if err := db.bdb.Update(func(tx *bolt.Tx) error {
+			mappings := make([]*Mapping, 0)
+			c := db.bucket(tx, MAPPINGS_BUCKET).Cursor()
+			for k, v := c.First(); k != nil && len(mappings) < boltDeletePageSize; k, v = c.Next() {
+				m := &Mapping{}
+				if err := UnmarshallBinary(v, m); err != nil {
+					return err
+				}
+
+				m.Key = string(k)
+				mappings = append(mappings, m)
+			}
+
+			now := time.Now()
+			for _, m := range mappings {
+				if err := db.removeMapping(tx, newChange(m.Key, m, nil, actor, now)); err != nil {
+					return err
+				}
+			}
+
+			n = len(mappings)
 			return nil
-		})
+		}); err != nil {
+			return count, err
+		}
+
+		count += int64(n)
+		if n < boltDeletePageSize {
+			break
+		}
+	}
+
+	// hits recorded for keys without a mapping
+	if err := db.bdb.Update(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, HITS_BUCKET)
+		keys := make([][]byte, 0)
+		if err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// rekeyActor is the actor recorded in the history of mappings renamed by
+// RekeyMappings.
+const rekeyActor = "rekey"
+
+// RekeyMappings renames all mappings in all namespaces whose keys are not
+// normalized according to the current configuration. The recorded hits of each
+// renamed mapping are moved to its new key, and the deletion of the old key and
+// the addition of the new key are recorded in their history. Mappings whose
+// normalized key is already in use are not renamed and their keys are returned
+// as conflicts, prefixed with the host name of their namespace, if any.
+func (db *BoltDatabase) RekeyMappings() (int64, []string, error) {
+	var count int64
+	conflicts := make([]string, 0)
+	err := db.bdb.Update(func(tx *bolt.Tx) error {
+		namespaces := [][]byte{nil}
+		if err := tx.Bucket(HOSTS_BUCKET).ForEach(func(k, v []byte) error {
+			namespaces = append(namespaces, append([]byte{}, k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, ns := range namespaces {
+			view := &BoltDatabase{cfg: db.cfg, path: db.path, bdb: db.bdb, ns: ns, namespaces: db.namespaces, regexps: db.regexps}
+			mappings := make([]*Mapping, 0)
+			if err := view.bucket(tx, MAPPINGS_BUCKET).ForEach(func(k, v []byte) error {
+				m := &Mapping{}
+				if err := UnmarshallBinary(v, m); err != nil {
+					return err
+				}
+
+				mappings = append(mappings, m)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, m := range mappings {
+				key := db.cfg.Normalize.MappingKey(m)
+				if key == m.Key {
+					continue
+				}
+
+				if view.bucket(tx, MAPPINGS_BUCKET).Get([]byte(key)) != nil {
+					if ns == nil {
+						conflicts = append(conflicts, m.Key)
+					} else {
+						conflicts = append(conflicts, string(ns)+" "+m.Key)
+					}
+					continue
+				}
+
+				if err := view.rekeyMappingHits(tx, m.Key, key); err != nil {
+					return err
+				}
+
+				if err := view.deleteMapping(tx, m.Key); err != nil {
+					return err
+				}
+
+				v := *m
+				v.Key = key
+				nextRevision(&v, nil)
+				if err := view.putMapping(tx, &v); err != nil {
+					return err
+				}
+
+				if err := view.addChange(tx, newChange(m.Key, m, nil, rekeyActor, *v.Modified)); err != nil {
+					return err
+				}
+
+				if err := view.addChange(tx, newChange(key, nil, &v, rekeyActor, *v.Modified)); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+
+		return nil
 	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return count, conflicts, nil
+}
 
+// boltRecordBuckets returns a new record of the type stored in each bucket
+// that contains records.
+var boltRecordBuckets = map[string]func() interface{}{
+	string(MAPPINGS_BUCKET): func() interface{} { return &Mapping{} },
+	string(HITS_BUCKET):     func() interface{} { return &MappingHits{} },
+	string(MISSES_BUCKET):   func() interface{} { return &Miss{} },
+}
+
+// MigrateRecords rewrites all legacy gob records in all namespaces in the
+// current record format. Records are rewritten in a single transaction.
+func (db *BoltDatabase) MigrateRecords() (int64, error) {
+	var count int64
+	err := db.bdb.Update(func(tx *bolt.Tx) error {
+		// regexp mappings are rewritten without putMapping
+		tx.OnCommit(db.regexps.invalidate)
+
+		namespaces := [][]byte{nil}
+		if err := tx.Bucket(HOSTS_BUCKET).ForEach(func(k, v []byte) error {
+			namespaces = append(namespaces, append([]byte{}, k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, ns := range namespaces {
+			view := &BoltDatabase{cfg: db.cfg, path: db.path, bdb: db.bdb, ns: ns, namespaces: db.namespaces, regexps: db.regexps}
+			for name, newRecord := range boltRecordBuckets {
+				b := view.bucket(tx, []byte(name))
+				records := make(map[string][]byte)
+				if err := b.ForEach(func(k, v []byte) error {
+					vb, err := migrateRecord(v, newRecord())
+					if err != nil {
+						return fmt.Errorf("Error decoding %v record %q: %v", name, k, err)
+					}
+
+					if vb != nil {
+						records[string(k)] = vb
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+
+				// bolt does not allow modification during iteration
+				for k, vb := range records {
+					if err := b.Put([]byte(k), vb); err != nil {
+						return err
+					}
+					count++
+				}
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 
 	return count, nil
 }
+
+// boltHistoryKey returns the history bucket key of a change to the given
+// mapping key. Keys sort by mapping key and then by sequence.
+func boltHistoryKey(key string, seq uint64) []byte {
+	b := append([]byte(key), 0)
+	return binary.BigEndian.AppendUint64(b, seq)
+}
+
+// AddChanges appends the given changes to the history of each mapping key.
+func (db *BoltDatabase) AddChanges(changes []*MappingChange) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		for _, c := range changes {
+			if err := db.addChange(tx, c); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// addChange appends a change to the history of its mapping key within the
+// given transaction.
+func (db *BoltDatabase) addChange(tx *bolt.Tx, c *MappingChange) error {
+	b := db.bucket(tx, HISTORY_BUCKET)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	vb, err := MarshallBinary(c)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(boltHistoryKey(c.Key, seq), vb)
+}
+
+// GetHistory returns all changes to the given mapping key in the order they
+// were made.
+func (db *BoltDatabase) GetHistory(key string) ([]*MappingChange, error) {
+	changes := make([]*MappingChange, 0)
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		prefix := append([]byte(key), 0)
+		c := db.bucket(tx, HISTORY_BUCKET).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			// a longer mapping key may include the separator
+			if len(k) != len(prefix)+8 {
+				continue
+			}
+
+			change := &MappingChange{}
+			if err := UnmarshallBinary(v, change); err != nil {
+				return err
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// GetChanges returns all changes made since the given time, in the order they
+// were made.
+func (db *BoltDatabase) GetChanges(since time.Time) ([]*MappingChange, error) {
+	changes := make([]*MappingChange, 0)
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		return db.bucket(tx, HISTORY_BUCKET).ForEach(func(k, v []byte) error {
+			change := &MappingChange{}
+			if err := UnmarshallBinary(v, change); err != nil {
+				return err
+			}
+
+			if !change.Time.Before(since) {
+				changes = append(changes, change)
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+	return changes, nil
+}
+
+// rekeyMappingHits moves the recorded hits of a mapping to a new key within the
+// given transaction.
+func (db *BoltDatabase) rekeyMappingHits(tx *bolt.Tx, oldKey, newKey string) error {
+	b := db.bucket(tx, HITS_BUCKET)
+	vb := b.Get([]byte(oldKey))
+	if vb == nil {
+		return nil
+	}
+
+	h := &MappingHits{}
+	if err := UnmarshallBinary(vb, h); err != nil {
+		return err
+	}
+	h.Key = newKey
+
+	vb, err := MarshallBinary(h)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(newKey), vb); err != nil {
+		return err
+	}
+
+	return db.deleteMappingHits(tx, oldKey)
+}
+
+// AddHits adds the given hits to the recorded hits of each mapping.
+func (db *BoltDatabase) AddHits(hits []*MappingHits) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, HITS_BUCKET)
+		for _, h := range hits {
+			k := []byte(h.Key)
+			v := &MappingHits{Key: h.Key}
+			if vb := b.Get(k); vb != nil {
+				if err := UnmarshallBinary(vb, v); err != nil {
+					return err
+				}
+			}
+
+			v.Merge(h)
+			vb, err := MarshallBinary(v)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(k, vb); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetHits returns the recorded hits of the mappings with the given keys, or
+// of all mappings that have been hit if no keys are given.
+func (db *BoltDatabase) GetHits(keys ...string) ([]*MappingHits, error) {
+	hits := make([]*MappingHits, 0)
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, HITS_BUCKET)
+		add := func(k, v []byte) error {
+			h := &MappingHits{}
+			if err := UnmarshallBinary(v, h); err != nil {
+				return err
+			}
+
+			hits = append(hits, h)
+			return nil
+		}
+
+		if len(keys) == 0 {
+			return b.ForEach(add)
+		}
+
+		for _, key := range keys {
+			if v := b.Get([]byte(key)); v != nil {
+				if err := add(nil, v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+// AddMisses adds the given misses to the recorded misses of each key. Only the
+// max most recently seen keys are retained.
+func (db *BoltDatabase) AddMisses(misses []*Miss, max int) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, MISSES_BUCKET)
+		seen := db.bucket(tx, SEEN_BUCKET)
+		for _, m := range misses {
+			k := []byte(m.Key)
+			v := &Miss{Key: m.Key}
+			if vb := b.Get(k); vb != nil {
+				if err := UnmarshallBinary(vb, v); err != nil {
+					return err
+				}
+
+				if err := seen.Delete(boltTimeKey(v.LastSeen, v.Key)); err != nil {
+					return err
+				}
+			}
+
+			v.Merge(m)
+			vb, err := MarshallBinary(v)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(k, vb); err != nil {
+				return err
+			}
+
+			if err := seen.Put(boltTimeKey(v.LastSeen, v.Key), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		// evict the least recently seen keys, skipping the max most recent
+		evict := make([][]byte, 0)
+		c := seen.Cursor()
+		k, _ := c.Last()
+		for i := 0; k != nil && i < max; i++ {
+			k, _ = c.Prev()
+		}
+		for ; k != nil; k, _ = c.Prev() {
+			evict = append(evict, append([]byte{}, k...))
+		}
+
+		for _, k := range evict {
+			if err := b.Delete(k[8:]); err != nil {
+				return err
+			}
+
+			if err := seen.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *BoltDatabase) getMisses(tx *bolt.Tx) ([]*Miss, error) {
+	misses := make([]*Miss, 0)
+	if err := db.bucket(tx, MISSES_BUCKET).ForEach(func(k, v []byte) error {
+		m := &Miss{}
+		if err := UnmarshallBinary(v, m); err != nil {
+			return err
+		}
+
+		misses = append(misses, m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return misses, nil
+}
+
+// GetMisses returns up to limit of the most requested missing keys. If limit
+// is zero, all missing keys are returned.
+func (db *BoltDatabase) GetMisses(limit int) ([]*Miss, error) {
+	var misses []*Miss
+	if err := db.bdb.View(func(tx *bolt.Tx) error {
+		v, err := db.getMisses(tx)
+		misses = v
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	sortMisses(misses)
+	if limit > 0 && len(misses) > limit {
+		misses = misses[:limit]
+	}
+
+	return misses, nil
+}
+
+func (db *BoltDatabase) DeleteMiss(key string) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		b := db.bucket(tx, MISSES_BUCKET)
+		vb := b.Get([]byte(key))
+		if vb == nil {
+			return nil
+		}
+
+		m := &Miss{}
+		if err := UnmarshallBinary(vb, m); err != nil {
+			return err
+		}
+
+		if err := db.bucket(tx, SEEN_BUCKET).Delete(boltTimeKey(m.LastSeen, key)); err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
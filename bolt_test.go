@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 func tmpBoltDB(fn func(Database)) {
@@ -23,7 +27,7 @@ func tmpBoltDB(fn func(Database)) {
 
 	// open database
 	cfg := &Config{
-		DatabasePath: dbpath,
+		DatabaseOptions: DatabaseOptions(fmt.Sprintf(`{"path": %q}`, dbpath)),
 	}
 	db, err := OpenBoltDatabase(cfg)
 	if err != nil {
@@ -39,7 +43,294 @@ func tmpBoltDB(fn func(Database)) {
 }
 
 func TestBoltDB(t *testing.T) {
+	// delete mappings in more than one page
+	defer func(n int) { boltDeletePageSize = n }(boltDeletePageSize)
+	boltDeletePageSize = 2
+
 	tmpBoltDB(func(db Database) {
 		testDB(t, db)
+		testDBNamespaces(t, db)
+		testDBStats(t, db)
+		testDBListMappings(t, db)
+		testDBRevisions(t, db)
+		testDBHistory(t, db)
+	})
+}
+
+func TestBoltDBExpiredMappings(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		testDBExpiredMappings(t, db)
+	})
+}
+
+func TestBoltDBMissesIndex(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		now := time.Now()
+		for i, key := range []string{"/a", "/b", "/a", "/c", "/d"} {
+			if err := db.AddMisses([]*Miss{
+				{Key: key, Count: 1, LastSeen: now.Add(time.Duration(i) * time.Second)},
+			}, 3); err != nil {
+				panic(err)
+			}
+		}
+
+		if err := db.DeleteMiss("/c"); err != nil {
+			panic(err)
+		}
+
+		// the index holds one entry for each miss, by the time last seen
+		bdb := db.(*BoltDatabase)
+		keys := make([]string, 0)
+		if err := bdb.bdb.View(func(tx *bolt.Tx) error {
+			return bdb.bucket(tx, SEEN_BUCKET).ForEach(func(k, v []byte) error {
+				keys = append(keys, string(k[8:]))
+				return nil
+			})
+		}); err != nil {
+			panic(err)
+		}
+
+		if fmt.Sprint(keys) != "[/a /d]" {
+			t.Errorf("Expected index of /a and /d, got %v", keys)
+		}
+
+		if misses, err := db.GetMisses(0); err != nil {
+			panic(err)
+		} else if len(misses) != 2 {
+			t.Errorf("Expected 2 misses, got %v", misses)
+		}
+	})
+}
+
+func TestBoltDBRegexpSnapshot(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		ns, err := db.Namespace("example.test")
+		if err != nil {
+			panic(err)
+		}
+
+		keys := func(db Database) string {
+			mappings, err := db.GetRegexpMappings()
+			if err != nil {
+				panic(err)
+			}
+
+			v := make([]string, len(mappings))
+			for i, m := range mappings {
+				v[i] = m.Key
+				m.Key = "modified" // callers get copies of the snapshot
+			}
+
+			return fmt.Sprint(v)
+		}
+
+		if err := db.AddMapping(&Mapping{Key: "^/b", Type: RegexpMapping, Destination: "/"}); err != nil {
+			panic(err)
+		}
+
+		if v := keys(db); v != "[^/b]" {
+			t.Errorf("Bad regexp mappings %v", v)
+		}
+
+		if v := keys(db); v != "[^/b]" {
+			t.Errorf("Bad regexp mappings from snapshot %v", v)
+		}
+
+		if v := keys(ns); v != "[]" {
+			t.Errorf("Bad regexp mappings in namespace %v", v)
+		}
+
+		if err := db.AddMapping(&Mapping{Key: "^/a", Type: RegexpMapping, Destination: "/"}); err != nil {
+			panic(err)
+		}
+
+		if v := keys(db); v != "[^/a ^/b]" {
+			t.Errorf("Bad regexp mappings after adding a mapping %v", v)
+		}
+
+		// replacing a regexp mapping with another type removes it
+		if err := db.AddMapping(&Mapping{Key: "^/b", Destination: "/"}); err != nil {
+			panic(err)
+		}
+
+		if v := keys(db); v != "[^/a]" {
+			t.Errorf("Bad regexp mappings after replacing a mapping %v", v)
+		}
+
+		if err := db.DeleteMapping("^/a"); err != nil {
+			panic(err)
+		}
+
+		if v := keys(db); v != "[]" {
+			t.Errorf("Bad regexp mappings after deleting a mapping %v", v)
+		}
+	})
+}
+
+func TestBoltDBRekey(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		ns, err := db.Namespace("example.test")
+		if err != nil {
+			panic(err)
+		}
+
+		for _, m := range []*Mapping{
+			{Key: "/Promo/", Destination: "/promo"},
+			{Key: "/promo", Destination: "/existing"},
+			{Key: "/Other/", Destination: "/other"},
+			{Key: "/Prefix/", Destination: "/prefix", Type: PrefixMapping},
+		} {
+			if err := db.AddMapping(m); err != nil {
+				panic(err)
+			}
+		}
+
+		if err := ns.AddMapping(&Mapping{Key: "/Host", Destination: "/host"}); err != nil {
+			panic(err)
+		}
+
+		if err := db.AddHits([]*MappingHits{{Key: "/Other/", Count: 2, FirstHit: time.Now(), LastHit: time.Now()}}); err != nil {
+			panic(err)
+		}
+
+		bdb := db.(*BoltDatabase)
+		bdb.cfg.Normalize = KeyNormalization{Lowercase: true, StripTrailingSlash: true}
+		before := time.Now()
+		n, conflicts, err := bdb.RekeyMappings()
+		if err != nil {
+			panic(err)
+		}
+
+		if n != 3 {
+			t.Errorf("Expected 3 renamed mappings, got %v", n)
+		}
+
+		if len(conflicts) != 1 || conflicts[0] != "/Promo/" {
+			t.Errorf("Expected conflict for /Promo/, got %v", conflicts)
+		}
+
+		for key, d := range map[string]Database{"/other": db, "/prefix/": db, "/promo": db, "/host": ns} {
+			if _, err := d.GetMapping(key); err != nil {
+				t.Errorf("Error getting renamed mapping %v: %v", key, err)
+			}
+		}
+
+		if m, err := db.GetPrefixMapping("/prefix/path"); err != nil || m.Key != "/prefix/" {
+			t.Errorf("Expected renamed prefix mapping in index, got: %v, %v", m, err)
+		}
+
+		hits, err := db.GetHits()
+		if err != nil {
+			panic(err)
+		}
+
+		if len(hits) != 1 || hits[0].Key != "/other" || hits[0].Count != 2 {
+			t.Errorf("Expected hits to be moved to renamed mapping, got: %v", hits)
+		}
+
+		// the rename is recorded in the history of both keys
+		if history, err := db.GetHistory("/Other/"); err != nil {
+			panic(err)
+		} else if n := len(history); n != 2 || history[1].Action != DeleteAction || history[1].Actor != rekeyActor {
+			t.Errorf("Expected deletion of the old key in its history, got: %v", history)
+		}
+
+		if history, err := db.GetHistory("/other"); err != nil {
+			panic(err)
+		} else if len(history) != 1 || history[0].Action != AddAction || history[0].Mapping.Destination != "/other" {
+			t.Errorf("Expected addition of the new key in its history, got: %v", history)
+		}
+
+		if history, err := ns.GetHistory("/host"); err != nil {
+			panic(err)
+		} else if len(history) != 1 || history[0].Actor != rekeyActor {
+			t.Errorf("Expected history of the renamed mapping in its namespace, got: %v", history)
+		}
+
+		// a rekey is undone by rolling back with the previous settings
+		bdb.cfg.Normalize = KeyNormalization{}
+		if _, err := rollbackMappings(db, before, "tester"); err != nil {
+			panic(err)
+		}
+
+		if _, err := db.GetMapping("/Other/"); err != nil {
+			t.Errorf("Error getting restored mapping /Other/: %v", err)
+		}
+
+		if _, err := db.GetMapping("/other"); err != MappingNotFoundError {
+			t.Errorf("Expected renamed mapping /other to be removed, got: %v", err)
+		}
+	})
+}
+
+func TestBoltDBMigrate(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		ns, err := db.Namespace("example.test")
+		if err != nil {
+			panic(err)
+		}
+
+		if err := db.AddMapping(&Mapping{Key: "/current", Destination: "/current"}); err != nil {
+			panic(err)
+		}
+
+		// write legacy gob records
+		bdb := db.(*BoltDatabase)
+		for _, v := range []struct {
+			db     *BoltDatabase
+			bucket []byte
+			key    string
+			record interface{}
+		}{
+			{bdb, MAPPINGS_BUCKET, "/legacy", &Mapping{Key: "/legacy", Destination: "/{{ .Key }}", IsTemplate: true}},
+			{bdb, HITS_BUCKET, "/legacy", &MappingHits{Key: "/legacy", Count: 3}},
+			{bdb, MISSES_BUCKET, "/missing", &Miss{Key: "/missing", Count: 1}},
+			{ns.(*BoltDatabase), MAPPINGS_BUCKET, "/host", &Mapping{Key: "/host", Destination: "/host"}},
+		} {
+			b, err := marshallGob(v.record)
+			if err != nil {
+				panic(err)
+			}
+
+			if err := v.db.bdb.Update(func(tx *bolt.Tx) error {
+				return v.db.bucket(tx, v.bucket).Put([]byte(v.key), b)
+			}); err != nil {
+				panic(err)
+			}
+		}
+
+		n, err := bdb.MigrateRecords()
+		if err != nil {
+			panic(err)
+		}
+
+		if n != 4 {
+			t.Errorf("Expected 4 migrated records, got %v", n)
+		}
+
+		if n, err := bdb.MigrateRecords(); err != nil || n != 0 {
+			t.Errorf("Expected no records to migrate twice, got: %v, %v", n, err)
+		}
+
+		if err := bdb.bdb.View(func(tx *bolt.Tx) error {
+			if v := bdb.bucket(tx, MAPPINGS_BUCKET).Get([]byte("/legacy")); isLegacyRecord(v) {
+				t.Errorf("Expected legacy mapping to be rewritten, got: %q", v)
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+
+		if m, err := db.GetMapping("/legacy"); err != nil || !m.IsTemplate {
+			t.Errorf("Expected migrated template mapping, got: %v, %v", m, err)
+		}
+
+		if _, err := ns.GetMapping("/host"); err != nil {
+			t.Errorf("Error getting migrated mapping in namespace: %v", err)
+		}
+
+		if hits, err := db.GetHits(); err != nil || len(hits) != 1 || hits[0].Count != 3 {
+			t.Errorf("Expected migrated hits, got: %v, %v", hits, err)
+		}
 	})
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig contains configuration for the in-memory lookup cache.
+type CacheConfig struct {
+	Size        int      `json:"size"`        // maximum number of cached lookups; zero disables the cache
+	TTL         Duration `json:"ttl"`         // time to cache found mappings
+	NegativeTTL Duration `json:"negativeTTL"` // time to cache missing mappings; zero disables negative caching
+}
+
+// CacheStats reports the effectiveness of the lookup cache.
+type CacheStats struct {
+	Size         int     `json:"size"`
+	Hits         int64   `json:"hits"`         // lookups answered from the cache
+	NegativeHits int64   `json:"negativeHits"` // hits for mappings cached as missing
+	Misses       int64   `json:"misses"`       // lookups passed to the database
+	HitRatio     float64 `json:"hitRatio"`
+	MissRatio    float64 `json:"missRatio"`
+}
+
+// cacheEntry is a cached lookup result. A nil mapping and nil slice indicate
+// a cached MappingNotFoundError.
+type cacheEntry struct {
+	key      string
+	mapping  *Mapping
+	mappings []*Mapping
+	expires  time.Time
+}
+
+// lookupCache is an LRU cache of lookup results shared by all namespaces of a
+// CachedDatabase.
+type lookupCache struct {
+	cfg         CacheConfig
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	generations map[string]int64 // incremented when a namespace is modified
+
+	hits         int64
+	negativeHits int64
+	misses       int64
+}
+
+// CachedDatabase is a Database decorator that caches mapping lookups in
+// memory. Lookups are cached for each namespace until the TTL expires or any
+// mapping in the namespace is modified through the CachedDatabase.
+//
+// Modifications made by other processes that share the underlying database
+// are visible after the TTL expires.
+type CachedDatabase struct {
+	Database
+	ns    string
+	cache *lookupCache
+}
+
+// NewCachedDatabase returns a Database that caches lookups in the given
+// database.
+func NewCachedDatabase(db Database, cfg CacheConfig) *CachedDatabase {
+	return &CachedDatabase{
+		Database: db,
+		cache: &lookupCache{
+			cfg:         cfg,
+			entries:     make(map[string]*list.Element),
+			lru:         list.New(),
+			generations: make(map[string]int64),
+		},
+	}
+}
+
+// Namespace returns a cached view of the given namespace of the underlying
+// database.
+func (db *CachedDatabase) Namespace(name string) (Database, error) {
+	v, err := db.Database.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedDatabase{
+		Database: v,
+		ns:       name,
+		cache:    db.cache,
+	}, nil
+}
+
+// CacheStats returns the current cache statistics.
+func (db *CachedDatabase) CacheStats() CacheStats {
+	c := db.cache
+	c.mu.Lock()
+	stats := CacheStats{Size: c.lru.Len()}
+	c.mu.Unlock()
+
+	stats.Hits = atomic.LoadInt64(&c.hits)
+	stats.NegativeHits = atomic.LoadInt64(&c.negativeHits)
+	stats.Misses = atomic.LoadInt64(&c.misses)
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+		stats.MissRatio = float64(stats.Misses) / float64(total)
+	}
+
+	return stats
+}
+
+// cacheKey returns the cache key for the given lookup in the given generation
+// of the namespace. Keys of earlier generations are never read again and are
+// eventually evicted.
+func cacheKey(gen int64, ns, op, key string) string {
+	return fmt.Sprintf("%d\x00%v\x00%v\x00%v", gen, ns, op, key)
+}
+
+// get returns the cached entry for the given lookup, if any, and the current
+// generation of the namespace.
+func (c *lookupCache) get(ns, op, key string) (*cacheEntry, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen := c.generations[ns]
+	el, ok := c.entries[cacheKey(gen, ns, op, key)]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, gen, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		atomic.AddInt64(&c.misses, 1)
+		return nil, gen, false
+	}
+
+	c.lru.MoveToFront(el)
+	atomic.AddInt64(&c.hits, 1)
+	if e.mapping == nil && e.mappings == nil {
+		atomic.AddInt64(&c.negativeHits, 1)
+	}
+
+	return e, gen, true
+}
+
+// put caches the result of the given lookup, evicting the least recently
+// used entries if the cache is full. The result is discarded if the namespace
+// was modified since the given generation.
+func (c *lookupCache) put(gen int64, ns, op, key string, m *Mapping, mappings []*Mapping) {
+	ttl := c.cfg.TTL.Duration
+	if m == nil && mappings == nil {
+		ttl = c.cfg.NegativeTTL.Duration
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[ns] != gen {
+		return
+	}
+
+	e := &cacheEntry{
+		key:      cacheKey(gen, ns, op, key),
+		mapping:  m,
+		mappings: mappings,
+		expires:  time.Now().Add(ttl),
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.cfg.Size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate discards all cached lookups in the given namespace.
+func (c *lookupCache) invalidate(ns string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[ns]++
+}
+
+// lookup returns a cached copy of the mapping returned by fn for the given
+// lookup, calling fn only if the result is not already cached.
+func (db *CachedDatabase) lookup(op, key string, fn func(string) (*Mapping, error)) (*Mapping, error) {
+	e, gen, ok := db.cache.get(db.ns, op, key)
+	if ok {
+		if e.mapping == nil {
+			return nil, MappingNotFoundError
+		}
+
+		m := *e.mapping
+		return &m, nil
+	}
+
+	m, err := fn(key)
+	if err == MappingNotFoundError {
+		db.cache.put(gen, db.ns, op, key, nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := *m
+	db.cache.put(gen, db.ns, op, key, &v, nil)
+	return m, nil
+}
+
+func (db *CachedDatabase) GetMapping(key string) (*Mapping, error) {
+	return db.lookup("exact", key, db.Database.GetMapping)
+}
+
+func (db *CachedDatabase) GetPrefixMapping(key string) (*Mapping, error) {
+	return db.lookup("prefix", key, db.Database.GetPrefixMapping)
+}
+
+func (db *CachedDatabase) GetRegexpMappings() ([]*Mapping, error) {
+	e, gen, ok := db.cache.get(db.ns, "regexp", "")
+	if ok {
+		return copyMappings(e.mappings), nil
+	}
+
+	mappings, err := db.Database.GetRegexpMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	db.cache.put(gen, db.ns, "regexp", "", nil, copyMappings(mappings))
+	return mappings, nil
+}
+
+// copyMappings returns copies of the given mappings, so that cached mappings
+// are not shared with callers that modify them, such as Mapping.Validate.
+func copyMappings(mappings []*Mapping) []*Mapping {
+	v := make([]*Mapping, len(mappings))
+	for i, m := range mappings {
+		c := *m
+		v[i] = &c
+	}
+
+	return v
+}
+
+func (db *CachedDatabase) AddMapping(m *Mapping) error {
+	defer db.cache.invalidate(db.ns)
+	return db.Database.AddMapping(m)
+}
+
+func (db *CachedDatabase) AddMappingIf(m *Mapping, rev int64, actor string) (*MappingChange, error) {
+	defer db.cache.invalidate(db.ns)
+	return db.Database.AddMappingIf(m, rev, actor)
+}
+
+func (db *CachedDatabase) DeleteMapping(key string) error {
+	defer db.cache.invalidate(db.ns)
+	return db.Database.DeleteMapping(key)
+}
+
+func (db *CachedDatabase) DeleteMappingIf(key string, rev int64, actor string) (*MappingChange, error) {
+	defer db.cache.invalidate(db.ns)
+	return db.Database.DeleteMappingIf(key, rev, actor)
+}
+
+func (db *CachedDatabase) DeleteMappings(actor string) (int64, error) {
+	defer db.cache.invalidate(db.ns)
+	return db.Database.DeleteMappings(actor)
+}
+
+func (db *CachedDatabase) DeleteExpiredMappings(before time.Time, actor string) (int64, error) {
+	n, err := db.Database.DeleteExpiredMappings(before, actor)
+	if n > 0 {
+		db.cache.invalidate(db.ns)
+	}
+
+	return n, err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedDatabase(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		cdb := NewCachedDatabase(db, CacheConfig{
+			Size:        100,
+			TTL:         Duration{time.Minute},
+			NegativeTTL: Duration{time.Minute},
+		})
+		testDB(t, cdb)
+		testDBNamespaces(t, cdb)
+		testDBStats(t, cdb)
+		testDBRevisions(t, cdb)
+	})
+}
+
+func TestCachedDatabaseInvalidation(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		cdb := NewCachedDatabase(db, CacheConfig{
+			Size:        2,
+			TTL:         Duration{time.Minute},
+			NegativeTTL: Duration{time.Minute},
+		})
+
+		expectStats := func(hits, negativeHits, misses int64) {
+			stats := cdb.CacheStats()
+			if stats.Hits != hits || stats.NegativeHits != negativeHits || stats.Misses != misses {
+				t.Errorf("Expected %v hits, %v negative hits and %v misses, got: %+v", hits, negativeHits, misses, stats)
+			}
+		}
+
+		if err := cdb.AddMapping(&Mapping{Key: "/a", Destination: "/a"}); err != nil {
+			panic(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := cdb.GetMapping("/a"); err != nil {
+				panic(err)
+			}
+		}
+		expectStats(2, 0, 1)
+
+		// negative cache
+		for i := 0; i < 2; i++ {
+			if _, err := cdb.GetMapping("/b"); err != MappingNotFoundError {
+				t.Fatalf("Expected MappingNotFoundError, got: %v", err)
+			}
+		}
+		expectStats(3, 1, 2)
+
+		// writes invalidate cached misses
+		if err := cdb.AddMapping(&Mapping{Key: "/b", Destination: "/b"}); err != nil {
+			panic(err)
+		}
+
+		if m, err := cdb.GetMapping("/b"); err != nil || m.Destination != "/b" {
+			t.Fatalf("Expected mapping for /b after invalidation, got: %v, %v", m, err)
+		}
+		expectStats(3, 1, 3)
+
+		// writes to the underlying database are not seen until invalidated
+		if err := db.DeleteMapping("/b"); err != nil {
+			panic(err)
+		}
+
+		if _, err := cdb.GetMapping("/b"); err != nil {
+			t.Errorf("Expected cached mapping for /b, got: %v", err)
+		}
+
+		// writes in other namespaces do not invalidate
+		ns, err := cdb.Namespace("example.test")
+		if err != nil {
+			panic(err)
+		}
+
+		if err := ns.AddMapping(&Mapping{Key: "/b", Destination: "/host"}); err != nil {
+			panic(err)
+		}
+
+		if m, err := cdb.GetMapping("/b"); err != nil || m.Destination != "/b" {
+			t.Errorf("Expected cached mapping for /b in default namespace, got: %v, %v", m, err)
+		}
+
+		if m, err := ns.GetMapping("/b"); err != nil || m.Destination != "/host" {
+			t.Errorf("Expected namespaced mapping for /b, got: %v, %v", m, err)
+		}
+
+		// least recently used entries are evicted
+		for _, key := range []string{"/c", "/d"} {
+			cdb.GetMapping(key)
+		}
+
+		if stats := cdb.CacheStats(); stats.Size != 2 {
+			t.Errorf("Expected cache size 2, got %v", stats.Size)
+		}
+
+		if _, err := cdb.GetMapping("/b"); err != MappingNotFoundError {
+			t.Errorf("Expected evicted mapping to be read from the database, got: %v", err)
+		}
+	})
+}
+
+func TestCachedRegexpMappingsCopied(t *testing.T) {
+	tmpBoltDB(func(db Database) {
+		cdb := NewCachedDatabase(db, CacheConfig{Size: 10, TTL: Duration{time.Minute}})
+		if err := cdb.AddMapping(&Mapping{Key: "^/a/", Type: RegexpMapping, Destination: "/{{ .Key }}"}); err != nil {
+			panic(err)
+		}
+
+		// mappings are validated concurrently by the redirect handler
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mappings, err := cdb.GetRegexpMappings()
+				if err != nil {
+					panic(err)
+				}
+				for _, m := range mappings {
+					if err := m.Validate(); err != nil {
+						panic(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		mappings, err := cdb.GetRegexpMappings()
+		if err != nil {
+			panic(err)
+		}
+		mappings[0].Destination = "/changed"
+
+		mappings, err = cdb.GetRegexpMappings()
+		if err != nil {
+			panic(err)
+		}
+		if mappings[0].Destination != "/{{ .Key }}" {
+			t.Errorf("Expected cached regexp mapping to be unchanged, got %v", mappings[0].Destination)
+		}
+	})
+}
@@ -2,88 +2,190 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
-	"strings"
+	"sync"
+	"time"
 )
 
-// singleton config instance
-var cfg *Config = &Config{
-	Path:           "",
-	Initialized:    false,
-	DatabaseDriver: "bolt",
-	DatabasePath:   "./redirector.db",
-	ListenAddr:     ":8080",
-	MgmtAddr:       "127.0.0.1:9321",
-	LogFile:        "-", // stdout
-	AccessLogFile:  "-", // stdout
-	KeyBuilderName: "path",
-	ViewBag:        NewViewBag(),
+var (
+	cfgMu sync.Mutex
+	cfg   *Config // singleton config instance, loaded by GetConfig
+)
+
+// configPaths are the configuration files searched by GetConfig, in order.
+var configPaths = []string{
+	"./redirector.json",
+	"/etc/redirector/redirector.json",
+}
+
+// defaultConfig returns a configuration with default settings.
+func defaultConfig() *Config {
+	return &Config{
+		Path:           "",
+		Initialized:    false,
+		DatabaseDriver: "bolt",
+		ListenAddr:     ":8080",
+		MgmtAddr:       "127.0.0.1:9321",
+		LogFile:        "-", // stdout
+		AccessLogFile:  "-", // stdout
+		LogLevel:       InfoLevel,
+		LogFormat:      TextLog,
+		KeyBuilderName: "path",
+		ViewBag:        NewViewBag(),
+
+		SweepInterval:      Duration{time.Hour},
+		ExpiredRetention:   Duration{7 * 24 * time.Hour},
+		StatsFlushInterval: Duration{10 * time.Second},
+		MaxMisses:          10000,
+		ShutdownTimeout:    Duration{30 * time.Second},
+		AccessLogFormat:    AccessLogFormat{Name: DefaultAccessLog},
+
+		Cache: CacheConfig{
+			TTL:         Duration{time.Minute},
+			NegativeTTL: Duration{10 * time.Second},
+		},
+	}
 }
 
 // Config contains runtime configuration for the redirector service.
 type Config struct {
-	Path              string     `json:"-"` // Loaded configuration file
-	Initialized       bool       `json:"-"`
-	ExitOnError       bool       `json:"-"` // Bypass panic handler
-	DatabaseDriver    string     `json:"database"`
-	DatabasePath      string     `json:"databasePath"`
-	ListenAddr        string     `json:"listenAddr"`
-	MgmtAddr          string     `json:"mgmtAddr"`
-	LogFile           string     `json:"logFile"`
-	AccessLogFile     string     `json:"accessLogFile"`
-	KeyBuilderName    string     `json:"keyBuilder"` // The name of the KeyBuilder
-	KeyBuilder        KeyBuilder `json:"-"`          // An instance of a KeyBuilder
-	DefaultKey        string     `json:"defaultKey"` // fallback for all 404s
-	DestinationPrefix string     `json:"destinationPrefix"`
-	ViewBag           ViewBag    `json:"viewBag"`
+	Path               string           `json:"-"` // Loaded configuration file
+	Initialized        bool             `json:"-"`
+	ExitOnError        bool             `json:"-"` // Bypass panic handler
+	DatabaseDriver     string           `json:"database"`
+	DatabasePath       string           `json:"databasePath"`    // deprecated: use the driver's databaseOptions
+	DatabaseOptions    DatabaseOptions  `json:"databaseOptions"` // driver-specific connection settings
+	Redis              DatabaseOptions  `json:"redis,omitempty"` // deprecated: use the redis driver's databaseOptions
+	ListenAddr         string           `json:"listenAddr"`
+	MgmtAddr           string           `json:"mgmtAddr"`
+	TLS                TLSConfig        `json:"tls"`           // HTTPS for the redirect listener
+	UpgradeAddr        string           `json:"upgradeAddr"`   // HTTP listener that redirects all requests to HTTPS; empty disables
+	MgmtTLS            TLSConfig        `json:"mgmtTLS"`       // HTTPS for the management listener
+	MgmtClientTLS      ClientTLSConfig  `json:"mgmtClientTLS"` // TLS settings of the management client
+	MgmtTokens         APITokens        `json:"mgmtTokens"`    // tokens accepted by the management API; empty disables authentication
+	MgmtToken          Secret           `json:"mgmtToken"`     // token sent by the management client
+	LogFile            string           `json:"logFile"`
+	LogLevel           LogLevel         `json:"logLevel"`  // minimum level of application log entries
+	LogFormat          LogFormat        `json:"logFormat"` // text or json
+	AccessLogFile      string           `json:"accessLogFile"`
+	AccessLogFormat    AccessLogFormat  `json:"accessLogFormat"` // default, combined, json or a template
+	KeyBuilderName     string           `json:"keyBuilder"`      // The name of the KeyBuilder
+	KeyBuilder         KeyBuilder       `json:"-"`               // An instance of a KeyBuilder
+	DefaultKey         string           `json:"defaultKey"`      // fallback for all 404s
+	DestinationPrefix  string           `json:"destinationPrefix"`
+	QueryPolicy        QueryPolicy      `json:"queryPolicy"` // default for mappings with no query policy
+	ViewBag            ViewBag          `json:"viewBag"`
+	GoneOnExpiry       bool             `json:"goneOnExpiry"`       // return 410 for expired mappings
+	SweepInterval      Duration         `json:"sweepInterval"`      // interval between purges of expired mappings
+	ExpiredRetention   Duration         `json:"expiredRetention"`   // time to keep mappings after expiry
+	StatsFlushInterval Duration         `json:"statsFlushInterval"` // interval between writes of mapping hits and misses; zero disables both
+	HitsFlushInterval  *Duration        `json:"hitsFlushInterval"`  // deprecated: use statsFlushInterval
+	MaxMisses          int              `json:"maxMisses"`          // number of missing keys to record; zero disables miss recording
+	Hosts              HostConfigs      `json:"hosts"`              // virtual host overrides, keyed by host name
+	Normalize          KeyNormalization `json:"normalize"`          // canonical form of request and mapping keys
+	Cache              CacheConfig      `json:"cache"`              // in-memory lookup cache
+	ShutdownTimeout    Duration         `json:"shutdownTimeout"`    // time to wait for active requests to complete on shutdown
 }
 
-// LoadConfig reads configuration from the given file path
-func LoadConfig(path string) (*Config, error) {
+// Duration is a time.Duration that is encoded in JSON as a string such as
+// "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+// decodeConfig reads the configuration file at the given path over the
+// default settings, without initializing it.
+func decodeConfig(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
+	c := defaultConfig()
 	dec := json.NewDecoder(f)
-	if err := dec.Decode(cfg); err != nil {
+	if err := dec.Decode(c); err != nil {
 		return nil, err
 	}
 
-	cfg.Path = path
-	if err := cfg.initialize(); err != nil {
-		return nil, err
+	// hitsFlushInterval is the former name of statsFlushInterval
+	if c.HitsFlushInterval != nil {
+		c.StatsFlushInterval = *c.HitsFlushInterval
+		c.HitsFlushInterval = nil
 	}
 
-	return cfg, nil
+	c.Path = path
+	return c, nil
 }
 
-// GetConfig returns a pointer to a singleton configuration struct.
-func GetConfig() (*Config, error) {
-	if !cfg.Initialized {
-		cfgPaths := []string{
-			"./redirector.json",
-			"/etc/redirector/redirector.json",
+// findConfig reads the first configuration file that exists in the search
+// path, or returns the default settings if there is none. The configuration is
+// not initialized.
+func findConfig() (*Config, error) {
+	for _, path := range configPaths {
+		c, err := decodeConfig(path)
+		if err == nil {
+			return c, nil
 		}
 
-		for _, path := range cfgPaths {
-			_, err := LoadConfig(path)
-			if err == nil {
-				break
-			}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return defaultConfig(), nil
+}
+
+// LoadConfig reads configuration from the given file path
+func LoadConfig(path string) (*Config, error) {
+	c, err := decodeConfig(path)
+	if err != nil {
+		return nil, err
+	}
 
-			if !os.IsNotExist(err) {
-				return nil, err
-			}
+	if err := c.initialize(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetConfig returns a pointer to a singleton configuration struct. The
+// configuration must not be modified once it is loaded; the server replaces
+// it with a new configuration on reload.
+func GetConfig() (*Config, error) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+
+	if cfg == nil {
+		c, err := findConfig()
+		if err != nil {
+			return nil, err
 		}
 
-		if !cfg.Initialized {
-			if err := cfg.initialize(); err != nil {
-				return nil, err
-			}
+		if err := c.initialize(); err != nil {
+			return nil, err
 		}
+		cfg = c
 	}
 
 	return cfg, nil
@@ -92,19 +194,44 @@ func GetConfig() (*Config, error) {
 // initialize instanciates the current runtime configuration.
 func (c *Config) initialize() error {
 	// expand keybuilder
-	switch c.KeyBuilderName {
-	case "", "path":
-		c.KeyBuilder = RequestURIPathKeyBuilder()
-
-	case "uri":
-		c.KeyBuilder = RequestURIKeyBuilder()
-
-	default:
-		if strings.HasPrefix(c.KeyBuilderName, "param:") {
-			c.KeyBuilder = RequestParamKeyBuilder(c.KeyBuilderName[6:])
-		} else {
-			return fmt.Errorf("Unknown key builder: %v", c.KeyBuilderName)
-		}
+	kb, err := ParseKeyBuilder(c.KeyBuilderName)
+	if err != nil {
+		return err
+	}
+	c.KeyBuilder = kb
+
+	// normalize request keys
+	if c.Normalize.Enabled() {
+		c.KeyBuilder = NormalizedKeyBuilder(c.KeyBuilder, c.Normalize)
+		c.DefaultKey = c.Normalize.Key(c.DefaultKey)
+	}
+
+	if err := c.QueryPolicy.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.MgmtTokens.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.LogFormat.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.initializeHosts(); err != nil {
+		return err
+	}
+
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+
+	if err := migrateRedisConfig(c); err != nil {
+		return err
+	}
+
+	if err := validateDatabaseOptions(c); err != nil {
+		return err
 	}
 
 	if err := InitTemplates(); err != nil {
@@ -2,22 +2,128 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 var (
-	MappingNotFoundError = fmt.Errorf("Mapping not found")
+	MappingNotFoundError  = fmt.Errorf("Mapping not found")
+	RevisionMismatchError = fmt.Errorf("Mapping revision does not match")
 )
 
+// Revisions given to Database.AddMappingIf and Database.DeleteMappingIf that
+// match any stored mapping or no stored mapping. All other revisions match only
+// a stored mapping with the same revision.
+const (
+	AnyRevision     int64 = -1 // matches a stored or a missing mapping
+	MissingRevision int64 = -2 // matches only a missing mapping
+)
+
+// Database stores mappings and their hits, misses and history. Every write to
+// a mapping records the change in the history of the mapping key, with the
+// given actor, in the same transaction as the write.
 type Database interface {
 	Close() error
+	Namespace(name string) (Database, error)
 	AddMapping(m *Mapping) error
+	AddMappingIf(m *Mapping, rev int64, actor string) (*MappingChange, error)
 	GetMapping(key string) (*Mapping, error)
+	GetPrefixMapping(key string) (*Mapping, error)
+	GetRegexpMappings() ([]*Mapping, error)
 	GetMappings() ([]*Mapping, error)
+	ListMappings(opts ListOptions) (mappings []*Mapping, next string, err error)
 	DeleteMapping(key string) error
-	DeleteMappings() (int64, error)
+	DeleteMappingIf(key string, rev int64, actor string) (*MappingChange, error)
+	DeleteMappings(actor string) (int64, error)
+	DeleteExpiredMappings(before time.Time, actor string) (int64, error)
+	AddHits(hits []*MappingHits) error
+	GetHits(keys ...string) ([]*MappingHits, error)
+	AddMisses(misses []*Miss, max int) error
+	GetMisses(limit int) ([]*Miss, error)
+	DeleteMiss(key string) error
+	AddChanges(changes []*MappingChange) error
+	GetHistory(key string) ([]*MappingChange, error)
+	GetChanges(since time.Time) ([]*MappingChange, error)
 	Stats() (DatabaseStats, error)
 }
 
+// checkRevision returns RevisionMismatchError if the stored mapping, or nil if
+// the mapping is missing, does not match the given revision.
+func checkRevision(cur *Mapping, rev int64) error {
+	switch rev {
+	case AnyRevision:
+		return nil
+
+	case MissingRevision:
+		if cur != nil {
+			return RevisionMismatchError
+		}
+		return nil
+	}
+
+	if cur == nil || cur.Revision != rev {
+		return RevisionMismatchError
+	}
+
+	return nil
+}
+
+// nextRevision sets the revision of m to follow the revision of the stored
+// mapping, or nil if the mapping is new, and sets its modified time.
+func nextRevision(m, cur *Mapping) {
+	m.Revision = 1
+	if cur != nil {
+		m.Revision = cur.Revision + 1
+	}
+
+	now := time.Now()
+	m.Modified = &now
+}
+
+// ListOptions select a page of mappings returned by Database.ListMappings.
+type ListOptions struct {
+	Limit  int    // maximum number of mappings in the page; zero for no limit
+	After  string // cursor returned with the previous page; empty for the first page
+	Prefix string // only list mappings with keys that start with Prefix
+	Search string // only list mappings with Search in the destination or comment, ignoring case
+}
+
+// Match returns true if the given mapping matches the prefix and search
+// filters.
+func (o ListOptions) Match(m *Mapping) bool {
+	if !strings.HasPrefix(m.Key, o.Prefix) {
+		return false
+	}
+
+	if o.Search == "" {
+		return true
+	}
+
+	s := strings.ToLower(o.Search)
+	return strings.Contains(strings.ToLower(m.Destination), s) || strings.Contains(strings.ToLower(m.Comment), s)
+}
+
+// commonPrefix returns the longest common prefix of a and b.
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
+
+// sortRegexpMappings sorts regexp mappings into evaluation order; by ascending
+// priority and then by key.
+func sortRegexpMappings(mappings []*Mapping) {
+	sort.SliceStable(mappings, func(i, j int) bool {
+		if mappings[i].Priority != mappings[j].Priority {
+			return mappings[i].Priority < mappings[j].Priority
+		}
+		return mappings[i].Key < mappings[j].Key
+	})
+}
+
 type DatabaseStats struct {
 	TotalMappings int64 `json:"totalMappings"`
 	DiskUsage     int64 `json:"diskUsage"`
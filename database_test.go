@@ -1,20 +1,31 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 var testMappings = []Mapping{
-	{"default", "/okay", false, "Should only apply to missing keys", false},
-	{"/permanent", "/okay", true, "Should return HTTP 308", false},
-	{"/temporary", "/okay", false, "Should return HTTP 307", false},
-	{"/template", "/?key={{ .Key }}", false, "Should expand template", true},
-	{"/viewbag", "/?Foo={{ .Foo }}", false, "Should expand View Bag", true},
+	{Key: "default", Destination: "/okay", Comment: "Should only apply to missing keys"},
+	{Key: "/permanent", Destination: "/okay", Permanent: true, Comment: "Should return HTTP 308"},
+	{Key: "/temporary", Destination: "/okay", Comment: "Should return HTTP 307"},
+	{Key: "/found", Destination: "/okay", Status: 302, Comment: "Should return HTTP 302"},
+	{Key: "/gone", Status: 410, Comment: "Should return HTTP 410"},
+	{Key: "/query", Destination: "/okay?a=0&b=0", Query: QueryOverride, Comment: "Should override query parameters"},
+	{Key: "/template", Destination: "/?key={{ .Key }}", Comment: "Should expand template", IsTemplate: true},
+	{Key: "/viewbag", Destination: "/?Foo={{ .Foo }}", Comment: "Should expand View Bag", IsTemplate: true},
+	{Key: "/prefix", Destination: "/prefixed{{ .Suffix }}", Comment: "Should match prefix", Type: PrefixMapping, IsTemplate: true},
+	{Key: "/prefix/longer", Destination: "/longer{{ .Suffix }}", Comment: "Should match longest prefix", Type: PrefixMapping, IsTemplate: true},
+	{Key: `^/products/(?P<id>[0-9]+)$`, Destination: "/p/{{ .id }}", Comment: "Should expand named group", Type: RegexpMapping, IsTemplate: true},
+	{Key: `^/items/([a-z]+)/([0-9]+)$`, Destination: "/i/{{ index .Match 2 }}/{{ index .Match 1 }}", Comment: "Should expand numbered groups", Type: RegexpMapping, Priority: 1, IsTemplate: true},
+	{Key: `^/items/`, Destination: "/items", Comment: "Should match after higher priority", Type: RegexpMapping, Priority: 2},
+	{Key: `^/prefix/regexp$`, Destination: "/regexp", Comment: "Should match before prefix", Type: RegexpMapping},
 }
 
 func testDB(t *testing.T, db Database) {
 	// clear existing
-	if _, err := db.DeleteMappings(); err != nil {
+	if _, err := db.DeleteMappings(""); err != nil {
 		panic(err)
 	}
 
@@ -38,12 +49,146 @@ func testDB(t *testing.T, db Database) {
 				t.Errorf("Bad mapping permanence: '%v', expected '%v'", v.Permanent, m.Permanent)
 			}
 
+			if v.Query != m.Query {
+				t.Errorf("Bad mapping query policy: '%v', expected '%v'", v.Query, m.Query)
+			}
+
+			if v.Status != m.Status {
+				t.Errorf("Bad mapping status: '%v', expected '%v'", v.Status, m.Status)
+			}
+
 			if v.Comment != m.Comment {
 				t.Errorf("Bad mapping comment: '%v', expected '%v'", v.Comment, m.Comment)
 			}
+
+			if v.Type != m.Type {
+				t.Errorf("Bad mapping type: '%v', expected '%v'", v.Type, m.Type)
+			}
+		}
+	}
+
+	// test regexp mappings
+	if v, err := db.GetRegexpMappings(); err != nil {
+		panic(err)
+	} else {
+		expect := []string{`^/prefix/regexp$`, `^/products/(?P<id>[0-9]+)$`, `^/items/([a-z]+)/([0-9]+)$`, `^/items/`}
+		if len(v) != len(expect) {
+			t.Errorf("Bad regexp mapping count %v, expected %v", len(v), len(expect))
+		} else {
+			for i, m := range v {
+				if m.Key != expect[i] {
+					t.Errorf("Bad regexp mapping at index %v: '%v', expected '%v'", i, m.Key, expect[i])
+				}
+			}
+		}
+	}
+
+	// test prefix mappings
+	prefixTests := map[string]string{
+		"/prefix":               "/prefix",
+		"/prefix/a":             "/prefix",
+		"/prefix/long":          "/prefix",
+		"/prefix/longer":        "/prefix/longer",
+		"/prefix/longer/path":   "/prefix/longer",
+		"/prefix/longest/path":  "/prefix",
+		"/prefix/m/longer/path": "/prefix",
+	}
+	for key, expect := range prefixTests {
+		if v, err := db.GetPrefixMapping(key); err != nil {
+			t.Errorf("Error getting prefix mapping for '%v': %v", key, err)
+		} else if v.Key != expect {
+			t.Errorf("Bad prefix mapping for '%v': '%v', expected '%v'", key, v.Key, expect)
+		}
+	}
+
+	for _, key := range []string{"/prefi", "/permanent", "/a", "/zzz", "/prefiz/"} {
+		if _, err := db.GetPrefixMapping(key); err != MappingNotFoundError {
+			t.Errorf("Expected no prefix mapping for '%v', got: %v", key, err)
+		}
+	}
+
+	// test hits
+	first := time.Unix(1000, 0)
+	last := time.Unix(2000, 0)
+	for i := 0; i < 2; i++ {
+		if err := db.AddHits([]*MappingHits{
+			{Key: "/temporary", Count: 2, FirstHit: first.Add(time.Duration(i) * time.Hour), LastHit: last.Add(time.Duration(i) * time.Hour)},
+		}); err != nil {
+			panic(err)
 		}
 	}
 
+	if v, err := db.GetHits(); err != nil {
+		panic(err)
+	} else if len(v) != 1 {
+		t.Errorf("Bad mapping hits count %v, expected 1", len(v))
+	} else {
+		if v[0].Count != 4 {
+			t.Errorf("Bad hit count %v, expected 4", v[0].Count)
+		}
+
+		if !v[0].FirstHit.Equal(first) {
+			t.Errorf("Bad first hit time %v, expected %v", v[0].FirstHit, first)
+		}
+
+		if expect := last.Add(time.Hour); !v[0].LastHit.Equal(expect) {
+			t.Errorf("Bad last hit time %v, expected %v", v[0].LastHit, expect)
+		}
+	}
+
+	if v, err := db.GetHits("/temporary", "/permanent"); err != nil {
+		panic(err)
+	} else if len(v) != 1 || v[0].Key != "/temporary" {
+		t.Errorf("Bad hits for the given keys: %v", v)
+	}
+
+	if v, err := db.GetHits("/permanent"); err != nil {
+		panic(err)
+	} else if len(v) != 0 {
+		t.Errorf("Bad hits for a mapping without hits: %v", v)
+	}
+
+	// test misses
+	for i, key := range []string{"/miss/a", "/miss/b", "/miss/a", "/miss/c", "/miss/c", "/miss/c"} {
+		if err := db.AddMisses([]*Miss{
+			{Key: key, Count: 1, Referer: key, LastSeen: first.Add(time.Duration(i) * time.Second)},
+		}, 2); err != nil {
+			panic(err)
+		}
+	}
+
+	if v, err := db.GetMisses(0); err != nil {
+		panic(err)
+	} else if len(v) != 2 {
+		t.Errorf("Bad miss count %v, expected 2", len(v))
+	} else {
+		if v[0].Key != "/miss/c" || v[0].Count != 3 {
+			t.Errorf("Bad top miss %v with count %v, expected /miss/c with count 3", v[0].Key, v[0].Count)
+		}
+
+		if v[1].Key != "/miss/a" || v[1].Count != 2 || v[1].Referer != "/miss/a" {
+			t.Errorf("Bad miss %v with count %v, expected /miss/a with count 2", v[1].Key, v[1].Count)
+		}
+	}
+
+	if v, err := db.GetMisses(1); err != nil {
+		panic(err)
+	} else if len(v) != 1 {
+		t.Errorf("Bad limited miss count %v, expected 1", len(v))
+	}
+
+	for _, key := range []string{"/miss/a", "/miss/c"} {
+		if err := db.DeleteMiss(key); err != nil {
+			panic(err)
+		}
+	}
+
+	if v, err := db.GetMisses(0); err != nil {
+		panic(err)
+	} else if len(v) != 0 {
+		t.Errorf("Misses were deleted but still exist in database")
+	}
+
 	// test all
 	if v, err := db.GetMappings(); err != nil {
 		panic(err)
@@ -63,4 +208,392 @@ func testDB(t *testing.T, db Database) {
 			t.Errorf("Mapping was deleted but still exists in database")
 		}
 	}
+
+	if _, err := db.GetPrefixMapping("/prefix/a"); err != MappingNotFoundError {
+		t.Errorf("Prefix mapping was deleted but still exists in database")
+	}
+
+	if v, err := db.GetRegexpMappings(); err != nil {
+		panic(err)
+	} else if len(v) != 0 {
+		t.Errorf("Regexp mappings were deleted but still exist in database")
+	}
+
+	if v, err := db.GetHits(); err != nil {
+		panic(err)
+	} else if len(v) != 0 {
+		t.Errorf("Mappings were deleted but hits still exist in database")
+	}
+}
+
+// testDBNamespaces checks that mappings in separate namespaces are isolated
+// from each other.
+func testDBNamespaces(t *testing.T, db Database) {
+	ns, err := db.Namespace("*.example.test")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, d := range []Database{db, ns} {
+		if _, err := d.DeleteMappings(""); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := db.AddMapping(&Mapping{Key: "/global", Destination: "/okay"}); err != nil {
+		panic(err)
+	}
+
+	if err := ns.AddMapping(&Mapping{Key: "/host", Destination: "/okay", Type: PrefixMapping}); err != nil {
+		panic(err)
+	}
+
+	if m, err := ns.GetMapping("/global"); err != MappingNotFoundError {
+		t.Errorf("Expected MappingNotFoundError for global mapping in namespace, got: %v, %v", m, err)
+	}
+
+	if m, err := db.GetPrefixMapping("/host/path"); err != MappingNotFoundError {
+		t.Errorf("Expected MappingNotFoundError for namespaced mapping in global namespace, got: %v, %v", m, err)
+	}
+
+	if m, err := ns.GetPrefixMapping("/host/path"); err != nil || m.Key != "/host" {
+		t.Errorf("Expected namespaced prefix mapping, got: %v, %v", m, err)
+	}
+
+	if _, err := ns.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+
+	if mappings, err := db.GetMappings(); err != nil || len(mappings) != 1 {
+		t.Errorf("Expected 1 global mapping after clearing namespace, got: %v, %v", len(mappings), err)
+	}
+
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+}
+
+// testDBStats checks that the number of mappings in the namespace is reported.
+func testDBStats(t *testing.T, db Database) {
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+
+	for _, key := range []string{"/a", "/b", "/c"} {
+		if err := db.AddMapping(&Mapping{Key: key, Destination: "/okay"}); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := db.DeleteMapping("/b"); err != nil {
+		panic(err)
+	}
+
+	if stats, err := db.Stats(); err != nil {
+		panic(err)
+	} else if stats.TotalMappings != 2 {
+		t.Errorf("Expected 2 mappings, got %v", stats.TotalMappings)
+	}
+
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+}
+
+// testDBExpiredMappings checks that expired mappings are deleted.
+func testDBExpiredMappings(t *testing.T, db Database) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	mappings := []*Mapping{
+		{Key: "/expired", Destination: "/okay", NotAfter: &past},
+		{Key: "/expiring", Destination: "/okay", NotAfter: &future},
+		{Key: "/permanent", Destination: "/okay"},
+	}
+	for _, m := range mappings {
+		if err := db.AddMapping(m); err != nil {
+			panic(err)
+		}
+	}
+
+	// re-adding a mapping should replace its expiry index entry
+	mappings[1].NotAfter = &past
+	if err := db.AddMapping(mappings[1]); err != nil {
+		panic(err)
+	}
+
+	n, err := db.DeleteExpiredMappings(now, "tester")
+	if err != nil {
+		panic(err)
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 expired mappings to be deleted, got %v", n)
+	}
+
+	for _, key := range []string{"/expired", "/expiring"} {
+		if _, err := db.GetMapping(key); err != MappingNotFoundError {
+			t.Errorf("Expired mapping %v was not deleted", key)
+		}
+	}
+
+	if _, err := db.GetMapping("/permanent"); err != nil {
+		t.Errorf("Error getting unexpired mapping: %v", err)
+	}
+}
+
+// testDBListMappings checks that mappings are listed page by page and
+// filtered by key prefix and search text.
+func testDBListMappings(t *testing.T, db Database) {
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+
+	for _, m := range []*Mapping{
+		{Key: "/a/1", Destination: "/one"},
+		{Key: "/a/2", Destination: "/two", Comment: "Spring PROMO"},
+		{Key: "/a/3", Destination: "/three"},
+		{Key: "/a/4", Destination: "/promo/four"},
+		{Key: "/a/5", Destination: "/five"},
+		{Key: "/b/1", Destination: "/promo/b"},
+	} {
+		if err := db.AddMapping(m); err != nil {
+			panic(err)
+		}
+	}
+
+	list := func(opts ListOptions) []string {
+		keys := make([]string, 0)
+		for pages := 0; ; pages++ {
+			mappings, next, err := db.ListMappings(opts)
+			if err != nil {
+				panic(err)
+			}
+
+			if opts.Limit > 0 && len(mappings) > opts.Limit {
+				t.Errorf("Expected at most %v mappings in page, got %v", opts.Limit, len(mappings))
+			}
+
+			for _, m := range mappings {
+				keys = append(keys, m.Key)
+			}
+
+			if next == "" || pages > 10 {
+				return keys
+			}
+			opts.After = next
+		}
+	}
+
+	tests := []struct {
+		opts   ListOptions
+		expect string
+	}{
+		{ListOptions{}, "/a/1 /a/2 /a/3 /a/4 /a/5 /b/1"},
+		{ListOptions{Limit: 2}, "/a/1 /a/2 /a/3 /a/4 /a/5 /b/1"},
+		{ListOptions{Limit: 6}, "/a/1 /a/2 /a/3 /a/4 /a/5 /b/1"},
+		{ListOptions{Limit: 2, Prefix: "/a/"}, "/a/1 /a/2 /a/3 /a/4 /a/5"},
+		{ListOptions{Prefix: "/b"}, "/b/1"},
+		{ListOptions{Prefix: "/c"}, ""},
+		{ListOptions{Search: "promo"}, "/a/2 /a/4 /b/1"},
+		{ListOptions{Limit: 1, Prefix: "/a/", Search: "promo"}, "/a/2 /a/4"},
+	}
+
+	for _, test := range tests {
+		if keys := strings.Join(list(test.opts), " "); keys != test.expect {
+			t.Errorf("Expected [%v] for %+v, got [%v]", test.expect, test.opts, keys)
+		}
+	}
+
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+}
+
+// testDBRevisions checks that mapping revisions are incremented on each change
+// and that conditional changes fail if the revision does not match.
+func testDBRevisions(t *testing.T, db Database) {
+	if _, err := db.DeleteMappings(""); err != nil {
+		panic(err)
+	}
+
+	m := &Mapping{Key: "/rev", Destination: "/one"}
+	if _, err := db.AddMappingIf(m, MissingRevision, ""); err != nil {
+		t.Fatalf("Error creating mapping: %v", err)
+	}
+
+	if m.Revision != 1 || m.Modified == nil {
+		t.Errorf("Expected revision 1 with modified time, got %v, %v", m.Revision, m.Modified)
+	}
+
+	if _, err := db.AddMappingIf(&Mapping{Key: "/rev", Destination: "/two"}, MissingRevision, ""); err != RevisionMismatchError {
+		t.Errorf("Expected RevisionMismatchError creating existing mapping, got %v", err)
+	}
+
+	if _, err := db.AddMappingIf(&Mapping{Key: "/rev", Destination: "/two"}, 2, ""); err != RevisionMismatchError {
+		t.Errorf("Expected RevisionMismatchError for future revision, got %v", err)
+	}
+
+	m = &Mapping{Key: "/rev", Destination: "/two"}
+	if _, err := db.AddMappingIf(m, 1, ""); err != nil {
+		t.Errorf("Error updating mapping at revision 1: %v", err)
+	}
+
+	if err := db.AddMapping(&Mapping{Key: "/rev", Destination: "/three"}); err != nil {
+		panic(err)
+	}
+
+	v, err := db.GetMapping("/rev")
+	if err != nil {
+		panic(err)
+	}
+
+	if v.Revision != 3 || v.Destination != "/three" || v.Modified == nil {
+		t.Errorf("Expected stored revision 3 of /three, got %v of %v", v.Revision, v.Destination)
+	}
+
+	if _, err := db.DeleteMappingIf("/rev", 2, ""); err != RevisionMismatchError {
+		t.Errorf("Expected RevisionMismatchError deleting stale revision, got %v", err)
+	}
+
+	if _, err := db.GetMapping("/rev"); err != nil {
+		t.Errorf("Expected mapping to remain after failed delete, got %v", err)
+	}
+
+	if _, err := db.DeleteMappingIf("/rev", 3, ""); err != nil {
+		t.Errorf("Error deleting mapping at revision 3: %v", err)
+	}
+
+	if _, err := db.DeleteMappingIf("/rev", AnyRevision, ""); err != MappingNotFoundError {
+		t.Errorf("Expected MappingNotFoundError deleting missing mapping, got %v", err)
+	}
+
+	if _, err := db.AddMappingIf(&Mapping{Key: "/rev", Destination: "/four"}, 3, ""); err != RevisionMismatchError {
+		t.Errorf("Expected RevisionMismatchError updating deleted mapping, got %v", err)
+	}
+}
+
+// testDBHistory checks that changes to mappings are recorded in their history
+// and can be rolled back.
+func testDBHistory(t *testing.T, db Database) {
+	if _, err := db.DeleteMappings("tester"); err != nil {
+		panic(err)
+	}
+
+	for _, dest := range []string{"/one", "/two"} {
+		if _, err := db.AddMappingIf(&Mapping{Key: "/hist", Destination: dest}, AnyRevision, "tester"); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := db.DeleteMappingIf("/hist", AnyRevision, "tester"); err != nil {
+		panic(err)
+	}
+
+	history, err := db.GetHistory("/hist")
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+
+	actions := make([]string, 0)
+	for _, c := range history {
+		actions = append(actions, c.Action)
+		if c.Actor != "tester" {
+			t.Errorf("Expected actor tester, got %v", c.Actor)
+		}
+	}
+
+	if strings.Join(actions, ",") != "add,update,delete" {
+		t.Fatalf("Expected history add,update,delete, got %v", actions)
+	}
+
+	if history[1].Previous == nil || history[1].Previous.Destination != "/one" || history[1].Mapping.Revision != 2 {
+		t.Errorf("Expected update of /one to revision 2, got %v", history[1])
+	}
+
+	if _, err := rollbackMapping(db, "/hist", 2, "tester"); err != nil {
+		t.Fatalf("Error rolling back to revision 2: %v", err)
+	}
+
+	if m, err := db.GetMapping("/hist"); err != nil || m.Destination != "/two" {
+		t.Errorf("Expected /hist restored to /two, got %v, %v", m, err)
+	}
+
+	if _, err := rollbackMapping(db, "/hist", 99, "tester"); err != RevisionNotFoundError {
+		t.Errorf("Expected RevisionNotFoundError, got %v", err)
+	}
+
+	// roll back all changes made since a point in time
+	before := time.Now()
+	for _, m := range []*Mapping{{Key: "/hist", Destination: "/three"}, {Key: "/new", Destination: "/okay"}} {
+		if _, err := db.AddMappingIf(m, AnyRevision, "tester"); err != nil {
+			panic(err)
+		}
+	}
+
+	changes, err := db.GetChanges(before)
+	if err != nil {
+		t.Fatalf("Error getting changes: %v", err)
+	}
+
+	if len(changes) != 2 {
+		t.Errorf("Expected 2 changes since %v, got %v", before, len(changes))
+	}
+
+	if _, err := rollbackMappings(db, before, "tester"); err != nil {
+		t.Fatalf("Error rolling back changes: %v", err)
+	}
+
+	if m, err := db.GetMapping("/hist"); err != nil || m.Destination != "/two" {
+		t.Errorf("Expected /hist restored to /two, got %v, %v", m, err)
+	}
+
+	if _, err := db.GetMapping("/new"); err != MappingNotFoundError {
+		t.Errorf("Expected /new to be removed, got %v", err)
+	}
+
+	// deletions by the sweeper and of all mappings are recorded
+	past := time.Now().Add(-time.Hour)
+	for _, m := range []*Mapping{{Key: "/swept", Destination: "/okay", NotAfter: &past}, {Key: "/a", Destination: "/okay"}, {Key: "/b", Destination: "/okay"}} {
+		if _, err := db.AddMappingIf(m, AnyRevision, "tester"); err != nil {
+			panic(err)
+		}
+	}
+
+	before = time.Now()
+	if n, err := db.DeleteExpiredMappings(time.Now(), "sweeper"); err != nil || n != 1 {
+		t.Errorf("Expected 1 expired mapping to be deleted, got %v, %v", n, err)
+	}
+
+	if n, err := db.DeleteMappings("tester"); err != nil || n != 3 {
+		t.Errorf("Expected 3 mappings to be deleted, got %v, %v", n, err)
+	}
+
+	history, err = db.GetHistory("/swept")
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+
+	if c := history[len(history)-1]; c.Action != DeleteAction || c.Actor != "sweeper" || c.Previous == nil {
+		t.Errorf("Expected deletion by sweeper in history, got %v", c)
+	}
+
+	restored, err := rollbackMappings(db, before, "tester")
+	if err != nil {
+		t.Fatalf("Error rolling back deletions: %v", err)
+	}
+
+	if len(restored) != 4 {
+		t.Errorf("Expected 4 mappings to be restored, got %v", len(restored))
+	}
+
+	for _, key := range []string{"/hist", "/swept", "/a", "/b"} {
+		if _, err := db.GetMapping(key); err != nil {
+			t.Errorf("Expected %v to be restored, got %v", key, err)
+		}
+	}
+
+	if _, err := db.DeleteMappings("tester"); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Driver opens databases of a single type. Drivers are registered by name
+// with RegisterDriver and selected with the "database" configuration setting.
+type Driver struct {
+	// Open opens a database using the given configuration.
+	Open func(cfg *Config) (Database, error)
+
+	// Options returns a pointer to a new options struct for the driver, with
+	// defaults set from the given configuration. The struct describes the
+	// driver-specific settings accepted in the "databaseOptions"
+	// configuration object.
+	Options func(cfg *Config) interface{}
+}
+
+var (
+	drivers   = make(map[string]*Driver)
+	driversMu sync.RWMutex
+)
+
+// RegisterDriver makes a database driver available by the given name. If
+// RegisterDriver is called twice with the same name or if driver is nil, it
+// panics.
+func RegisterDriver(name string, driver *Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if driver == nil || driver.Open == nil || driver.Options == nil {
+		panic("redirector: RegisterDriver driver is nil")
+	}
+
+	if _, ok := drivers[name]; ok {
+		panic("redirector: RegisterDriver called twice for driver " + name)
+	}
+
+	drivers[name] = driver
+}
+
+// Drivers returns the sorted names of all registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// getDriver returns the driver registered with the given name.
+func getDriver(name string) (*Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	driver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: %v", UnsupportedDatabaseDriverError, name)
+	}
+
+	return driver, nil
+}
+
+// OpenDatabase opens a database using the configured driver.
+func OpenDatabase(cfg *Config) (Database, error) {
+	driver, err := getDriver(cfg.DatabaseDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.Open(cfg)
+}
+
+// validateDatabaseOptions returns an error if the configured database driver
+// is not registered or does not accept the configured database options.
+func validateDatabaseOptions(cfg *Config) error {
+	driver, err := getDriver(cfg.DatabaseDriver)
+	if err != nil {
+		return err
+	}
+
+	if err := decodeDatabaseOptions(cfg, driver.Options(cfg)); err != nil {
+		return fmt.Errorf("Invalid options for database driver %v: %v", cfg.DatabaseDriver, err)
+	}
+
+	return nil
+}
+
+// decodeDatabaseOptions decodes the configured database options into v.
+// Unknown options are an error.
+func decodeDatabaseOptions(cfg *Config, v interface{}) error {
+	if len(cfg.DatabaseOptions) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(cfg.DatabaseOptions))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// dsnPassword matches the password of a keyword/value connection string, such
+// as "host=localhost password=secret" or "password='a secret'".
+var dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s]*)`)
+
+// DatabaseOptions are the raw, driver-specific options of the configured
+// database driver. They are decoded by the driver when the database is opened.
+type DatabaseOptions json.RawMessage
+
+// MarshalJSON encodes the options with any passwords redacted.
+func (o DatabaseOptions) MarshalJSON() ([]byte, error) {
+	if len(o) == 0 {
+		return []byte("null"), nil
+	}
+
+	v := make(map[string]interface{})
+	if err := json.Unmarshal(o, &v); err != nil {
+		return nil, err
+	}
+
+	for k, val := range v {
+		if strings.Contains(strings.ToLower(k), "password") {
+			v[k] = "********"
+			continue
+		}
+
+		// connection strings may include a password
+		if s, ok := val.(string); ok {
+			if u, err := url.Parse(s); err == nil && u.User != nil {
+				v[k] = u.Redacted()
+			} else if dsnPassword.MatchString(s) {
+				v[k] = dsnPassword.ReplaceAllString(s, "${1}********")
+			}
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON stores a copy of the raw options.
+func (o *DatabaseOptions) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*o = nil
+		return nil
+	}
+
+	*o = append((*o)[0:0], b...)
+	return nil
+}
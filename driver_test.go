@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDrivers(t *testing.T) {
+	names := Drivers()
+	expect := []string{"bolt", "postgres", "redis", "sqlite"}
+	if len(names) != len(expect) {
+		t.Fatalf("Expected drivers %v, got %v", expect, names)
+	}
+
+	for i, name := range expect {
+		if names[i] != name {
+			t.Errorf("Expected driver %v at index %v, got %v", name, i, names[i])
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected panic registering a duplicate driver")
+			}
+		}()
+
+		RegisterDriver("bolt", &Driver{Open: OpenBoltDatabase, Options: newBoltOptions})
+	}()
+}
+
+func TestValidateDatabaseOptions(t *testing.T) {
+	tests := []struct {
+		driver  string
+		options string
+		valid   bool
+	}{
+		{"bolt", ``, true},
+		{"bolt", `{"path": "./test.db", "timeout": "1s"}`, true},
+		{"bolt", `{"dsn": "./test.db"}`, false},
+		{"bolt", `{"timeout": "forever"}`, false},
+		{"redis", `{"address": "localhost:6379", "db": 1}`, true},
+		{"redis", `{"path": "./test.db"}`, false},
+		{"sqlite", `{"dsn": "./test.db"}`, true},
+		{"postgres", `{"dsn": "postgres://localhost/redirector", "maxOpenConns": 8}`, true},
+		{"nope", ``, false},
+	}
+
+	for _, test := range tests {
+		c := &Config{
+			DatabaseDriver:  test.driver,
+			DatabaseOptions: DatabaseOptions(test.options),
+		}
+
+		err := validateDatabaseOptions(c)
+		if test.valid && err != nil {
+			t.Errorf("Expected valid options for %v driver: %v: %v", test.driver, test.options, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("Expected invalid options for %v driver: %v", test.driver, test.options)
+		}
+	}
+}
@@ -3,10 +3,95 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
 )
 
-// MarshallBinary serializes an object into a slice of bytes.
+// Records are stored as a three byte magic number, followed by a one byte
+// schema version and a JSON document. Records written before the envelope was
+// introduced are bare gob-encoded structs and are still readable.
+var recordMagic = []byte("rdr")
+
+// recordVersion is the schema version of newly written records.
+const recordVersion byte = 1
+
+var UnsupportedRecordVersionError = fmt.Errorf("Unsupported record version")
+
+// A RecordMigrator is a Database that can rewrite legacy records in the
+// current record format.
+type RecordMigrator interface {
+	// MigrateRecords rewrites all legacy records in all namespaces and returns
+	// the number of records rewritten.
+	MigrateRecords() (int64, error)
+}
+
+// mappingRecord is the stored form of a Mapping. It includes fields that are
+// omitted from the JSON representation of a Mapping in the API.
+type mappingRecord struct {
+	*Mapping
+	IsTemplate bool `json:"isTemplate,omitempty"`
+}
+
+// MarshallBinary serializes an object into a versioned record.
 func MarshallBinary(v interface{}) ([]byte, error) {
+	if m, ok := v.(*Mapping); ok {
+		v = &mappingRecord{Mapping: m, IsTemplate: m.IsTemplate}
+	}
+
+	w := bytes.NewBuffer(append(append([]byte{}, recordMagic...), recordVersion))
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return w.Bytes(), nil
+}
+
+// UnmarshallBinary deserializes a versioned or legacy gob record into an
+// object.
+func UnmarshallBinary(b []byte, v interface{}) error {
+	if isLegacyRecord(b) {
+		return unmarshallGob(b, v)
+	}
+
+	if version := b[len(recordMagic)]; version != recordVersion {
+		return fmt.Errorf("%v: %v", UnsupportedRecordVersionError, version)
+	}
+
+	if m, ok := v.(*Mapping); ok {
+		r := &mappingRecord{Mapping: m}
+		if err := json.Unmarshal(b[len(recordMagic)+1:], r); err != nil {
+			return err
+		}
+
+		m.IsTemplate = r.IsTemplate
+		return nil
+	}
+
+	return json.Unmarshal(b[len(recordMagic)+1:], v)
+}
+
+// isLegacyRecord returns true if b was not written by MarshallBinary in a
+// versioned envelope.
+func isLegacyRecord(b []byte) bool {
+	return len(b) <= len(recordMagic) || !bytes.HasPrefix(b, recordMagic)
+}
+
+// migrateRecord returns b rewritten in the current record format, decoded via
+// v, or nil if b is already current.
+func migrateRecord(b []byte, v interface{}) ([]byte, error) {
+	if !isLegacyRecord(b) {
+		return nil, nil
+	}
+
+	if err := UnmarshallBinary(b, v); err != nil {
+		return nil, err
+	}
+
+	return MarshallBinary(v)
+}
+
+// marshallGob serializes an object in the legacy gob record format.
+func marshallGob(v interface{}) ([]byte, error) {
 	w := &bytes.Buffer{}
 	enc := gob.NewEncoder(w)
 	if err := enc.Encode(v); err != nil {
@@ -16,8 +101,8 @@ func MarshallBinary(v interface{}) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
-// UnmarshallBinary deserializes a slice of bytes into an object.
-func UnmarshallBinary(b []byte, v interface{}) error {
+// unmarshallGob deserializes a legacy gob record into an object.
+func unmarshallGob(b []byte, v interface{}) error {
 	r := bytes.NewReader(b)
 	dec := gob.NewDecoder(r)
 	if err := dec.Decode(v); err != nil {
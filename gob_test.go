@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour).Round(0)
+	m := &Mapping{
+		Key:         "/test",
+		Destination: "/{{ .Key }}",
+		Status:      301,
+		Type:        PrefixMapping,
+		NotAfter:    &notAfter,
+		IsTemplate:  true,
+	}
+
+	b, err := MarshallBinary(m)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.HasPrefix(b, []byte("rdr\x01{")) {
+		t.Errorf("Expected versioned JSON record, got: %q", b)
+	}
+
+	v := &Mapping{}
+	if err := UnmarshallBinary(b, v); err != nil {
+		panic(err)
+	}
+
+	if v.Key != m.Key || v.Destination != m.Destination || v.Status != m.Status || v.Type != m.Type || !v.IsTemplate {
+		t.Errorf("Expected %+v, got %+v", m, v)
+	}
+
+	if v.NotAfter == nil || !v.NotAfter.Equal(notAfter) {
+		t.Errorf("Expected notAfter %v, got %v", notAfter, v.NotAfter)
+	}
+
+	// legacy records
+	b, err = marshallGob(m)
+	if err != nil {
+		panic(err)
+	}
+
+	v = &Mapping{}
+	if err := UnmarshallBinary(b, v); err != nil {
+		panic(err)
+	}
+
+	if v.Key != m.Key || !v.IsTemplate {
+		t.Errorf("Expected %+v from legacy record, got %+v", m, v)
+	}
+
+	if vb, err := migrateRecord(b, &Mapping{}); err != nil || isLegacyRecord(vb) {
+		t.Errorf("Expected migrated record, got: %q, %v", vb, err)
+	}
+
+	// future records
+	if err := UnmarshallBinary([]byte("rdr\x02{}"), &Mapping{}); err == nil {
+		t.Errorf("Expected error for unsupported record version")
+	}
+}
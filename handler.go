@@ -4,21 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"time"
 )
 
 // defaultHandler is a http.Handler that provides runtime configuration, request
-// logging and panic handling.
+// logging, metrics and panic handling.
 type defaultHandler struct {
-	Runtime *Runtime
-	Handler http.Handler
+	Runtime  *Runtime
+	Listener string // name of the listener in request metrics
+	Handler  http.Handler
 }
 
-// WrapHandler returns a defaultHandler that wraps the given http.Handler.
-func WrapHandler(rt *Runtime, h http.Handler) http.Handler {
+// WrapHandler returns a defaultHandler that wraps the given http.Handler of
+// the named listener.
+func WrapHandler(rt *Runtime, listener string, h http.Handler) http.Handler {
 	return &defaultHandler{
-		Runtime: rt,
-		Handler: h,
+		Runtime:  rt,
+		Listener: listener,
+		Handler:  h,
 	}
 }
 
@@ -35,39 +39,52 @@ func loggable(v interface{}) string {
 func (c *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	ww := NewResponseWriter(w)
+	entry := newAccessLogEntry(c.Listener, r, start)
+	r = withAccessLogEntry(r, entry)
 	defer func() {
-		if err := recover(); err != nil {
-			status := StatusCodeForError(err.(error))
+		if v := recover(); v != nil {
+			err, ok := v.(error)
+			if !ok {
+				err = fmt.Errorf("%v", v)
+			}
+
+			status := StatusCodeForError(err)
 			if status >= 500 && status < 600 {
-				c.Runtime.Logger.Printf("Error: %v", err)
-				// TODO: log stack traces
+				c.Runtime.Logger.With(Fields{
+					"method":     r.Method,
+					"url":        r.URL.String(),
+					"remoteAddr": r.RemoteAddr,
+					"stack":      string(debug.Stack()),
+				}).Errorf("Error: %v", err)
 
-				if c.Runtime.Config.ExitOnError {
+				if c.Runtime.Config().ExitOnError {
 					panic(err)
 				}
 			}
 
+			// statuses without a template, such as the errors of the
+			// management API, have a plain text body
 			ww.WriteHeader(status)
 			if body, err := BodyForStatus(status); err != nil {
-				c.Runtime.Logger.Printf("Error getting body for status %v: %v", status, err)
+				if err != BodyNotFoundError {
+					c.Runtime.Logger.Warnf("Error getting body for status %v: %v", status, err)
+				}
 				fmt.Fprintf(ww, "%d %s\n", status, http.StatusText(status))
 			} else {
 				fmt.Fprintf(ww, body)
 			}
 		}
 
-		d := time.Since(start)
-		c.Runtime.AccessLogger.Printf(
-			"%s %s %s %s %d %d %s %s %d",
-			r.RemoteAddr,
-			r.Method,
-			r.URL,
-			r.Proto,
-			ww.Status(),
-			ww.Size(),
-			loggable(r.Header.Get("Referer")),
-			loggable(ww.Header().Get("Location")),
-			d.Nanoseconds())
+		entry.Status = ww.Status()
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK // nothing was written
+		}
+		entry.Size = ww.Size()
+		entry.Location = ww.Header().Get("Location")
+		entry.Duration = time.Since(start)
+
+		c.Runtime.Metrics.ObserveRequest(c.Listener, entry.Status, entry.Duration)
+		c.Runtime.AccessLogger.Log(entry)
 	}()
 
 	ww.Header().Set("Server", PACKAGE_NAME+"/"+PACKAGE_VERSION)
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Actions recorded in the history of a mapping key.
+const (
+	AddAction    = "add"
+	UpdateAction = "update"
+	DeleteAction = "delete"
+)
+
+// A MappingChange is an entry in the append-only history of a mapping key.
+type MappingChange struct {
+	Key      string    `json:"key"`
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor,omitempty"`    // who made the change, if known
+	Previous *Mapping  `json:"previous,omitempty"` // nil if the mapping was added
+	Mapping  *Mapping  `json:"mapping,omitempty"`  // nil if the mapping was deleted
+}
+
+var RevisionNotFoundError = fmt.Errorf("Mapping revision not found in history")
+
+// sortChanges sorts changes into the order they were made.
+func sortChanges(changes []*MappingChange) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Time.Before(changes[j].Time)
+	})
+}
+
+// newChange returns the change that replaces the stored mapping prev with m at
+// the given time. The mapping was added if prev is nil and deleted if m is nil.
+func newChange(key string, prev, m *Mapping, actor string, t time.Time) *MappingChange {
+	change := &MappingChange{
+		Key:      key,
+		Action:   UpdateAction,
+		Time:     t,
+		Actor:    actor,
+		Previous: prev,
+		Mapping:  m,
+	}
+
+	switch {
+	case prev == nil:
+		change.Action = AddAction
+	case m == nil:
+		change.Action = DeleteAction
+	}
+
+	return change
+}
+
+// restoreMapping replaces the current value of a mapping key with the given
+// value from its history, or deletes the mapping if v is nil. It returns nil
+// if the mapping already has the given value.
+func restoreMapping(db Database, key string, v *Mapping, actor string) (*MappingChange, error) {
+	cur, err := db.GetMapping(key)
+	if err == MappingNotFoundError {
+		cur = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		if cur == nil {
+			return nil, nil
+		}
+
+		return db.DeleteMappingIf(key, cur.Revision, actor)
+	}
+
+	// the same write of the mapping is still current
+	if cur != nil && cur.Revision == v.Revision && cur.Modified != nil && v.Modified != nil && cur.Modified.Equal(*v.Modified) {
+		return nil, nil
+	}
+
+	rev := MissingRevision
+	if cur != nil {
+		rev = cur.Revision
+	}
+
+	m := *v
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return db.AddMappingIf(&m, rev, actor)
+}
+
+// rollbackMapping restores the given revision of a mapping from its history.
+// If a revision appears more than once in the history, because the mapping was
+// deleted and added again, the most recent is restored.
+func rollbackMapping(db Database, key string, rev int64, actor string) (*MappingChange, error) {
+	history, err := db.GetHistory(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m := mappingRevision(history, rev)
+	if m == nil {
+		return nil, RevisionNotFoundError
+	}
+
+	return restoreMapping(db, key, m, actor)
+}
+
+// mappingRevision returns the most recent value of the given revision in the
+// history of a mapping key, or nil if the revision is not found.
+func mappingRevision(history []*MappingChange, rev int64) *Mapping {
+	for i := len(history) - 1; i >= 0; i-- {
+		for _, m := range []*Mapping{history[i].Mapping, history[i].Previous} {
+			if m != nil && m.Revision == rev {
+				return m
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollbackMappings restores every mapping changed since the given time to its
+// value at that time, and returns the changes made.
+func rollbackMappings(db Database, before time.Time, actor string) ([]*MappingChange, error) {
+	changes, err := db.GetChanges(before)
+	if err != nil {
+		return nil, err
+	}
+
+	// the value of each key before its first change since the given time
+	keys := make([]string, 0)
+	values := make(map[string]*Mapping)
+	for _, c := range changes {
+		if _, ok := values[c.Key]; !ok {
+			keys = append(keys, c.Key)
+			values[c.Key] = c.Previous
+		}
+	}
+
+	restored := make([]*MappingChange, 0)
+	for _, key := range keys {
+		change, err := restoreMapping(db, key, values[key], actor)
+		if err != nil {
+			return restored, fmt.Errorf("Error restoring %v: %v", key, err)
+		}
+
+		if change != nil {
+			restored = append(restored, change)
+		}
+	}
+
+	return restored, nil
+}
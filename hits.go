@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MappingHits records usage of a single mapping.
+type MappingHits struct {
+	Key      string    `json:"key"`
+	Count    int64     `json:"count"`
+	FirstHit time.Time `json:"firstHit"`
+	LastHit  time.Time `json:"lastHit"`
+}
+
+// Merge adds the hits recorded in v to h.
+func (h *MappingHits) Merge(v *MappingHits) {
+	if h.Count == 0 || v.FirstHit.Before(h.FirstHit) {
+		h.FirstHit = v.FirstHit
+	}
+
+	if v.LastHit.After(h.LastHit) {
+		h.LastHit = v.LastHit
+	}
+
+	h.Count += v.Count
+}
+
+// HitRecorder accumulates mapping hits in memory so they may be written to a
+// Database in batches, away from the request path.
+type HitRecorder struct {
+	db    Database
+	mu    sync.Mutex
+	batch map[string]map[string]*MappingHits // keyed by namespace and key
+}
+
+func NewHitRecorder(db Database) *HitRecorder {
+	return &HitRecorder{
+		db:    db,
+		batch: make(map[string]map[string]*MappingHits),
+	}
+}
+
+// Hit records a hit for the given mapping key in the given database namespace
+// at the given time.
+func (c *HitRecorder) Hit(ns, key string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch, ok := c.batch[ns]
+	if !ok {
+		batch = make(map[string]*MappingHits)
+		c.batch[ns] = batch
+	}
+
+	if h, ok := batch[key]; ok {
+		h.Count++
+		h.LastHit = t
+		return
+	}
+
+	batch[key] = &MappingHits{
+		Key:      key,
+		Count:    1,
+		FirstHit: t,
+		LastHit:  t,
+	}
+}
+
+// Flush writes all accumulated hits to the database.
+func (c *HitRecorder) Flush() error {
+	c.mu.Lock()
+	batches := c.batch
+	c.batch = make(map[string]map[string]*MappingHits, len(batches))
+	c.mu.Unlock()
+
+	for ns, batch := range batches {
+		hits := make([]*MappingHits, 0, len(batch))
+		for _, h := range batch {
+			hits = append(hits, h)
+		}
+
+		db, err := c.db.Namespace(ns)
+		if err != nil {
+			return err
+		}
+
+		if err := db.AddHits(hits); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushStats writes all accumulated mapping hits and misses to the database.
+func flushStats(rt *Runtime) {
+	if rt.Hits != nil {
+		if err := rt.Hits.Flush(); err != nil {
+			rt.Logger.Errorf("Error writing mapping hits: %v", err)
+		}
+	}
+
+	if rt.Misses != nil {
+		if err := rt.Misses.Flush(); err != nil {
+			rt.Logger.Errorf("Error writing missing keys: %v", err)
+		}
+	}
+}
+
+// flushStatsPeriodically calls flushStats at the configured interval. It
+// blocks indefinitely and should be run in its own goroutine.
+func flushStatsPeriodically(rt *Runtime) {
+	ticker := time.NewTicker(rt.Config().StatsFlushInterval.Duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		flushStats(rt)
+	}
+}
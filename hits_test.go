@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHitRecorder(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		rt.Hits = NewHitRecorder(rt.Database)
+		start := time.Now()
+		for _, path := range []string{"/temporary", "/temporary", "/prefix/a", "/does/not/exist"} {
+			if _, err := testHttpClient().Get(ts.URL + path); err != nil {
+				panic(err)
+			}
+		}
+
+		if err := rt.Hits.Flush(); err != nil {
+			panic(err)
+		}
+
+		if _, err := testHttpClient().Get(ts.URL + "/temporary"); err != nil {
+			panic(err)
+		}
+
+		if err := rt.Hits.Flush(); err != nil {
+			panic(err)
+		}
+
+		hits, err := rt.Database.GetHits()
+		if err != nil {
+			panic(err)
+		}
+
+		expect := map[string]int64{
+			"/temporary": 3,
+			"/prefix":    1,
+		}
+		if len(hits) != len(expect) {
+			t.Fatalf("Expected hits for %v mappings, got %v", len(expect), len(hits))
+		}
+
+		for _, h := range hits {
+			if h.Count != expect[h.Key] {
+				t.Errorf("Expected %v hits for mapping %v, got %v", expect[h.Key], h.Key, h.Count)
+			}
+
+			if h.FirstHit.Before(start) || h.LastHit.Before(h.FirstHit) {
+				t.Errorf("Bad hit times for mapping %v: first: %v, last: %v", h.Key, h.FirstHit, h.LastHit)
+			}
+		}
+	})
+}
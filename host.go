@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostConfig overrides the global configuration for requests to a virtual
+// host. Empty fields inherit the global configuration.
+//
+// Mappings for each configured host are stored in their own database
+// namespace, named for the host as it appears in the configuration.
+type HostConfig struct {
+	Name              string      `json:"-"`          // database namespace; empty for the global configuration
+	KeyBuilderName    string      `json:"keyBuilder"` // The name of the KeyBuilder
+	KeyBuilder        KeyBuilder  `json:"-"`          // An instance of a KeyBuilder
+	DefaultKey        string      `json:"defaultKey"` // fallback for all 404s
+	DestinationPrefix string      `json:"destinationPrefix"`
+	QueryPolicy       QueryPolicy `json:"queryPolicy"`
+	ViewBag           ViewBag     `json:"viewBag"`  // merged with the global ViewBag
+	CertFile          string      `json:"certFile"` // certificate selected by SNI on the HTTPS redirect listener
+	KeyFile           string      `json:"keyFile"`
+}
+
+// HostConfigs maps host names to virtual host configuration. Host names may
+// start with a "*." wildcard label to match all subdomains of a domain.
+type HostConfigs map[string]*HostConfig
+
+var UnknownHostError = fmt.Errorf("No configuration found for host")
+
+// normalizeHost returns the lower-cased host name of a Host header, without
+// any port number.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Match returns the configuration for the given Host header or nil if no host
+// matches. Exact host names take precedence over wildcards and longer
+// wildcards take precedence over shorter wildcards.
+func (c HostConfigs) Match(host string) *HostConfig {
+	if len(c) == 0 {
+		return nil
+	}
+
+	host = normalizeHost(host)
+	if hc, ok := c[host]; ok {
+		return hc
+	}
+
+	for i := strings.Index(host, "."); i >= 0; {
+		if hc, ok := c["*"+host[i:]]; ok {
+			return hc
+		}
+
+		j := strings.Index(host[i+1:], ".")
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+
+	return nil
+}
+
+// initializeHosts validates and instanciates the configuration of all virtual
+// hosts.
+func (c *Config) initializeHosts() error {
+	hosts := make(HostConfigs, len(c.Hosts))
+	for name, hc := range c.Hosts {
+		if hc == nil {
+			hc = &HostConfig{}
+		}
+
+		hc.Name = strings.ToLower(name)
+		if hc.Name == "" || strings.Contains(hc.Name[1:], "*") || (hc.Name[0] == '*' && !strings.HasPrefix(hc.Name, "*.")) {
+			return fmt.Errorf("Invalid host name: %v", name)
+		}
+
+		if _, ok := hosts[hc.Name]; ok {
+			return fmt.Errorf("Duplicate host name: %v", name)
+		}
+
+		if hc.KeyBuilderName != "" {
+			kb, err := ParseKeyBuilder(hc.KeyBuilderName)
+			if err != nil {
+				return fmt.Errorf("Error in configuration of host %v: %v", name, err)
+			}
+			hc.KeyBuilder = kb
+		}
+
+		if c.Normalize.Enabled() {
+			if hc.KeyBuilder != nil {
+				hc.KeyBuilder = NormalizedKeyBuilder(hc.KeyBuilder, c.Normalize)
+			}
+			hc.DefaultKey = c.Normalize.Key(hc.DefaultKey)
+		}
+
+		if err := hc.QueryPolicy.Validate(); err != nil {
+			return fmt.Errorf("Error in configuration of host %v: %v", name, err)
+		}
+
+		hosts[hc.Name] = hc
+	}
+
+	c.Hosts = hosts
+	return nil
+}
+
+// ForHost returns the effective configuration for requests with the given Host
+// header, with any host overrides applied to the global configuration.
+func (c *Config) ForHost(host string) *HostConfig {
+	v := &HostConfig{
+		KeyBuilderName:    c.KeyBuilderName,
+		KeyBuilder:        c.KeyBuilder,
+		DefaultKey:        c.DefaultKey,
+		DestinationPrefix: c.DestinationPrefix,
+		QueryPolicy:       c.QueryPolicy,
+		ViewBag:           c.ViewBag,
+	}
+
+	hc := c.Hosts.Match(host)
+	if hc == nil {
+		return v
+	}
+
+	v.Name = hc.Name
+	if hc.KeyBuilder != nil {
+		v.KeyBuilderName = hc.KeyBuilderName
+		v.KeyBuilder = hc.KeyBuilder
+	}
+
+	if hc.DefaultKey != "" {
+		v.DefaultKey = hc.DefaultKey
+	}
+
+	if hc.DestinationPrefix != "" {
+		v.DestinationPrefix = hc.DestinationPrefix
+	}
+
+	if hc.QueryPolicy != QueryDefault {
+		v.QueryPolicy = hc.QueryPolicy
+	}
+
+	if len(hc.ViewBag) > 0 {
+		v.ViewBag = NewViewBag()
+		for k, val := range c.ViewBag {
+			v.ViewBag.Add(k, val)
+		}
+		for k, val := range hc.ViewBag {
+			v.ViewBag.Add(k, val)
+		}
+	}
+
+	return v
+}
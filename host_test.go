@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHostConfigs(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostConfigs{
+			"Example.com":           {DefaultKey: "exact"},
+			"*.example.com":         {DefaultKey: "wildcard"},
+			"*.cdn.example.com":     {DefaultKey: "longer"},
+			"param.example.org":     {KeyBuilderName: "param:id"},
+			"inherited.example.org": nil,
+		},
+	}
+	if err := cfg.initializeHosts(); err != nil {
+		panic(err)
+	}
+
+	tests := map[string]string{
+		"example.com":            "example.com",
+		"EXAMPLE.COM:8080":       "example.com",
+		"www.example.com":        "*.example.com",
+		"a.b.example.com":        "*.example.com",
+		"img.cdn.example.com":    "*.cdn.example.com",
+		"cdn.example.com":        "*.example.com",
+		"param.example.org":      "param.example.org",
+		"example.org":            "",
+		"notexample.com":         "",
+		"inherited.example.org.": "inherited.example.org",
+	}
+	for host, expect := range tests {
+		name := ""
+		if hc := cfg.Hosts.Match(host); hc != nil {
+			name = hc.Name
+		}
+
+		if name != expect {
+			t.Errorf("Expected host %v to match '%v', got '%v'", host, expect, name)
+		}
+	}
+
+	for _, name := range []string{"*", "*example.com", "www.*.example.com"} {
+		cfg := &Config{Hosts: HostConfigs{name: {}}}
+		if err := cfg.initializeHosts(); err == nil {
+			t.Errorf("Expected error for invalid host name %v", name)
+		}
+	}
+}
+
+func TestForHost(t *testing.T) {
+	cfg := &Config{
+		KeyBuilder:        RequestURIPathKeyBuilder(),
+		DefaultKey:        "default",
+		DestinationPrefix: "http://global.test",
+		QueryPolicy:       QueryDrop,
+		ViewBag:           ViewBag{"Foo": "global", "Bar": "global"},
+		Hosts: HostConfigs{
+			"example.com": {
+				DefaultKey:  "example",
+				QueryPolicy: QueryMerge,
+				ViewBag:     ViewBag{"Foo": "example"},
+			},
+		},
+	}
+	if err := cfg.initializeHosts(); err != nil {
+		panic(err)
+	}
+
+	hc := cfg.ForHost("unknown.test")
+	if hc.Name != "" || hc.DefaultKey != "default" || hc.QueryPolicy != QueryDrop {
+		t.Errorf("Expected global configuration for unknown host, got: %+v", hc)
+	}
+
+	hc = cfg.ForHost("example.com")
+	if hc.Name != "example.com" {
+		t.Errorf("Expected namespace 'example.com', got '%v'", hc.Name)
+	}
+
+	if hc.DefaultKey != "example" || hc.QueryPolicy != QueryMerge {
+		t.Errorf("Expected host overrides, got: %+v", hc)
+	}
+
+	if hc.DestinationPrefix != "http://global.test" || hc.KeyBuilder == nil {
+		t.Errorf("Expected inherited configuration, got: %+v", hc)
+	}
+
+	if hc.ViewBag["Foo"] != "example" || hc.ViewBag["Bar"] != "global" {
+		t.Errorf("Expected merged ViewBag, got: %v", hc.ViewBag)
+	}
+
+	if cfg.ViewBag["Foo"] != "global" {
+		t.Errorf("Expected global ViewBag to be unmodified, got: %v", cfg.ViewBag)
+	}
+}
@@ -31,8 +31,11 @@ func StatusCodeForError(err error) int {
 	case nil:
 		return 0
 
-	case MappingNotFoundError:
+	case MappingNotFoundError, RevisionNotFoundError:
 		return http.StatusNotFound
+
+	case RevisionMismatchError:
+		return http.StatusPreconditionFailed
 	}
 
 	if herr, ok := err.(*HTTPError); ok {
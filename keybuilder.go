@@ -3,9 +3,16 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
-var ParamNotFoundError = fmt.Errorf("Key parameter not found in request URI")
+var (
+	ParamNotFoundError   = fmt.Errorf("Key parameter not found in request URI")
+	HeaderNotFoundError  = fmt.Errorf("Key header not found in request")
+	CookieNotFoundError  = fmt.Errorf("Key cookie not found in request")
+	SegmentNotFoundError = fmt.Errorf("Key segment not found in request URI path")
+)
 
 // A KeyBuilder translates a client HTTP request into a URL mapping key that may
 // be used to lookup the destination URL of a redirect mapping.
@@ -23,6 +30,179 @@ func (f KeyBuilderFunc) Parse(r *http.Request) (string, error) {
 	return f(r)
 }
 
+// A MultiKeyBuilder is a KeyBuilder that may translate a client HTTP request
+// into multiple candidate mapping keys, in order of preference.
+type MultiKeyBuilder interface {
+	KeyBuilder
+	ParseAll(r *http.Request) ([]string, error)
+}
+
+// parseKeys returns all candidate mapping keys for the given request.
+func parseKeys(kb KeyBuilder, r *http.Request) ([]string, error) {
+	if mkb, ok := kb.(MultiKeyBuilder); ok {
+		return mkb.ParseAll(r)
+	}
+
+	key, err := kb.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{key}, nil
+}
+
+// ParseKeyBuilder returns the KeyBuilder for the given name. Supported names
+// are "path" (the default), "uri", "host", "param:NAME", "header:NAME",
+// "cookie:NAME" and "segment:N".
+//
+// Names may be combined with "+" to join the keys of multiple KeyBuilders
+// (e.g. "host+path") and chained with "," to try multiple KeyBuilders in order
+// (e.g. "param:id,path").
+func ParseKeyBuilder(name string) (KeyBuilder, error) {
+	if !strings.Contains(name, ",") {
+		return parseCombinedKeyBuilder(name)
+	}
+
+	chain := make(KeyBuilderChain, 0)
+	for _, s := range strings.Split(name, ",") {
+		kb, err := parseCombinedKeyBuilder(s)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, kb)
+	}
+
+	return chain, nil
+}
+
+// parseCombinedKeyBuilder parses a KeyBuilder name that may combine multiple
+// KeyBuilders with "+".
+func parseCombinedKeyBuilder(name string) (KeyBuilder, error) {
+	if !strings.Contains(name, "+") {
+		return parseSingleKeyBuilder(name)
+	}
+
+	builders := make([]KeyBuilder, 0)
+	for _, s := range strings.Split(name, "+") {
+		kb, err := parseSingleKeyBuilder(s)
+		if err != nil {
+			return nil, err
+		}
+		builders = append(builders, kb)
+	}
+
+	return CombinedKeyBuilder(builders...), nil
+}
+
+// parseSingleKeyBuilder parses the name of a single KeyBuilder.
+func parseSingleKeyBuilder(name string) (KeyBuilder, error) {
+	switch name {
+	case "", "path":
+		return RequestURIPathKeyBuilder(), nil
+
+	case "uri":
+		return RequestURIKeyBuilder(), nil
+
+	case "host":
+		return RequestHostKeyBuilder(), nil
+	}
+
+	i := strings.Index(name, ":")
+	if i < 0 || i == len(name)-1 {
+		return nil, fmt.Errorf("Unknown key builder: %v", name)
+	}
+
+	arg := name[i+1:]
+	switch name[:i] {
+	case "param":
+		return RequestParamKeyBuilder(arg), nil
+
+	case "header":
+		return RequestHeaderKeyBuilder(arg), nil
+
+	case "cookie":
+		return RequestCookieKeyBuilder(arg), nil
+
+	case "segment":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid path segment in key builder: %v", name)
+		}
+		return RequestPathSegmentKeyBuilder(n), nil
+	}
+
+	return nil, fmt.Errorf("Unknown key builder: %v", name)
+}
+
+// KeyBuilderChain is a MultiKeyBuilder that returns the keys of each of its
+// KeyBuilders that succeeds, in order. Parse returns only the first key.
+type KeyBuilderChain []KeyBuilder
+
+// Parse returns the key of the first KeyBuilder in the chain that succeeds.
+func (c KeyBuilderChain) Parse(r *http.Request) (string, error) {
+	keys, err := c.ParseAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return keys[0], nil
+}
+
+// ParseAll returns the distinct keys of all KeyBuilders in the chain that
+// succeed. If no KeyBuilder succeeds, the last error is returned. Server errors
+// are returned immediately.
+func (c KeyBuilderChain) ParseAll(r *http.Request) ([]string, error) {
+	keys := make([]string, 0, len(c))
+	var lastErr error
+	for _, kb := range c {
+		key, err := kb.Parse(r)
+		if err != nil {
+			if StatusCodeForError(err) >= 500 {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		dup := false
+		for _, k := range keys {
+			if k == key {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		if lastErr == nil {
+			lastErr = NewHTTPError(http.StatusNotFound, MappingNotFoundError)
+		}
+		return nil, lastErr
+	}
+
+	return keys, nil
+}
+
+// CombinedKeyBuilder returns a KeyBuilder that joins the keys of all of the
+// given KeyBuilders. It fails if any of the given KeyBuilders fails.
+func CombinedKeyBuilder(builders ...KeyBuilder) KeyBuilder {
+	return KeyBuilderFunc(func(r *http.Request) (string, error) {
+		key := ""
+		for _, kb := range builders {
+			s, err := kb.Parse(r)
+			if err != nil {
+				return "", err
+			}
+			key += s
+		}
+
+		return key, nil
+	})
+}
+
 // RequestURIKeyBuilder returns a KeyBuilder that uses the full request URI as
 // a mapping key.
 func RequestURIKeyBuilder() KeyBuilder {
@@ -67,3 +247,51 @@ func RequestParamKeyBuilder(param string) KeyBuilder {
 		return key, nil
 	})
 }
+
+// RequestHostKeyBuilder returns a KeyBuilder that uses the lower-cased request
+// host name, without any port number, as a mapping key.
+func RequestHostKeyBuilder() KeyBuilder {
+	return KeyBuilderFunc(func(r *http.Request) (string, error) {
+		return normalizeHost(r.Host), nil
+	})
+}
+
+// RequestHeaderKeyBuilder returns a KeyBuilder that uses a given request header
+// (e.g. "X-Key: some_key") as a mapping key.
+func RequestHeaderKeyBuilder(name string) KeyBuilder {
+	return KeyBuilderFunc(func(r *http.Request) (string, error) {
+		key := r.Header.Get(name)
+		if key == "" {
+			return "", NewHTTPError(http.StatusNotFound, HeaderNotFoundError)
+		}
+
+		return key, nil
+	})
+}
+
+// RequestCookieKeyBuilder returns a KeyBuilder that uses the value of a given
+// request cookie as a mapping key.
+func RequestCookieKeyBuilder(name string) KeyBuilder {
+	return KeyBuilderFunc(func(r *http.Request) (string, error) {
+		c, err := r.Cookie(name)
+		if err != nil || c.Value == "" {
+			return "", NewHTTPError(http.StatusNotFound, CookieNotFoundError)
+		}
+
+		return c.Value, nil
+	})
+}
+
+// RequestPathSegmentKeyBuilder returns a KeyBuilder that uses the nth segment
+// of the request URI path as a mapping key, counting from one. For example,
+// segment 2 of "/some/path/here" is "path".
+func RequestPathSegmentKeyBuilder(n int) KeyBuilder {
+	return KeyBuilderFunc(func(r *http.Request) (string, error) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n > len(segments) || segments[n-1] == "" {
+			return "", NewHTTPError(http.StatusNotFound, SegmentNotFoundError)
+		}
+
+		return segments[n-1], nil
+	})
+}
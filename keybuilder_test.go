@@ -9,6 +9,7 @@ import (
 func TestPathKeyBuilder(t *testing.T) {
 	expect := "/test/path/"
 	c := &Config{
+		DatabaseDriver: "bolt",
 		KeyBuilderName: "path",
 	}
 
@@ -66,6 +67,7 @@ func TestURIKeyBuilder(t *testing.T) {
 func TestParamKeyBuilderConfig(t *testing.T) {
 	expect := "/test"
 	c := &Config{
+		DatabaseDriver: "bolt",
 		KeyBuilderName: "param:key",
 	}
 
@@ -132,3 +134,59 @@ func TestMissingParamKeyBuilder(t *testing.T) {
 		t.Fatalf("Expected empty key, got '%v'", key)
 	}
 }
+
+func TestRequestKeyBuilders(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://www.keys.test:8080/some/path/here?id=123", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("X-Key", "header-key")
+	r.AddCookie(&http.Cookie{Name: "key", Value: "cookie-key"})
+
+	tests := map[string][]string{
+		"host":                  {"www.keys.test"},
+		"header:X-Key":          {"header-key"},
+		"cookie:key":            {"cookie-key"},
+		"segment:2":             {"path"},
+		"host+path":             {"www.keys.test/some/path/here"},
+		"param:id,path":         {"123", "/some/path/here"},
+		"param:missing,path":    {"/some/path/here"},
+		"segment:9,segment:1":   {"some"},
+		"path,segment:1,path":   {"/some/path/here", "some"},
+		"header:X-Key+param:id": {"header-key123"},
+	}
+	for name, expect := range tests {
+		kb, err := ParseKeyBuilder(name)
+		if err != nil {
+			t.Errorf("Error parsing key builder %v: %v", name, err)
+			continue
+		}
+
+		keys, err := parseKeys(kb, r)
+		if err != nil {
+			t.Errorf("Error parsing keys with %v: %v", name, err)
+			continue
+		}
+
+		if fmt.Sprintf("%q", keys) != fmt.Sprintf("%q", expect) {
+			t.Errorf("Expected %v to return keys %q, got %q", name, expect, keys)
+		}
+	}
+
+	for _, name := range []string{"header:X-Missing", "cookie:missing", "segment:4", "param:missing,header:X-Missing", "host+param:missing"} {
+		kb, err := ParseKeyBuilder(name)
+		if err != nil {
+			panic(err)
+		}
+
+		if keys, err := parseKeys(kb, r); StatusCodeForError(err) != http.StatusNotFound {
+			t.Errorf("Expected Not Found error for %v, got %q, %v", name, keys, err)
+		}
+	}
+
+	for _, name := range []string{"nope", "segment:0", "segment:x", "header:", "path,nope", "host+nope"} {
+		if _, err := ParseKeyBuilder(name); err == nil {
+			t.Errorf("Expected error parsing key builder %v", name)
+		}
+	}
+}
@@ -1,20 +1,264 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func NewLogger(path string) (*log.Logger, error) {
-	out := os.Stdout
-	if path != "-" {
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0640)
-		if err != nil {
-			return nil, err
+// LogLevel is the severity of an application log entry.
+type LogLevel int32
+
+const (
+	DebugLevel LogLevel = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var (
+	UnknownLogLevelError  = fmt.Errorf("Unknown log level")
+	UnknownLogFormatError = fmt.Errorf("Unknown log format")
+)
+
+func (l LogLevel) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the LogLevel of the given name.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+
+	return InfoLevel, fmt.Errorf("%v: %v", UnknownLogLevelError, s)
+}
+
+func (l LogLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *LogLevel) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := ParseLogLevel(s)
+	if err != nil {
+		return err
+	}
+
+	*l = v
+	return nil
+}
+
+// LogFormat selects the encoding of application log entries.
+type LogFormat string
+
+const (
+	TextLog LogFormat = "text" // the default
+	JSONLog LogFormat = "json" // one JSON object per line
+)
+
+// Validate returns UnknownLogFormatError if the format is not supported.
+func (f LogFormat) Validate() error {
+	switch f {
+	case "", TextLog, JSONLog:
+		return nil
+	}
+
+	return fmt.Errorf("%v: %v", UnknownLogFormatError, f)
+}
+
+// Fields are the structured values of a log entry, keyed by name.
+type Fields map[string]interface{}
+
+// logOutput is the destination of a Logger and all loggers derived from it.
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+}
+
+// A Logger writes leveled application log entries with structured fields.
+// Entries are written as text lines or as JSON objects.
+type Logger struct {
+	out    *logOutput
+	format LogFormat
+	fields Fields
+}
+
+// openLog returns the log file at the given path, or stdout if the path is
+// "-".
+func openLog(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0640)
+}
+
+// NewLogger returns a Logger that writes entries of at least the given level to
+// the file at path, or to stdout if the path is "-".
+func NewLogger(path string, format LogFormat, level LogLevel) (*Logger, error) {
+	w, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLogger(w, format, level), nil
+}
+
+func newLogger(w io.Writer, format LogFormat, level LogLevel) *Logger {
+	return &Logger{
+		out:    &logOutput{w: w, level: int32(level)},
+		format: format,
+	}
+}
+
+// Level returns the minimum level of entries that are written.
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.out.level))
+}
+
+// SetLevel changes the minimum level of entries that are written by the logger
+// and all loggers derived from it.
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// With returns a Logger that adds the given fields to every entry.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &Logger{out: l.out, format: l.format, fields: merged}
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) { l.log(DebugLevel, format, a...) }
+func (l *Logger) Infof(format string, a ...interface{})  { l.log(InfoLevel, format, a...) }
+func (l *Logger) Warnf(format string, a ...interface{})  { l.log(WarnLevel, format, a...) }
+func (l *Logger) Errorf(format string, a ...interface{}) { l.log(ErrorLevel, format, a...) }
+
+// StdLogger returns a log.Logger that writes each line at the given level, for
+// packages that log with the standard library, such as net/http.
+func (l *Logger) StdLogger(level LogLevel) *log.Logger {
+	return log.New(&stdLogWriter{l, level}, "", 0)
+}
+
+type stdLogWriter struct {
+	Logger *Logger
+	Level  LogLevel
+}
+
+func (w *stdLogWriter) Write(b []byte) (int, error) {
+	w.Logger.log(w.Level, "%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func (l *Logger) log(level LogLevel, format string, a ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+
+	now := time.Now()
+	msg := fmt.Sprintf(format, a...)
+
+	b := &bytes.Buffer{}
+	if l.format == JSONLog {
+		l.writeJSON(b, now, level, msg)
+	} else {
+		l.writeText(b, now, level, msg)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+// fieldValue returns a value that encodes usefully as text or JSON.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+func (l *Logger) fieldNames() []string {
+	names := make([]string, 0, len(l.fields))
+	for name := range l.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeText writes an entry as a line with the same timestamp as the standard
+// library logger, followed by name=value pairs. Multi-line values, such as
+// stack traces, follow on indented lines.
+func (l *Logger) writeText(b *bytes.Buffer, now time.Time, level LogLevel, msg string) {
+	fmt.Fprintf(b, "%s %s %s", now.Format("2006/01/02 15:04:05.000000"), strings.ToUpper(level.String()), msg)
+
+	var multiline []string
+	for _, name := range l.fieldNames() {
+		s := fmt.Sprintf("%v", fieldValue(l.fields[name]))
+		if strings.Contains(s, "\n") {
+			multiline = append(multiline, name+":\n\t"+strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n\t", -1))
+			continue
+		}
+
+		if s == "" || strings.ContainsAny(s, " \t\"=") {
+			s = fmt.Sprintf("%q", s)
 		}
+		fmt.Fprintf(b, " %s=%s", name, s)
+	}
+	b.WriteString("\n")
 
-		out = f
+	for _, s := range multiline {
+		b.WriteString(s)
+		b.WriteString("\n")
 	}
+}
 
-	return log.New(out, "", log.Ldate|log.Ltime|log.Lmicroseconds), nil
+// writeJSON writes an entry as a JSON object on a single line.
+func (l *Logger) writeJSON(b *bytes.Buffer, now time.Time, level LogLevel, msg string) {
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for name, v := range l.fields {
+		entry[name] = fieldValue(v)
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		fmt.Fprintf(b, `{"time":%q,"level":"error","msg":%q}`+"\n", now.Format(time.RFC3339Nano), "Error encoding log entry: "+err.Error())
+	}
 }
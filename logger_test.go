@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	b := &bytes.Buffer{}
+	logger := newLogger(b, TextLog, WarnLevel)
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log entries at warn level, got %v:\n%v", len(lines), b.String())
+	}
+	for i, suffix := range []string{" WARN warn", " ERROR error"} {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Errorf("Expected log entry ending with %q, got %q", suffix, lines[i])
+		}
+	}
+
+	// derived loggers share the level
+	b.Reset()
+	derived := logger.With(Fields{"a": 1})
+	logger.SetLevel(DebugLevel)
+	derived.Debugf("debug")
+	if !strings.Contains(b.String(), " DEBUG debug a=1\n") {
+		t.Errorf("Expected debug entry from derived logger, got %q", b.String())
+	}
+
+	for _, s := range []string{"debug", "INFO", "Warn", "error"} {
+		if _, err := ParseLogLevel(s); err != nil {
+			t.Errorf("Error parsing log level %v: %v", s, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("Expected error parsing unknown log level")
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	b := &bytes.Buffer{}
+	newLogger(b, TextLog, InfoLevel).With(Fields{
+		"key":   "/a b",
+		"err":   fmt.Errorf("failed"),
+		"stack": "line 1\nline 2\n",
+	}).Infof("Hello %v", "world")
+
+	s := b.String()
+	expect := " INFO Hello world err=failed key=\"/a b\"\nstack:\n\tline 1\n\tline 2\n"
+	if !strings.HasSuffix(s, expect) {
+		t.Errorf("Expected log entry ending with %q, got %q", expect, s)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	b := &bytes.Buffer{}
+	newLogger(b, JSONLog, InfoLevel).With(Fields{"key": "/a", "status": 404}).Warnf("Hello %v", "world")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("Error decoding log entry %q: %v", b.String(), err)
+	}
+
+	for name, v := range map[string]interface{}{
+		"level":  "warn",
+		"msg":    "Hello world",
+		"key":    "/a",
+		"status": float64(404),
+	} {
+		if entry[name] != v {
+			t.Errorf("Expected %v to be %v, got %v", name, v, entry[name])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("Expected time in log entry, got %v", b.String())
+	}
+}
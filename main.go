@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/urfave/cli.v1"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
+	"strings"
 	"text/tabwriter"
+	"time"
 )
 
 const (
@@ -18,6 +24,16 @@ func main() {
 	app.Name = PACKAGE_NAME
 	app.Version = PACKAGE_VERSION
 	app.Usage = "Simple HTTP server to map old URLs to new URLs"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "host",
+			Usage: "manage the mappings of the given virtual host",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "management API token (default: $" + TokenEnv + " or mgmtToken in the config file)",
+		},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "serve",
@@ -28,17 +44,18 @@ func main() {
 			Name:   "ls",
 			Usage:  "list all mappings",
 			Action: ListMappingsAction,
+			Flags:  listMappingsFlags,
 		},
 		{
 			Name:   "export",
 			Usage:  "export all mappings to a JSON document",
 			Action: ExportMappingsAction,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "pretty,p",
 					Usage: "print JSON with human-readable whitespace",
 				},
-			},
+			}, listMappingsFlags...),
 		},
 		{
 			Name:   "import",
@@ -57,6 +74,10 @@ func main() {
 					Name:  "comment,c",
 					Usage: "Overwrite the comment for all imported mappings",
 				},
+				cli.BoolFlag{
+					Name:  "create-only",
+					Usage: "fail without importing if any mapping already exists",
+				},
 			},
 		},
 		{
@@ -74,7 +95,63 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "permanent,p",
-					Usage: "Redirect is permanent (301)",
+					Usage: "Redirect is permanent (308)",
+				},
+				cli.IntFlag{
+					Name:  "status,s",
+					Usage: "HTTP status code (301, 302, 303, 307, 308 or 410)",
+				},
+				cli.BoolFlag{
+					Name:  "prefix",
+					Usage: "match all keys that start with the given key",
+				},
+				cli.BoolFlag{
+					Name:  "regexp",
+					Usage: "match all keys against the given key as a regular expression",
+				},
+				cli.IntFlag{
+					Name:  "priority",
+					Usage: "evaluation order of regular expression mappings",
+				},
+				cli.StringFlag{
+					Name:  "query,q",
+					Usage: "request query string policy (drop, append, merge or override)",
+				},
+				cli.StringFlag{
+					Name:  "not-before",
+					Usage: "time the mapping becomes active (RFC 3339)",
+				},
+				cli.StringFlag{
+					Name:  "not-after",
+					Usage: "time the mapping expires (RFC 3339)",
+				},
+				cli.StringFlag{
+					Name:  "comment,c",
+					Usage: "Description of this redirection",
+				},
+			},
+		},
+		{
+			Name:   "misses",
+			Usage:  "list the most requested keys with no mapping",
+			Action: ListMissesAction,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "limit,n",
+					Usage: "maximum number of keys to list",
+					Value: 20,
+				},
+				cli.StringFlag{
+					Name:  "map,m",
+					Usage: "add a mapping for the given missing key instead of listing",
+				},
+				cli.StringFlag{
+					Name:  "dest,d",
+					Usage: "URL to redirect the missing key to",
+				},
+				cli.IntFlag{
+					Name:  "status,s",
+					Usage: "HTTP status code (301, 302, 303, 307, 308 or 410)",
 				},
 				cli.StringFlag{
 					Name:  "comment,c",
@@ -97,70 +174,287 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "get",
+			Usage:  "print a mapping as JSON",
+			Action: GetMappingAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key,k",
+					Usage: "key that identifies this redirect",
+				},
+			},
+		},
+		{
+			Name:   "edit",
+			Usage:  "edit a mapping in $EDITOR",
+			Action: EditMappingAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key,k",
+					Usage: "key that identifies this redirect",
+				},
+			},
+		},
+		{
+			Name:   "history",
+			Usage:  "list the changes made to a mapping",
+			Action: HistoryAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key,k",
+					Usage: "key that identifies this redirect",
+				},
+			},
+		},
+		{
+			Name:   "rollback",
+			Usage:  "restore a mapping revision, or all mappings to a point in time",
+			Action: RollbackAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key,k",
+					Usage: "key that identifies this redirect",
+				},
+				cli.Int64Flag{
+					Name:  "to",
+					Usage: "revision of the mapping to restore",
+					Value: -1,
+				},
+				cli.StringFlag{
+					Name:  "before",
+					Usage: "restore all mappings changed since the given time (RFC 3339)",
+				},
+			},
+		},
+		{
+			Name:   "reload",
+			Usage:  "reload the configuration file of the server",
+			Action: ReloadConfigAction,
+		},
+		{
+			Name:   "token",
+			Usage:  "generate a management API token",
+			Action: NewTokenAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name,n",
+					Usage: "name of the token, recorded in the history of changed mappings",
+				},
+				cli.StringFlag{
+					Name:  "role,r",
+					Usage: "read or write",
+					Value: ReadRole,
+				},
+				cli.StringSliceFlag{
+					Name:  "prefix",
+					Usage: "limit the token to mapping keys with the given prefix (may be repeated)",
+				},
+			},
+		},
+		{
+			Name:   "rekey",
+			Usage:  "normalize the keys of all mappings in a stopped bolt database",
+			Action: RekeyMappingsAction,
+		},
+		{
+			Name:   "migrate",
+			Usage:  "rewrite legacy database records in the current record format",
+			Action: MigrateRecordsAction,
+		},
+		{
+			Name:   "version",
+			Usage:  "print the version and compiled-in database drivers",
+			Action: VersionAction,
+		},
 	}
 
 	app.Run(os.Args)
 }
 
 func ServeAction(c *cli.Context) error {
-	rt, err := NewRuntime()
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	restarted := isRestarted()
+	rt, err := newRuntime(cfg)
 	if err != nil {
 		return err
 	}
 
 	defer rt.Close()
 
-	go func() {
-		serveManager(rt)
-	}()
+	g, err := NewServerGroup(rt)
+	if err != nil {
+		return err
+	}
 
-	return serve(rt)
-}
+	if err := serveManager(rt, g); err != nil {
+		return err
+	}
 
-func ListMappingsAction(c *cli.Context) error {
-	cfg, err := GetConfig()
-	if err != nil {
+	if cfg.UpgradeAddr != "" {
+		if err := serveUpgrade(rt, g); err != nil {
+			return err
+		}
+	}
+
+	if err := serve(rt, g); err != nil {
 		return err
 	}
 
-	client := NewManagementClient(cfg)
-	mappings, err := client.GetMappings()
-	if err != nil {
+	// a restarted server takes over from its parent once it is ready to serve.
+	// Requests are queued on the inherited listeners until then. A bolt
+	// database cannot be opened until the parent closes it, so it is checked
+	// before the parent is stopped and opened after the parent has exited.
+	if restarted && cfg.DatabaseDriver == "bolt" {
+		if err := checkBoltDatabase(cfg); err != nil {
+			return err
+		}
+
+		if err := notifyParent(); err != nil {
+			return fmt.Errorf("Error stopping parent process: %v", err)
+		}
+
+		waitForParent()
+	}
+
+	if err := rt.OpenDatabase(); err != nil {
 		return err
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 1, 3, ' ', 0)
-	fmt.Fprintln(w, "KEY\tDESTINATION\tPERMANENT\tCOMMENT")
-	for _, m := range mappings {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Key, m.Destination, m.Permanent, m.Comment)
+	if restarted && cfg.DatabaseDriver != "bolt" {
+		if err := notifyParent(); err != nil {
+			return fmt.Errorf("Error stopping parent process: %v", err)
+		}
 	}
-	w.Flush()
 
-	return nil
+	go g.handleSignals()
+	return g.Serve()
 }
 
-func ExportMappingsAction(c *cli.Context) error {
+// newManagementClient returns a management client for the virtual host and
+// token given on the command line.
+func newManagementClient(c *cli.Context, cfg *Config) *ManagementClient {
+	client := NewManagementClient(cfg)
+	client.Host = c.GlobalString("host")
+	if s := c.GlobalString("token"); s != "" {
+		client.Token = s
+	}
+
+	return client
+}
+
+// listMappingsFlags filter the mappings listed by the ls and export commands.
+var listMappingsFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "prefix",
+		Usage: "only list mappings with keys that start with the given prefix",
+	},
+	cli.StringFlag{
+		Name:  "search,s",
+		Usage: "only list mappings with the given text in the destination or comment",
+	},
+}
+
+// listOptions returns the mapping filters given on the command line.
+func listOptions(c *cli.Context) ListOptions {
+	return ListOptions{
+		Prefix: c.String("prefix"),
+		Search: c.String("search"),
+	}
+}
+
+func ListMappingsAction(c *cli.Context) error {
 	cfg, err := GetConfig()
 	if err != nil {
 		return err
 	}
 
-	client := NewManagementClient(cfg)
-	mappings, err := client.GetMappings()
+	client := newManagementClient(c, cfg)
+
+	// columns are aligned within each page
+	w := tabwriter.NewWriter(os.Stdout, 0, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tDESTINATION\tSTATUS\tHITS\tLAST HIT\tCOMMENT")
+	return client.GetMappings(listOptions(c), func(mappings []Mapping) error {
+		// only fetch the hits of the mappings in this page
+		hitsByKey := make(map[string]MappingHits, len(mappings))
+		if len(mappings) > 0 {
+			keys := make([]string, len(mappings))
+			for i, m := range mappings {
+				keys[i] = m.Key
+			}
+
+			hits, err := client.GetHits(keys...)
+			if err != nil {
+				return err
+			}
+
+			for _, h := range hits {
+				hitsByKey[h.Key] = h
+			}
+		}
+
+		for _, m := range mappings {
+			lastHit := "-"
+			h := hitsByKey[m.Key]
+			if h.Count > 0 {
+				lastHit = h.LastHit.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", m.Key, m.Type, m.Destination, m.StatusCode(), h.Count, lastHit, m.Comment)
+		}
+
+		return w.Flush()
+	})
+}
+
+func ExportMappingsAction(c *cli.Context) error {
+	cfg, err := GetConfig()
 	if err != nil {
 		return err
 	}
 
-	enc := json.NewEncoder(os.Stdout)
+	client := newManagementClient(c, cfg)
+
+	// write the JSON array one mapping at a time
+	sep, end := "[", "[]\n"
 	if c.Bool("pretty") {
-		enc.SetIndent("", "  ")
+		sep = "[\n  "
 	}
 
-	if err := enc.Encode(mappings); err != nil {
+	if err := client.GetMappings(listOptions(c), func(mappings []Mapping) error {
+		for _, m := range mappings {
+			var b []byte
+			var err error
+			if c.Bool("pretty") {
+				b, err = json.MarshalIndent(m, "  ", "  ")
+			} else {
+				b, err = json.Marshal(m)
+			}
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(os.Stdout, "%s%s", sep, b); err != nil {
+				return err
+			}
+
+			sep, end = ",", "]\n"
+			if c.Bool("pretty") {
+				sep, end = ",\n  ", "\n]\n"
+			}
+		}
+
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	return nil
+	_, err = fmt.Fprint(os.Stdout, end)
+	return err
 }
 
 func ImportMappingsAction(c *cli.Context) error {
@@ -198,7 +492,7 @@ func ImportMappingsAction(c *cli.Context) error {
 
 	for i, m := range mappings {
 		if err := m.Validate(); err != nil {
-			return fmt.Errorf("Validation error in mapping %v (key: %v): %v\n%v", i+1, m.Key, err)
+			return fmt.Errorf("Validation error in mapping %v (key: %v): %v", i+1, m.Key, err)
 		}
 	}
 
@@ -207,7 +501,7 @@ func ImportMappingsAction(c *cli.Context) error {
 		return err
 	}
 
-	client := NewManagementClient(cfg)
+	client := newManagementClient(c, cfg)
 	if c.Bool("clear") {
 		if err := client.RemoveAllMappings(); err != nil {
 			return fmt.Errorf("Error removing existing mappings: %v", err)
@@ -215,7 +509,12 @@ func ImportMappingsAction(c *cli.Context) error {
 		// TODO: 404s will occur here until mappings are reimported
 	}
 
-	if err := client.AddMappings(mappings); err != nil {
+	add := client.AddMappings
+	if c.Bool("create-only") {
+		add = client.CreateMappings
+	}
+
+	if err := add(mappings); err != nil {
 		return fmt.Errorf("Error adding mappings: %v", err)
 	}
 
@@ -227,24 +526,59 @@ func AddMappingAction(c *cli.Context) error {
 	m := &Mapping{
 		Key:         c.String("key"),
 		Destination: c.String("dest"),
-		Permanent:   c.Bool("permenant"),
+		Permanent:   c.Bool("permanent"),
+		Status:      c.Int("status"),
 		Comment:     c.String("comment"),
+		Priority:    c.Int("priority"),
+		Query:       QueryPolicy(c.String("query")),
+	}
+
+	if c.Bool("prefix") && c.Bool("regexp") {
+		return fmt.Errorf("Only one of --prefix or --regexp may be specified")
+	}
+
+	if c.Bool("prefix") {
+		m.Type = PrefixMapping
+	}
+
+	if c.Bool("regexp") {
+		m.Type = RegexpMapping
+	}
+
+	if s := c.String("not-before"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("Invalid time for --not-before: %v", err)
+		}
+		m.NotBefore = &t
+	}
+
+	if s := c.String("not-after"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("Invalid time for --not-after: %v", err)
+		}
+		m.NotAfter = &t
 	}
 
 	if m.Key == "" {
 		return fmt.Errorf("Key not specified")
 	}
 
-	if m.Destination == "" {
+	if m.Destination == "" && m.Status != http.StatusGone {
 		return fmt.Errorf("Destination URL not specified")
 	}
 
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
 	cfg, err := GetConfig()
 	if err != nil {
 		return err
 	}
 
-	client := NewManagementClient(cfg)
+	client := newManagementClient(c, cfg)
 	if err := client.AddMapping(m); err != nil {
 		return err
 	}
@@ -253,13 +587,57 @@ func AddMappingAction(c *cli.Context) error {
 	return nil
 }
 
+func ListMissesAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	client := newManagementClient(c, cfg)
+
+	// map a missing key
+	if key := c.String("map"); key != "" {
+		m := &Mapping{
+			Key:         key,
+			Destination: c.String("dest"),
+			Status:      c.Int("status"),
+			Comment:     c.String("comment"),
+		}
+
+		if err := m.Validate(); err != nil {
+			return err
+		}
+
+		if err := client.AddMapping(m); err != nil {
+			return err
+		}
+
+		fmt.Printf("Added %v\n", m)
+		return nil
+	}
+
+	misses, err := client.GetMisses(c.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCOUNT\tLAST SEEN\tREFERER")
+	for _, m := range misses {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Key, m.Count, m.LastSeen.Format(time.RFC3339), loggable(m.Referer))
+	}
+	w.Flush()
+
+	return nil
+}
+
 func RemoveMappingAction(c *cli.Context) error {
 	cfg, err := GetConfig()
 	if err != nil {
 		return err
 	}
 
-	client := NewManagementClient(cfg)
+	client := newManagementClient(c, cfg)
 
 	if c.Bool("all") {
 		if err := client.RemoveAllMappings(); err != nil {
@@ -286,3 +664,308 @@ func RemoveMappingAction(c *cli.Context) error {
 
 	return nil
 }
+
+func GetMappingAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	client := newManagementClient(c, cfg)
+
+	key := c.String("key")
+	if key == "" {
+		return fmt.Errorf("Key not specified")
+	}
+
+	m, err := client.GetMapping(key)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+func EditMappingAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	client := newManagementClient(c, cfg)
+
+	key := c.String("key")
+	if key == "" {
+		return fmt.Errorf("Key not specified")
+	}
+
+	m, err := client.GetMapping(key)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "redirector_edit_*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// $EDITOR may include arguments
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error running editor: %v", err)
+	}
+
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(bytes.TrimSpace(edited), b) {
+		fmt.Printf("No changes to %v\n", key)
+		return nil
+	}
+
+	v := &Mapping{}
+	if err := json.Unmarshal(edited, v); err != nil {
+		return fmt.Errorf("Invalid mapping JSON: %v", err)
+	}
+
+	if v.Key == "" {
+		v.Key = key
+	}
+
+	// fail if the mapping was changed by someone else while editing
+	if err := client.PutMapping(key, v, m.Revision); err == RevisionMismatchError {
+		return fmt.Errorf("Mapping %v was modified while editing; changes were not saved", key)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated %v\n", v.Key)
+	return nil
+}
+
+func HistoryAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	client := newManagementClient(c, cfg)
+
+	key := c.String("key")
+	if key == "" {
+		return fmt.Errorf("Key not specified")
+	}
+
+	history, err := client.GetHistory(key)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tREVISION\tACTOR\tDESTINATION")
+	for _, change := range history {
+		rev, dest := "-", "-"
+		if m := change.Mapping; m != nil {
+			rev, dest = fmt.Sprintf("%d", m.Revision), m.Destination
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", change.Time.Format(time.RFC3339), change.Action, rev, change.Actor, dest)
+	}
+
+	return w.Flush()
+}
+
+func RollbackAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	client := newManagementClient(c, cfg)
+
+	var changes []MappingChange
+	if s := c.String("before"); s != "" {
+		if c.String("key") != "" {
+			return fmt.Errorf("Only one of --key or --before may be specified")
+		}
+
+		before, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("Invalid time for --before: %v", err)
+		}
+
+		changes, err = client.RollbackMappings(before)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := c.String("key")
+		if key == "" {
+			return fmt.Errorf("Key or --before not specified")
+		}
+
+		rev := c.Int64("to")
+		if rev < 0 {
+			return fmt.Errorf("Revision not specified")
+		}
+
+		changes, err = client.RollbackMapping(key, rev)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		if change.Mapping == nil {
+			fmt.Printf("Removed %v\n", change.Key)
+		} else {
+			fmt.Printf("Restored %v\n", change.Mapping)
+		}
+	}
+
+	fmt.Printf("Rolled back %v mappings\n", len(changes))
+	return nil
+}
+
+// ReloadConfigAction asks the running server to reload its configuration file
+// and prints the settings that changed.
+func ReloadConfigAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	changes, err := newManagementClient(c, cfg).ReloadConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		fmt.Printf("%v\n", &change)
+	}
+
+	fmt.Printf("Reloaded configuration: %v settings changed\n", len(changes))
+	return nil
+}
+
+// NewTokenAction prints a new management API token and the configuration entry
+// that grants it. Only the hash of the token is stored in the configuration.
+func NewTokenAction(c *cli.Context) error {
+	t := &APIToken{
+		Name:     c.String("name"),
+		Role:     c.String("role"),
+		Prefixes: c.StringSlice("prefix"),
+	}
+
+	secret, err := NewToken()
+	if err != nil {
+		return err
+	}
+	t.Hash = Secret(HashToken(secret))
+
+	if err := (APITokens{t}).Validate(); err != nil {
+		return err
+	}
+
+	// print the hash, which is otherwise redacted in JSON
+	b, err := json.MarshalIndent(struct {
+		Name     string   `json:"name"`
+		Hash     string   `json:"sha256"`
+		Role     string   `json:"role"`
+		Prefixes []string `json:"prefixes,omitempty"`
+	}{t.Name, string(t.Hash), t.Role, t.Prefixes}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Token: %v\n\nAdd to mgmtTokens in the server configuration:\n%s\n", secret, b)
+	return nil
+}
+
+func RekeyMappingsAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	if cfg.DatabaseDriver != "bolt" {
+		return fmt.Errorf("Rekey is only supported for bolt databases")
+	}
+
+	db, err := OpenBoltDatabase(cfg)
+	if err != nil {
+		return fmt.Errorf("Error opening database (is the server running?): %v", err)
+	}
+	defer db.Close()
+
+	n, conflicts, err := db.(*BoltDatabase).RekeyMappings()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range conflicts {
+		fmt.Printf("Not renamed (normalized key already exists): %v\n", key)
+	}
+
+	fmt.Printf("Renamed %v mappings\n", n)
+	return nil
+}
+
+func MigrateRecordsAction(c *cli.Context) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenDatabase(cfg)
+	if err != nil {
+		return fmt.Errorf("Error opening database (is the server running?): %v", err)
+	}
+	defer db.Close()
+
+	migrator, ok := db.(RecordMigrator)
+	if !ok {
+		return fmt.Errorf("Migration is not required for %v databases", cfg.DatabaseDriver)
+	}
+
+	n, err := migrator.MigrateRecords()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %v records\n", n)
+	return nil
+}
+
+func VersionAction(c *cli.Context) error {
+	fmt.Printf("%v version %v\n", PACKAGE_NAME, PACKAGE_VERSION)
+	fmt.Printf("Database drivers: %v\n", strings.Join(Drivers(), ", "))
+	return nil
+}
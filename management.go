@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -12,11 +14,22 @@ var (
 	startTime time.Time
 )
 
+var (
+	// mappingsDefaultLimit is the number of mappings returned by GET /mappings/
+	// if no limit is given.
+	mappingsDefaultLimit = 100
+
+	// mappingsMaxLimit is the largest number of mappings returned by
+	// GET /mappings/ in a single page.
+	mappingsMaxLimit = 1000
+)
+
 type RuntimeStats struct {
 	Status   string        `json:"status"`
 	Version  string        `json:"version"`
 	Uptime   int64         `json:"uptime"`
 	Database DatabaseStats `json:"database"`
+	Cache    *CacheStats   `json:"cache,omitempty"` // nil if the lookup cache is disabled
 }
 
 type mgmtHandler struct {
@@ -24,10 +37,21 @@ type mgmtHandler struct {
 }
 
 func ManagementHandler(rt *Runtime) http.Handler {
-	return WrapHandler(rt, &mgmtHandler{rt})
+	return WrapHandler(rt, "management", &mgmtHandler{rt})
 }
 
 func (c *mgmtHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only GET requests are read-only
+	role := WriteRole
+	if r.Method == "GET" || r.Method == "HEAD" {
+		role = ReadRole
+	}
+	t := authenticate(c.Runtime.Config().MgmtTokens, w, r, role)
+	if t != nil {
+		requestAccessLogEntry(r).User = t.Name
+	}
+	r = withToken(r, t)
+
 	if r.URL.Path == "/stats/" {
 		if r.Method != "GET" {
 			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
@@ -37,16 +61,97 @@ func (c *mgmtHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/stats/mappings/" {
+		if r.Method != "GET" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		c.getMappingStatsHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/misses/" {
+		if r.Method != "GET" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		c.getMissesHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		if r.Method != "GET" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		checkUnscoped(r)
+		c.getMetricsHandler(w, r)
+		return
+	}
+
 	if r.URL.Path == "/config/" {
 		if r.Method != "GET" {
 			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
 		}
 
-		JSON(w, r, c.Runtime.Config)
+		checkUnscoped(r)
+		JSON(w, r, c.Runtime.Config())
 		return
 	}
 
-	if strings.HasPrefix(r.URL.Path, "/mappings/") {
+	if r.URL.Path == "/config/reload" {
+		if r.Method != "POST" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		checkUnscoped(r)
+		c.reloadConfigHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/history/" {
+		if r.Method != "GET" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		checkUnscoped(r)
+		c.getChangesHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/history/rollback" {
+		if r.Method != "POST" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		checkUnscoped(r)
+		c.rollbackMappingsHandler(w, r)
+		return
+	}
+
+	if key, ok := mappingSubresource(r, "history"); ok {
+		if r.Method != "GET" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		key = c.resolveKey(r, key)
+		checkScope(r, key)
+		c.getHistoryHandler(w, r, key)
+		return
+	}
+
+	if key, ok := mappingSubresource(r, "rollback"); ok {
+		if r.Method != "POST" {
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+
+		key = c.resolveKey(r, key)
+		checkScope(r, key)
+		c.rollbackMappingHandler(w, r, key)
+		return
+	}
+
+	if r.URL.Path == "/mappings/" {
 		switch r.Method {
 		case "POST":
 			c.postMappingHandler(w, r)
@@ -57,7 +162,28 @@ func (c *mgmtHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 
 		case "DELETE":
-			c.deleteMappingHandler(w, r)
+			c.deleteMappingHandler(w, r, "")
+			return
+
+		default:
+			panic(NewHTTPError(http.StatusMethodNotAllowed, nil))
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/mappings/") {
+		key := c.resolveKey(r, mappingKey(r))
+		checkScope(r, key)
+		switch r.Method {
+		case "GET":
+			c.getMappingHandler(w, r, key)
+			return
+
+		case "PUT", "PATCH":
+			c.putMappingHandler(w, r, key)
+			return
+
+		case "DELETE":
+			c.deleteMappingHandler(w, r, key)
 			return
 
 		default:
@@ -68,8 +194,29 @@ func (c *mgmtHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	panic(NewHTTPError(http.StatusNotFound, nil))
 }
 
+// database returns the database namespace of the virtual host selected by the
+// "host" query parameter, or the global namespace if no host is given.
+func (c *mgmtHandler) database(r *http.Request) Database {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		return c.Runtime.Database
+	}
+
+	hc := c.Runtime.Config().Hosts.Match(host)
+	if hc == nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "%v: %v", UnknownHostError, host))
+	}
+
+	db, err := c.Runtime.Database.Namespace(hc.Name)
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
 func (c *mgmtHandler) getStatsHandler(w http.ResponseWriter, r *http.Request) {
-	dbstats, err := c.Runtime.Database.Stats()
+	dbstats, err := c.database(r).Stats()
 	if err != nil {
 		panic(err)
 	}
@@ -81,23 +228,107 @@ func (c *mgmtHandler) getStatsHandler(w http.ResponseWriter, r *http.Request) {
 		Database: dbstats,
 	}
 
+	if db, ok := c.Runtime.Database.(*CachedDatabase); ok {
+		cstats := db.CacheStats()
+		stats.Cache = &cstats
+	}
+
 	JSON(w, r, stats)
 }
 
+// getMappingStatsHandler returns the hits of the mappings with the keys given
+// in the key query parameters, or of all mappings if no keys are given.
+func (c *mgmtHandler) getMappingStatsHandler(w http.ResponseWriter, r *http.Request) {
+	hits, err := c.database(r).GetHits(r.URL.Query()["key"]...)
+	if err != nil {
+		panic(err)
+	}
+
+	// tokens limited to key prefixes only see their own mappings
+	if t := requestToken(r); t != nil {
+		scoped := make([]*MappingHits, 0, len(hits))
+		for _, h := range hits {
+			if t.InScope(h.Key) {
+				scoped = append(scoped, h)
+			}
+		}
+		hits = scoped
+	}
+
+	JSON(w, r, hits)
+}
+
+func (c *mgmtHandler) getMissesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &limit); err != nil || limit < 0 {
+			panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid limit: %v", s))
+		}
+	}
+
+	misses, err := c.database(r).GetMisses(limit)
+	if err != nil {
+		panic(err)
+	}
+
+	// tokens limited to key prefixes only see their own keys
+	if t := requestToken(r); t != nil {
+		scoped := make([]*Miss, 0, len(misses))
+		for _, m := range misses {
+			if t.InScope(m.Key) {
+				scoped = append(scoped, m)
+			}
+		}
+		misses = scoped
+	}
+
+	JSON(w, r, misses)
+}
+
+// getMappingsHandler returns a page of mappings selected by the limit, after,
+// prefix and search query parameters. The cursor of the next page, if any, is
+// returned in the X-Next-Cursor header. Pages hold mappingsDefaultLimit
+// mappings if no limit is given, and at most mappingsMaxLimit mappings.
 func (c *mgmtHandler) getMappingsHandler(w http.ResponseWriter, r *http.Request) {
-	mappings, err := c.Runtime.Database.GetMappings()
+	q := r.URL.Query()
+	opts := ListOptions{
+		Limit:  mappingsDefaultLimit,
+		After:  q.Get("after"),
+		Prefix: q.Get("prefix"),
+		Search: q.Get("search"),
+	}
+
+	if s := q.Get("limit"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &opts.Limit); err != nil || opts.Limit < 1 {
+			panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid limit: %v", s))
+		}
+	}
+
+	if opts.Limit > mappingsMaxLimit {
+		opts.Limit = mappingsMaxLimit
+	}
+
+	// tokens limited to key prefixes must list within their prefixes
+	checkScope(r, opts.Prefix)
+
+	mappings, next, err := c.database(r).ListMappings(opts)
 	if err != nil {
 		panic(err)
 	}
 
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
 	JSON(w, r, mappings)
 }
 
 func (c *mgmtHandler) postMappingHandler(w http.ResponseWriter, r *http.Request) {
-	if m := r.Header.Get("Content-Type"); m != "application/json" {
+	if mediaType(r) != "application/json" {
 		panic(NewHTTPError(http.StatusBadRequest, nil))
 	}
 
+	cfg := c.Runtime.Config()
 	mappings := make([]*Mapping, 0)
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&mappings); err != nil {
@@ -105,32 +336,302 @@ func (c *mgmtHandler) postMappingHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	for i, m := range mappings {
-		if err := c.Runtime.Database.AddMapping(m); err != nil {
+		if err := m.Validate(); err != nil {
+			panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mapping '%v' at index [%v]: %v", m.Key, i, err))
+		}
+
+		checkMappingScope(r, m, cfg.Normalize.MappingKey(m))
+	}
+
+	// mode=create fails if any mapping already exists, instead of replacing it
+	rev := AnyRevision
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "replace":
+	case "create":
+		rev = MissingRevision
+	default:
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mode: %v", mode))
+	}
+
+	db := c.database(r)
+	if rev == AnyRevision {
+		// replaced mappings must be in scope as well as their keys
+		for _, m := range mappings {
+			checkStoredMappingScope(r, db, cfg.Normalize.MappingKey(m))
+		}
+	} else {
+		for i, m := range mappings {
+			key := cfg.Normalize.MappingKey(m)
+			if _, err := db.GetMapping(key); err == nil {
+				panic(NewHTTPErrorf(http.StatusConflict, "Mapping '%v' at index [%v] already exists", key, i))
+			} else if err != MappingNotFoundError {
+				panic(err)
+			}
+		}
+	}
+
+	for i, m := range mappings {
+		change, err := db.AddMappingIf(m, rev, actor(r))
+		if err == RevisionMismatchError {
+			panic(NewHTTPErrorf(http.StatusConflict, "Mapping '%v' at index [%v] already exists", m.Key, i))
+		} else if err != nil {
 			panic(fmt.Errorf("Error adding mapping '%v at index [%v]': %v", m.Key, i, err))
 		}
+
+		mappings[i] = change.Mapping
+	}
+
+	// keys are no longer missing
+	for _, m := range mappings {
+		if err := db.DeleteMiss(m.Key); err != nil {
+			panic(err)
+		}
 	}
 
-	c.Runtime.Logger.Printf("Added %v mappings", len(mappings))
+	c.Runtime.Logger.Infof("Added %v mappings", len(mappings))
 	if len(mappings) == 1 {
-		w.Header().Set("Location", fmt.Sprintf("/mappings/%v", mappings[0].Key))
+		w.Header().Set("Location", "/mappings/"+url.PathEscape(mappings[0].Key))
+		w.Header().Set("ETag", etag(mappings[0]))
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (c *mgmtHandler) deleteMappingHandler(w http.ResponseWriter, r *http.Request) {
-	m := Mapping{}
-	fmt.Sscanf(r.URL.Path, "/mappings/%s", &m.Key)
+// mappingKey returns the mapping key in the path of a /mappings/{key} request.
+// Keys are path escaped by clients so they may contain slashes, spaces and
+// other reserved characters.
+func mappingKey(r *http.Request) string {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/mappings/"))
+	if err != nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mapping key: %v", err))
+	}
+
+	return key
+}
+
+// resolveKey returns the key that the mapping given by a request key is stored
+// with. Mapping keys are normalized when mappings are stored, so the key is
+// looked up in each of its normalized forms, first as a stored mapping and
+// then in the history of deleted mappings. The key is returned unchanged if no
+// mapping or history is found.
+func (c *mgmtHandler) resolveKey(r *http.Request, key string) string {
+	if key == "" {
+		return key
+	}
+
+	db := c.database(r)
+	keys := c.Runtime.Config().Normalize.LookupKeys(key)
+	if len(keys) == 1 {
+		return key
+	}
+
+	for _, k := range keys {
+		if _, err := db.GetMapping(k); err == nil {
+			return k
+		} else if err != MappingNotFoundError {
+			panic(err)
+		}
+	}
+
+	for _, k := range keys {
+		history, err := db.GetHistory(k)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(history) > 0 {
+			return k
+		}
+	}
+
+	return key
+}
+
+// mappingSubresource returns the mapping key of a /mappings/{key}/{name}
+// request if the request is for the named subresource of a mapping. The key
+// must be path escaped to contain slashes.
+func mappingSubresource(r *http.Request, name string) (string, bool) {
+	p := r.URL.EscapedPath()
+	if !strings.HasPrefix(p, "/mappings/") {
+		return "", false
+	}
+
+	p = strings.TrimPrefix(p, "/mappings/")
+	i := strings.LastIndex(p, "/")
+	if i <= 0 || p[i+1:] != name {
+		return "", false
+	}
+
+	key, err := url.PathUnescape(p[:i])
+	if err != nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mapping key: %v", err))
+	}
+
+	return key, true
+}
+
+// mediaType returns the media type of a request body given in the Content-Type
+// header, without parameters such as charset, or an empty string if no valid
+// media type is given.
+func mediaType(r *http.Request) string {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return t
+}
+
+// actor returns the name recorded in the history of mappings changed by a
+// request. This is the name of the authenticated token, if any, or is given by
+// clients in the X-Redirector-Actor header, or is otherwise the remote address
+// of the client.
+func actor(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return t.Name
+	}
+
+	if s := r.Header.Get("X-Redirector-Actor"); s != "" {
+		return s
+	}
+
+	return r.RemoteAddr
+}
+
+// etag returns the entity tag of the current revision of a mapping.
+func etag(m *Mapping) string {
+	return fmt.Sprintf(`"%d"`, m.Revision)
+}
+
+// ifMatch returns the mapping revision required by the If-Match header of a
+// request, or AnyRevision if the header is not given.
+func ifMatch(r *http.Request) int64 {
+	s := r.Header.Get("If-Match")
+	if s == "" || s == "*" {
+		return AnyRevision
+	}
+
+	var rev int64
+	if _, err := fmt.Sscanf(s, `"%d"`, &rev); err != nil || rev < 0 {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid If-Match header: %v", s))
+	}
+
+	return rev
+}
+
+func (c *mgmtHandler) getMappingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	m, err := c.database(r).GetMapping(key)
+	if err != nil {
+		panic(err)
+	}
+	checkMappingScope(r, m, key)
+
+	w.Header().Set("ETag", etag(m))
+	JSON(w, r, m)
+}
+
+// putMappingHandler replaces (PUT) or partially updates (PATCH) an existing
+// mapping. The mapping is renamed if the request body gives a new key, unless
+// a mapping with the new key already exists. If the If-Match header is given,
+// the mapping is only modified if its current revision matches.
+func (c *mgmtHandler) putMappingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	switch mediaType(r) {
+	case "application/json":
+	case "application/merge-patch+json":
+		if r.Method != "PATCH" {
+			panic(NewHTTPError(http.StatusUnsupportedMediaType, nil))
+		}
+	default:
+		panic(NewHTTPError(http.StatusUnsupportedMediaType, nil))
+	}
+
+	cfg := c.Runtime.Config()
+	rev := ifMatch(r)
+	db := c.database(r)
+	old, err := db.GetMapping(key)
+	if err != nil {
+		panic(err)
+	}
+
+	// the replaced mapping must be in scope as well as its key
+	checkMappingScope(r, old, key)
+
+	if err := checkRevision(old, rev); err != nil {
+		panic(err)
+	}
+
+	// PATCH decodes the given fields over the existing mapping
+	m := &Mapping{}
+	if r.Method == "PATCH" {
+		v := *old
+		m = &v
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mapping: %v", err))
+	}
+
 	if m.Key == "" {
-		if _, err := c.Runtime.Database.DeleteMappings(); err != nil {
+		m.Key = key
+	}
+
+	if err := m.Validate(); err != nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid mapping '%v': %v", m.Key, err))
+	}
+
+	checkMappingScope(r, m, cfg.Normalize.MappingKey(m))
+
+	if cfg.Normalize.MappingKey(m) == key {
+		change, err := db.AddMappingIf(m, rev, actor(r))
+		if err != nil {
 			panic(err)
 		}
+
+		m = change.Mapping
+		c.Runtime.Logger.Infof("Updated mapping %v", key)
 	} else {
-		if _, err := c.Runtime.Database.GetMapping(m.Key); err != nil {
+		// create the renamed mapping before deleting the original
+		change, err := db.AddMappingIf(m, MissingRevision, actor(r))
+		if err == RevisionMismatchError {
+			panic(NewHTTPErrorf(http.StatusConflict, "Mapping '%v' already exists", cfg.Normalize.MappingKey(m)))
+		} else if err != nil {
 			panic(err)
 		}
 
-		if err := c.Runtime.Database.DeleteMapping(m.Key); err != nil {
+		m = change.Mapping
+		if _, err := db.DeleteMappingIf(key, rev, actor(r)); err != nil {
+			if _, err := db.DeleteMappingIf(m.Key, m.Revision, actor(r)); err != nil {
+				c.Runtime.Logger.Errorf("Error removing renamed mapping %v: %v", m.Key, err)
+			}
+			panic(err)
+		}
+
+		c.Runtime.Logger.Infof("Renamed mapping %v to %v", key, m.Key)
+		w.Header().Set("Location", "/mappings/"+url.PathEscape(m.Key))
+	}
+
+	// the key is no longer missing
+	if err := db.DeleteMiss(m.Key); err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("ETag", etag(m))
+	JSON(w, r, m)
+}
+
+// deleteMappingHandler deletes the mapping given in the request path, or all
+// mappings if no key is given. If the If-Match header is given, the mapping is
+// only deleted if its current revision matches.
+func (c *mgmtHandler) deleteMappingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	db := c.database(r)
+	if key == "" {
+		checkUnscoped(r)
+		if _, err := db.DeleteMappings(actor(r)); err != nil {
+			panic(err)
+		}
+	} else {
+		checkStoredMappingScope(r, db, key)
+		if _, err := db.DeleteMappingIf(key, ifMatch(r), actor(r)); err != nil {
 			panic(err)
 		}
 	}
@@ -138,13 +639,117 @@ func (c *mgmtHandler) deleteMappingHandler(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func serveManager(rt *Runtime) error {
+// getHistoryHandler returns the history of changes to a mapping key.
+func (c *mgmtHandler) getHistoryHandler(w http.ResponseWriter, r *http.Request, key string) {
+	history, err := c.database(r).GetHistory(key)
+	if err != nil {
+		panic(err)
+	}
+
+	JSON(w, r, history)
+}
+
+// getChangesHandler returns all changes to mappings made since the time given
+// in the since query parameter, or all changes if no time is given.
+func (c *mgmtHandler) getChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid time: %v", s))
+		}
+		since = t
+	}
+
+	changes, err := c.database(r).GetChanges(since)
+	if err != nil {
+		panic(err)
+	}
+
+	JSON(w, r, changes)
+}
+
+// rollbackMappingHandler restores the revision of a mapping given in the to
+// query parameter, and returns the change made, if any.
+func (c *mgmtHandler) rollbackMappingHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var rev int64
+	if s := r.URL.Query().Get("to"); s == "" {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "No revision given"))
+	} else if _, err := fmt.Sscanf(s, "%d", &rev); err != nil || rev < 0 {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid revision: %v", s))
+	}
+
+	// the restored mapping must be in scope as well as its key
+	db := c.database(r)
+	if t := requestToken(r); t != nil && len(t.Prefixes) > 0 {
+		history, err := db.GetHistory(key)
+		if err != nil {
+			panic(err)
+		}
+
+		if m := mappingRevision(history, rev); m != nil {
+			checkMappingScope(r, m, key)
+		}
+	}
+	checkStoredMappingScope(r, db, key)
+
+	change, err := rollbackMapping(db, key, rev, actor(r))
+	if err != nil {
+		panic(err)
+	}
+
+	changes := make([]*MappingChange, 0)
+	if change != nil {
+		c.Runtime.Logger.Infof("Rolled back mapping %v to revision %v", key, rev)
+		changes = append(changes, change)
+	}
+
+	JSON(w, r, changes)
+}
+
+// rollbackMappingsHandler restores every mapping changed since the time given
+// in the before query parameter to its value at that time, and returns the
+// changes made.
+func (c *mgmtHandler) rollbackMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	s := r.URL.Query().Get("before")
+	before, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid time: %v", s))
+	}
+
+	changes, err := rollbackMappings(c.database(r), before, actor(r))
+	if err != nil {
+		panic(err)
+	}
+
+	c.Runtime.Logger.Infof("Rolled back %v mappings to %v", len(changes), before)
+	JSON(w, r, changes)
+}
+
+func (c *mgmtHandler) reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	changes, err := c.Runtime.ReloadConfig()
+	if err != nil {
+		c.Runtime.Logger.Errorf("Error reloading configuration: %v", err)
+		panic(NewHTTPErrorf(http.StatusBadRequest, "Invalid configuration: %v", err))
+	}
+
+	JSON(w, r, changes)
+}
+
+func serveManager(rt *Runtime, g *ServerGroup) error {
 	startTime = time.Now()
+	cfg := rt.Config()
 	s := &http.Server{
-		Addr:    rt.Config.MgmtAddr,
+		Addr:    cfg.MgmtAddr,
 		Handler: ManagementHandler(rt),
 	}
 
-	rt.Logger.Printf("Listening for management commands on %v", rt.Config.MgmtAddr)
-	return s.ListenAndServe()
+	g.Go(countMappingsPeriodically)
+
+	rt.Logger.Infof("Listening for management commands on %v", cfg.MgmtAddr)
+	if len(cfg.MgmtTokens) == 0 {
+		rt.Logger.Warnf("No management tokens are configured; the management API is not authenticated")
+	}
+
+	return g.Listen("management", s, cfg.MgmtTLS, nil)
 }
@@ -2,40 +2,368 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"time"
 )
 
 type ManagementClient struct {
 	Config *Config
+	Host   string // virtual host to manage; empty for the global namespace
+	Actor  string // recorded in the history of changed mappings
+	Token  string // management API bearer token
+
+	client *http.Client
 }
 
+// NewManagementClient returns a client that sends the token given in the
+// REDIRECTOR_TOKEN environment variable, or otherwise the configured token.
 func NewManagementClient(cfg *Config) *ManagementClient {
-	return &ManagementClient{cfg}
+	c := &ManagementClient{Config: cfg, Token: string(cfg.MgmtToken)}
+	if s := os.Getenv(TokenEnv); s != "" {
+		c.Token = s
+	}
+
+	if u, err := user.Current(); err == nil {
+		c.Actor = u.Username
+	}
+
+	return c
+}
+
+// newRequest returns a management API request with the actor and token headers
+// set.
+func (c *ManagementClient) newRequest(method, addr string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, addr, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Actor != "" {
+		req.Header.Set("X-Redirector-Actor", c.Actor)
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return req, nil
 }
 
-func (c *ManagementClient) GetMappings() ([]Mapping, error) {
-	addr := fmt.Sprintf("http://%v/mappings/", c.Config.MgmtAddr)
+// do sends a request to the management API.
+func (c *ManagementClient) do(method, addr, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := c.newRequest(method, addr, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
-	resp, err := http.Get(addr)
+	client, err := c.httpClient()
 	if err != nil {
 		return nil, err
 	}
+
+	return client.Do(req)
+}
+
+// useTLS returns true if the management API is served with HTTPS.
+func (c *ManagementClient) useTLS() bool {
+	return c.Config.MgmtTLS.Enabled() || c.Config.MgmtClientTLS.Enabled()
+}
+
+// httpClient returns the HTTP client used for all requests, configured with
+// the CA bundle and client certificate of the management client.
+func (c *ManagementClient) httpClient() (*http.Client, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	if !c.useTLS() {
+		c.client = http.DefaultClient
+		return c.client, nil
+	}
+
+	tc := &tls.Config{ServerName: c.Config.MgmtClientTLS.ServerName}
+	if path := c.Config.MgmtClientTLS.CAFile; path != "" {
+		pool, err := loadCertPool(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading CA bundle: %v", err)
+		}
+		tc.RootCAs = pool
+	}
+
+	if path := c.Config.MgmtClientTLS.CertFile; path != "" {
+		cert, err := tls.LoadX509KeyPair(path, c.Config.MgmtClientTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+	c.client = &http.Client{Transport: transport}
+	return c.client, nil
+}
+
+// get sends a GET request to the management API.
+func (c *ManagementClient) get(addr string) (*http.Response, error) {
+	return c.do("GET", addr, "", nil)
+}
+
+// endpoint returns the URL of the given management API path, with the virtual
+// host selector added to the given query parameters.
+func (c *ManagementClient) endpoint(path string, params url.Values) string {
+	if params == nil {
+		params = url.Values{}
+	}
+
+	if c.Host != "" {
+		params.Set("host", c.Host)
+	}
+
+	scheme := "http"
+	if c.useTLS() {
+		scheme = "https"
+	}
+
+	addr := fmt.Sprintf("%v://%v%v", scheme, c.Config.MgmtAddr, path)
+	if len(params) > 0 {
+		addr += "?" + params.Encode()
+	}
+
+	return addr
+}
+
+// mappingsPageSize is the number of mappings requested in each page by
+// GetMappings.
+const mappingsPageSize = 1000
+
+// ListMappings returns a page of mappings and the cursor of the next page, or
+// an empty cursor if this is the last page.
+func (c *ManagementClient) ListMappings(opts ListOptions) ([]Mapping, string, error) {
+	params := url.Values{}
+	if opts.Limit > 0 {
+		params.Set("limit", fmt.Sprintf("%d", opts.Limit))
+	}
+
+	for k, v := range map[string]string{"after": opts.After, "prefix": opts.Prefix, "search": opts.Search} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+
+	resp, err := c.get(c.endpoint("/mappings/", params))
+	if err != nil {
+		return nil, "", err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
 	mappings := make([]Mapping, 0)
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(&mappings); err != nil {
+		return nil, "", err
+	}
+
+	return mappings, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// GetMappings calls fn with each page of the mappings that match the prefix
+// and search filters of opts, until all pages are read or fn returns an error.
+func (c *ManagementClient) GetMappings(opts ListOptions, fn func([]Mapping) error) error {
+	if opts.Limit == 0 {
+		opts.Limit = mappingsPageSize
+	}
+
+	for {
+		mappings, next, err := c.ListMappings(opts)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(mappings); err != nil {
+			return err
+		}
+
+		if next == "" {
+			return nil
+		}
+		opts.After = next
+	}
+}
+
+// mappingEndpoint returns the URL of the mapping with the given key.
+func (c *ManagementClient) mappingEndpoint(key string) string {
+	return c.endpoint("/mappings/"+url.PathEscape(key), nil)
+}
+
+// GetMapping returns the mapping with the given key, or MappingNotFoundError.
+func (c *ManagementClient) GetMapping(key string) (*Mapping, error) {
+	resp, err := c.get(c.mappingEndpoint(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, MappingNotFoundError
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	m := &Mapping{}
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// PutMapping replaces the existing mapping with the given key. The mapping is
+// renamed if m has a different key. If rev is not AnyRevision, the mapping is
+// only replaced if its current revision matches, or RevisionMismatchError is
+// returned.
+func (c *ManagementClient) PutMapping(key string, m *Mapping, rev int64) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest("PUT", c.mappingEndpoint(key), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rev != AnyRevision {
+		req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, rev))
+	}
+
+	client, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+
+	case http.StatusNotFound:
+		return MappingNotFoundError
+
+	case http.StatusPreconditionFailed:
+		return RevisionMismatchError
+
+	case http.StatusConflict:
+		return fmt.Errorf("Mapping '%v' already exists", m.Key)
+	}
+
+	return fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+}
+
+// hitsPageSize is the number of keys requested in each request by GetHits.
+const hitsPageSize = 100
+
+// GetHits returns the recorded hits of the mappings with the given keys, or of
+// all mappings that have been hit if no keys are given.
+func (c *ManagementClient) GetHits(keys ...string) ([]MappingHits, error) {
+	if len(keys) == 0 {
+		return c.getHits(nil)
+	}
+
+	hits := make([]MappingHits, 0, len(keys))
+	for i := 0; i < len(keys); i += hitsPageSize {
+		end := i + hitsPageSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		page, err := c.getHits(keys[i:end])
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, page...)
+	}
+
+	return hits, nil
+}
+
+func (c *ManagementClient) getHits(keys []string) ([]MappingHits, error) {
+	var params url.Values
+	if len(keys) > 0 {
+		params = url.Values{"key": keys}
+	}
+
+	resp, err := c.get(c.endpoint("/stats/mappings/", params))
+	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return mappings, nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	hits := make([]MappingHits, 0)
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&hits); err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+func (c *ManagementClient) GetMisses(limit int) ([]Miss, error) {
+	addr := c.endpoint("/misses/", url.Values{"limit": {fmt.Sprintf("%d", limit)}})
+
+	resp, err := c.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	misses := make([]Miss, 0)
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&misses); err != nil {
+		return nil, err
+	}
+
+	return misses, nil
 }
 
 func (c *ManagementClient) AddMapping(m *Mapping) error {
-	addr := fmt.Sprintf("http://%v/mappings/", c.Config.MgmtAddr)
+	addr := c.endpoint("/mappings/", nil)
 
 	b, err := json.Marshal([]Mapping{*m})
 	if err != nil {
@@ -43,7 +371,7 @@ func (c *ManagementClient) AddMapping(m *Mapping) error {
 	}
 
 	r := bytes.NewReader(b)
-	resp, err := http.Post(addr, "application/json", r)
+	resp, err := c.do("POST", addr, "application/json", r)
 	if err != nil {
 		return err
 	}
@@ -61,7 +389,17 @@ func (c *ManagementClient) AddMapping(m *Mapping) error {
 	return nil
 }
 func (c *ManagementClient) AddMappings(m []*Mapping) error {
-	addr := fmt.Sprintf("http://%v/mappings/", c.Config.MgmtAddr)
+	return c.postMappings(m, nil)
+}
+
+// CreateMappings adds the given mappings, or returns an error without adding
+// any mappings if one already exists.
+func (c *ManagementClient) CreateMappings(m []*Mapping) error {
+	return c.postMappings(m, url.Values{"mode": {"create"}})
+}
+
+func (c *ManagementClient) postMappings(m []*Mapping, params url.Values) error {
+	addr := c.endpoint("/mappings/", params)
 
 	b, err := json.Marshal(m)
 	if err != nil {
@@ -69,7 +407,7 @@ func (c *ManagementClient) AddMappings(m []*Mapping) error {
 	}
 
 	r := bytes.NewReader(b)
-	resp, err := http.Post(addr, "application/json", r)
+	resp, err := c.do("POST", addr, "application/json", r)
 	if err != nil {
 		return err
 	}
@@ -80,6 +418,10 @@ func (c *ManagementClient) AddMappings(m []*Mapping) error {
 		return err
 	}
 
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("One or more mappings already exist")
+	}
+
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
@@ -88,17 +430,28 @@ func (c *ManagementClient) AddMappings(m []*Mapping) error {
 }
 
 func (c *ManagementClient) RemoveMapping(m *Mapping) error {
-	addr := fmt.Sprintf("http://%v/mappings/%v", c.Config.MgmtAddr, m.Key)
+	addr := c.mappingEndpoint(m.Key)
 
-	req, err := http.NewRequest("DELETE", addr, nil)
+	resp, err := c.do("DELETE", addr, "", nil)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.DefaultClient.Do(req)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
+func (c *ManagementClient) RemoveAllMappings() error {
+	addr := c.endpoint("/mappings/", nil)
+
+	resp, err := c.do("DELETE", addr, "", nil)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
@@ -106,22 +459,87 @@ func (c *ManagementClient) RemoveMapping(m *Mapping) error {
 
 	return nil
 }
-func (c *ManagementClient) RemoveAllMappings() error {
-	addr := fmt.Sprintf("http://%v/mappings/", c.Config.MgmtAddr)
 
-	req, err := http.NewRequest("DELETE", addr, nil)
+// GetHistory returns the history of changes to the mapping with the given key.
+func (c *ManagementClient) GetHistory(key string) ([]MappingChange, error) {
+	resp, err := c.get(c.endpoint("/mappings/"+url.PathEscape(key)+"/history", nil))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	changes := make([]MappingChange, 0)
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&changes); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// RollbackMapping restores the given revision of a mapping from its history.
+func (c *ManagementClient) RollbackMapping(key string, rev int64) ([]MappingChange, error) {
+	addr := c.endpoint("/mappings/"+url.PathEscape(key)+"/rollback", url.Values{"to": {fmt.Sprintf("%d", rev)}})
+	return c.rollback(addr)
+}
+
+// RollbackMappings restores every mapping changed since the given time to its
+// value at that time.
+func (c *ManagementClient) RollbackMappings(before time.Time) ([]MappingChange, error) {
+	addr := c.endpoint("/history/rollback", url.Values{"before": {before.Format(time.RFC3339Nano)}})
+	return c.rollback(addr)
+}
+
+func (c *ManagementClient) rollback(addr string) ([]MappingChange, error) {
+	resp, err := c.do("POST", addr, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, RevisionNotFoundError
+	default:
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	changes := make([]MappingChange, 0)
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&changes); err != nil {
+		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	return changes, nil
+}
+
+// ReloadConfig reloads the configuration file of the server and returns the
+// changed settings.
+func (c *ManagementClient) ReloadConfig() ([]ConfigChange, error) {
+	resp, err := c.do("POST", c.endpoint("/config/reload", nil), "", nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		return nil, fmt.Errorf("The configuration file is invalid; see the server log for details")
+	default:
+		return nil, fmt.Errorf("%d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
 
-	return nil
+	changes := make([]ConfigChange, 0)
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&changes); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testManagementServer(fn func(*Runtime, *ManagementClient)) {
+	tmpBoltDB(func(db Database) {
+		rt := &Runtime{
+			Database:     db,
+			Logger:       newLogger(ioutil.Discard, TextLog, InfoLevel),
+			AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
+		}
+		rt.SetConfig(&Config{ExitOnError: true})
+
+		ts := httptest.NewServer(ManagementHandler(rt))
+		defer ts.Close()
+
+		fn(rt, &ManagementClient{
+			Config: &Config{MgmtAddr: strings.TrimPrefix(ts.URL, "http://")},
+		})
+	})
+}
+
+// testRequest sends a request with a JSON body to the management server and
+// returns the response status.
+func testRequest(client *ManagementClient, method, key, contentType, body string) int {
+	req, err := http.NewRequest(method, client.mappingEndpoint(key), bytes.NewReader([]byte(body)))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestMappingCRUD(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		// keys with slashes, spaces and escapes
+		keys := []string{"/path/to/page", "/with space", "/percent%2F", "/query?a=b"}
+		for _, key := range keys {
+			if err := client.AddMapping(&Mapping{Key: key, Destination: "/okay"}); err != nil {
+				panic(err)
+			}
+
+			m, err := client.GetMapping(key)
+			if err != nil {
+				t.Errorf("Error getting mapping %v: %v", key, err)
+				continue
+			}
+
+			if m.Key != key {
+				t.Errorf("Expected mapping %v, got %v", key, m.Key)
+			}
+		}
+
+		if _, err := client.GetMapping("/missing"); err != MappingNotFoundError {
+			t.Errorf("Expected MappingNotFoundError, got %v", err)
+		}
+
+		// replace
+		if err := client.PutMapping("/with space", &Mapping{Destination: "/replaced", Comment: "replaced"}, AnyRevision); err != nil {
+			t.Errorf("Error replacing mapping: %v", err)
+		}
+
+		if m, err := client.GetMapping("/with space"); err != nil || m.Destination != "/replaced" {
+			t.Errorf("Expected replaced mapping, got: %v, %v", m, err)
+		}
+
+		if err := client.PutMapping("/missing", &Mapping{Destination: "/okay"}, AnyRevision); err != MappingNotFoundError {
+			t.Errorf("Expected MappingNotFoundError replacing missing mapping, got %v", err)
+		}
+
+		// partial update
+		if status := testRequest(client, "PATCH", "/with space", "application/merge-patch+json", `{"dest": "/patched"}`); status != http.StatusOK {
+			t.Errorf("Expected status %v for PATCH, got %v", http.StatusOK, status)
+		}
+
+		if m, err := client.GetMapping("/with space"); err != nil || m.Destination != "/patched" || m.Comment != "replaced" {
+			t.Errorf("Expected patched mapping, got: %v, %v", m, err)
+		}
+
+		// media type parameters are ignored
+		if status := testRequest(client, "PATCH", "/with space", "application/merge-patch+json; charset=utf-8", `{"comment": "patched"}`); status != http.StatusOK {
+			t.Errorf("Expected status %v for PATCH with charset, got %v", http.StatusOK, status)
+		}
+
+		if status := testRequest(client, "PUT", "/with space", "text/plain", `{"dest": "/patched"}`); status != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status %v for PUT of text/plain, got %v", http.StatusUnsupportedMediaType, status)
+		}
+
+		if status := testRequest(client, "POST", "", "Application/JSON; charset=utf-8", `[{"key": "/charset", "dest": "/okay"}]`); status != http.StatusCreated {
+			t.Errorf("Expected status %v for POST with charset, got %v", http.StatusCreated, status)
+		}
+
+		if err := client.RemoveMapping(&Mapping{Key: "/charset"}); err != nil {
+			t.Errorf("Error removing mapping: %v", err)
+		}
+
+		if status := testRequest(client, "PATCH", "/with space", "application/json", `{"status": 200}`); status != http.StatusBadRequest {
+			t.Errorf("Expected status %v for invalid PATCH, got %v", http.StatusBadRequest, status)
+		}
+
+		// rename
+		if status := testRequest(client, "PATCH", "/with space", "application/json", `{"key": "/path/to/page"}`); status != http.StatusConflict {
+			t.Errorf("Expected status %v renaming to an existing key, got %v", http.StatusConflict, status)
+		}
+
+		if err := client.PutMapping("/with space", &Mapping{Key: "/renamed", Destination: "/okay"}, AnyRevision); err != nil {
+			t.Errorf("Error renaming mapping: %v", err)
+		}
+
+		if _, err := client.GetMapping("/with space"); err != MappingNotFoundError {
+			t.Errorf("Expected renamed mapping to be removed, got %v", err)
+		}
+
+		// delete
+		for _, key := range append(keys[2:], "/renamed") {
+			if err := client.RemoveMapping(&Mapping{Key: key}); err != nil {
+				t.Errorf("Error removing mapping %v: %v", key, err)
+			}
+		}
+
+		if err := client.RemoveMapping(&Mapping{Key: "/renamed"}); err == nil {
+			t.Errorf("Expected error removing missing mapping")
+		}
+
+		if _, err := client.GetMapping("/path/to/page"); err != nil {
+			t.Errorf("Expected mapping to remain, got %v", err)
+		}
+	})
+}
+
+func TestMappingETags(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		do := func(method, key, ifMatch, body string) *http.Response {
+			req, err := http.NewRequest(method, client.mappingEndpoint(key), bytes.NewReader([]byte(body)))
+			if err != nil {
+				panic(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				panic(err)
+			}
+			res.Body.Close()
+			return res
+		}
+
+		if err := client.CreateMappings([]*Mapping{{Key: "/etag", Destination: "/one"}}); err != nil {
+			panic(err)
+		}
+
+		if err := client.CreateMappings([]*Mapping{{Key: "/new", Destination: "/okay"}, {Key: "/etag", Destination: "/two"}}); err == nil {
+			t.Errorf("Expected error creating existing mapping")
+		}
+
+		if _, err := client.GetMapping("/new"); err != MappingNotFoundError {
+			t.Errorf("Expected no mappings to be created if one exists, got %v", err)
+		}
+
+		if res := do("GET", "/etag", "", ""); res.Header.Get("ETag") != `"1"` {
+			t.Errorf("Expected ETag \"1\", got %v", res.Header.Get("ETag"))
+		}
+
+		if res := do("PATCH", "/etag", `"2"`, `{"dest": "/two"}`); res.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %v for stale If-Match, got %v", http.StatusPreconditionFailed, res.StatusCode)
+		}
+
+		res := do("PATCH", "/etag", `"1"`, `{"dest": "/two"}`)
+		if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"2"` {
+			t.Errorf("Expected status %v with ETag \"2\", got %v with %v", http.StatusOK, res.StatusCode, res.Header.Get("ETag"))
+		}
+
+		if err := client.PutMapping("/etag", &Mapping{Destination: "/three"}, 1); err != RevisionMismatchError {
+			t.Errorf("Expected RevisionMismatchError, got %v", err)
+		}
+
+		if res := do("PUT", "/etag", "*", `{"dest": "/three"}`); res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status %v for If-Match *, got %v", http.StatusOK, res.StatusCode)
+		}
+
+		if res := do("DELETE", "/etag", `"2"`, ""); res.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %v deleting stale revision, got %v", http.StatusPreconditionFailed, res.StatusCode)
+		}
+
+		if res := do("DELETE", "/etag", `"3"`, ""); res.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status %v deleting current revision, got %v", http.StatusNoContent, res.StatusCode)
+		}
+	})
+}
+
+func TestMappingHistory(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		client.Actor = "tester"
+		for _, dest := range []string{"/one", "/two"} {
+			if err := client.AddMapping(&Mapping{Key: "/path/to/page", Destination: dest}); err != nil {
+				panic(err)
+			}
+		}
+
+		history, err := client.GetHistory("/path/to/page")
+		if err != nil {
+			t.Fatalf("Error getting history: %v", err)
+		}
+
+		if len(history) != 2 || history[1].Action != UpdateAction || history[1].Actor != "tester" {
+			t.Fatalf("Expected update by tester in history, got %v", history)
+		}
+
+		if _, err := client.RollbackMapping("/path/to/page", 1); err != nil {
+			t.Errorf("Error rolling back mapping: %v", err)
+		}
+
+		if m, err := client.GetMapping("/path/to/page"); err != nil || m.Destination != "/one" {
+			t.Errorf("Expected mapping restored to /one, got %v, %v", m, err)
+		}
+
+		if _, err := client.RollbackMapping("/path/to/page", 99); err != RevisionNotFoundError {
+			t.Errorf("Expected RevisionNotFoundError, got %v", err)
+		}
+
+		// roll back everything
+		if _, err := client.RollbackMappings(time.Now().Add(-time.Minute)); err != nil {
+			t.Errorf("Error rolling back mappings: %v", err)
+		}
+
+		if _, err := client.GetMapping("/path/to/page"); err != MappingNotFoundError {
+			t.Errorf("Expected mapping to be removed, got %v", err)
+		}
+	})
+}
+
+func TestNormalizedMappingKeys(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		rt.Config().Normalize = KeyNormalization{Lowercase: true, StripTrailingSlash: true}
+		rt.Database.(*BoltDatabase).cfg.Normalize = rt.Config().Normalize
+		if err := client.AddMapping(&Mapping{Key: "/Promo/", Destination: "/one"}); err != nil {
+			panic(err)
+		}
+
+		m, err := client.GetMapping("/Promo")
+		if err != nil {
+			t.Fatalf("Error getting mapping by unnormalized key: %v", err)
+		}
+
+		if m.Key != "/promo" {
+			t.Errorf("Expected normalized key /promo, got %v", m.Key)
+		}
+
+		if err := client.PutMapping("/PROMO/", &Mapping{Destination: "/two"}, AnyRevision); err != nil {
+			t.Errorf("Error updating mapping by unnormalized key: %v", err)
+		}
+
+		if err := client.RemoveMapping(&Mapping{Key: "/Promo"}); err != nil {
+			t.Errorf("Error removing mapping by unnormalized key: %v", err)
+		}
+
+		if _, err := rt.Database.GetMapping("/promo"); err != MappingNotFoundError {
+			t.Errorf("Expected mapping to be removed, got %v", err)
+		}
+
+		history, err := client.GetHistory("/Promo/")
+		if err != nil {
+			t.Fatalf("Error getting history by unnormalized key: %v", err)
+		}
+
+		if len(history) != 3 || history[2].Action != DeleteAction {
+			t.Errorf("Expected add, update and delete in history, got %v", history)
+		}
+	})
+}
+
+func TestListMappingsLimit(t *testing.T) {
+	defaultLimit, maxLimit := mappingsDefaultLimit, mappingsMaxLimit
+	defer func() { mappingsDefaultLimit, mappingsMaxLimit = defaultLimit, maxLimit }()
+	mappingsDefaultLimit, mappingsMaxLimit = 2, 3
+
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		for _, key := range []string{"/a", "/b", "/c", "/d", "/e"} {
+			if err := rt.Database.AddMapping(&Mapping{Key: key, Destination: "/"}); err != nil {
+				panic(err)
+			}
+		}
+
+		if mappings, next, err := client.ListMappings(ListOptions{}); err != nil {
+			panic(err)
+		} else if len(mappings) != 2 || next == "" {
+			t.Errorf("Expected the default page of 2 mappings, got %d", len(mappings))
+		}
+
+		if mappings, _, err := client.ListMappings(ListOptions{Limit: 10}); err != nil {
+			panic(err)
+		} else if len(mappings) != 3 {
+			t.Errorf("Expected the maximum page of 3 mappings, got %d", len(mappings))
+		}
+
+		res, err := http.Get(client.endpoint("/mappings/", url.Values{"limit": {"0"}}))
+		if err != nil {
+			panic(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %d for a zero limit, got %d", http.StatusBadRequest, res.StatusCode)
+		}
+
+		n := 0
+		if err := client.GetMappings(ListOptions{}, func(mappings []Mapping) error {
+			n += len(mappings)
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+
+		if n != 5 {
+			t.Errorf("Expected 5 mappings in all pages, got %d", n)
+		}
+
+		if err := rt.Database.AddHits([]*MappingHits{
+			{Key: "/a", Count: 1, FirstHit: time.Now(), LastHit: time.Now()},
+			{Key: "/b", Count: 2, FirstHit: time.Now(), LastHit: time.Now()},
+		}); err != nil {
+			panic(err)
+		}
+
+		if hits, err := client.GetHits("/b", "/c"); err != nil {
+			panic(err)
+		} else if len(hits) != 1 || hits[0].Key != "/b" || hits[0].Count != 2 {
+			t.Errorf("Expected only the hits of /b, got %v", hits)
+		}
+
+		if hits, err := client.GetHits(); err != nil {
+			panic(err)
+		} else if len(hits) != 2 {
+			t.Errorf("Expected the hits of all mappings, got %v", hits)
+		}
+	})
+}
@@ -3,38 +3,104 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 )
 
+// MappingType determines how the key of a Mapping is matched against a
+// request key.
+type MappingType string
+
+const (
+	// ExactMapping matches request keys that are identical to the mapping key.
+	ExactMapping MappingType = ""
+
+	// PrefixMapping matches request keys that start with the mapping key. If
+	// multiple prefix mappings match a request key, the longest is used.
+	PrefixMapping MappingType = "prefix"
+
+	// RegexpMapping matches request keys against a regular expression given as
+	// the mapping key. Capture groups are added to the ViewBag of destination
+	// templates.
+	RegexpMapping MappingType = "regexp"
+)
+
+func (t MappingType) String() string {
+	if t == ExactMapping {
+		return "exact"
+	}
+	return string(t)
+}
+
 // A Mapping maps a request key to a destination URL.
 type Mapping struct {
-	Key         string `json:"key"`
-	Destination string `json:"dest"`
-	Permanent   bool   `json:"perm,omitempty"`
-	Comment     string `json:"comment,omitempty"`
-	IsTemplate  bool   `json:"-"`
+	Key         string      `json:"key"`
+	Destination string      `json:"dest"`
+	Permanent   bool        `json:"perm,omitempty"`   // deprecated in favor of Status
+	Status      int         `json:"status,omitempty"` // HTTP status code
+	Comment     string      `json:"comment,omitempty"`
+	Type        MappingType `json:"type,omitempty"`
+	Priority    int         `json:"priority,omitempty"`  // evaluation order of regexp mappings
+	Query       QueryPolicy `json:"query,omitempty"`     // request query string policy
+	NotBefore   *time.Time  `json:"notBefore,omitempty"` // mapping is inactive before this time
+	NotAfter    *time.Time  `json:"notAfter,omitempty"`  // mapping is inactive after this time
+	Revision    int64       `json:"revision,omitempty"`  // incremented by the database on each change
+	Modified    *time.Time  `json:"modified,omitempty"`  // time of the last change, set by the database
+	IsTemplate  bool        `json:"-"`
 }
 
 var (
 	KeyMissingError             = fmt.Errorf("No key defined")
 	DestinationMissingError     = fmt.Errorf("No destination defined")
 	DestinationNotTemplateError = fmt.Errorf("Mapping destination is not a template")
+	UnknownMappingTypeError     = fmt.Errorf("Unknown mapping type")
+	UnsupportedStatusError      = fmt.Errorf("Unsupported HTTP status code")
+	InvalidActiveWindowError    = fmt.Errorf("Mapping notAfter time must be later than notBefore time")
 )
 
+// mappingStatusCodes are the HTTP status codes that may be returned for a
+// mapping.
+var mappingStatusCodes = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+	http.StatusGone,
+}
+
 var (
 	mappingTemplates      = make(map[string]*template.Template)
 	mappingTemplatesMutex = &sync.Mutex{}
+
+	mappingRegexps      = make(map[string]*regexp.Regexp)
+	mappingRegexpsMutex = &sync.Mutex{}
 )
 
 func (m *Mapping) String() string {
 	j := "->"
-	if m.Permanent {
+	switch m.StatusCode() {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
 		j = "=>"
+
+	case http.StatusGone:
+		j = "-x"
 	}
 
-	return fmt.Sprintf("%v %v %v", m.Key, j, m.Destination)
+	k := m.Key
+	switch m.Type {
+	case PrefixMapping:
+		k += "*"
+
+	case RegexpMapping:
+		k = "~" + k
+	}
+
+	return fmt.Sprintf("%v %v %v", k, j, m.Destination)
 }
 
 func (m *Mapping) Validate() error {
@@ -42,17 +108,124 @@ func (m *Mapping) Validate() error {
 		return KeyMissingError
 	}
 
-	if m.Destination == "" {
+	if m.Status != 0 {
+		ok := false
+		for _, code := range mappingStatusCodes {
+			if m.Status == code {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return UnsupportedStatusError
+		}
+	}
+
+	if m.Destination == "" && m.Status != http.StatusGone {
 		return DestinationMissingError
 	}
 
-	if strings.Contains(m.Destination, "{{") {
-		m.IsTemplate = true
+	if err := m.Query.Validate(); err != nil {
+		return err
+	}
+
+	if m.NotBefore != nil && m.NotAfter != nil && !m.NotAfter.After(*m.NotBefore) {
+		return InvalidActiveWindowError
 	}
 
+	switch m.Type {
+	case ExactMapping, PrefixMapping:
+	case RegexpMapping:
+		if _, err := m.Regexp(); err != nil {
+			return err
+		}
+
+	case "exact":
+		m.Type = ExactMapping
+
+	default:
+		return UnknownMappingTypeError
+	}
+
+	m.IsTemplate = strings.Contains(m.Destination, "{{")
+
 	return nil
 }
 
+// Active returns true if the mapping is within its activation window at the
+// given time.
+func (m *Mapping) Active(t time.Time) bool {
+	if m.NotBefore != nil && t.Before(*m.NotBefore) {
+		return false
+	}
+
+	return !m.Expired(t)
+}
+
+// Expired returns true if the activation window of the mapping has ended at
+// the given time.
+func (m *Mapping) Expired(t time.Time) bool {
+	return m.NotAfter != nil && t.After(*m.NotAfter)
+}
+
+// StatusCode returns the HTTP status code for redirects of this mapping. If no
+// explicit status is set, Permanent selects between 308 and 307, which
+// preserves the behavior of documents and records created before Status was
+// introduced.
+func (m *Mapping) StatusCode() int {
+	if m.Status != 0 {
+		return m.Status
+	}
+
+	if m.Permanent {
+		return http.StatusPermanentRedirect
+	}
+
+	return http.StatusTemporaryRedirect
+}
+
+// Regexp returns the compiled regular expression of a regexp mapping key.
+func (m *Mapping) Regexp() (*regexp.Regexp, error) {
+	mappingRegexpsMutex.Lock()
+	defer mappingRegexpsMutex.Unlock()
+	if re, ok := mappingRegexps[m.Key]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(m.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	mappingRegexps[m.Key] = re
+	return re, nil
+}
+
+// MatchRegexp matches the given request key against the key of a regexp
+// mapping. If the key matches, all capture groups are added to the given
+// ViewBag. Numbered groups are available as a slice named "Match" and named
+// groups are also added by name.
+func (m *Mapping) MatchRegexp(key string, vb ViewBag) (bool, error) {
+	re, err := m.Regexp()
+	if err != nil {
+		return false, err
+	}
+
+	match := re.FindStringSubmatch(key)
+	if match == nil {
+		return false, nil
+	}
+
+	vb.Add("Match", match)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			vb.Add(name, match[i])
+		}
+	}
+
+	return true, nil
+}
+
 // ComputeDestination expands any templated fields in the mapping destination
 // URL.
 //
@@ -63,10 +236,11 @@ func (m *Mapping) ComputeDestination(vb ViewBag) (string, error) {
 		return "", DestinationNotTemplateError
 	}
 
-	// get template
+	// get template, cached by destination as mappings in different host
+	// namespaces may share a key
 	tmpl, err := func(m *Mapping) (*template.Template, error) {
 		mappingTemplatesMutex.Lock()
-		if tmpl, ok := mappingTemplates[m.Key]; ok {
+		if tmpl, ok := mappingTemplates[m.Destination]; ok {
 			mappingTemplatesMutex.Unlock()
 			return tmpl, nil
 		}
@@ -76,7 +250,7 @@ func (m *Mapping) ComputeDestination(vb ViewBag) (string, error) {
 			return nil, err
 		} else {
 			mappingTemplatesMutex.Lock()
-			mappingTemplates[m.Key] = tmpl
+			mappingTemplates[m.Destination] = tmpl
 			mappingTemplatesMutex.Unlock()
 			return tmpl, nil
 		}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
 	"testing"
 )
 
@@ -45,3 +47,77 @@ func TestDestinationTemplate(t *testing.T) {
 		t.Fatalf("Expected destination '%v', got '%v'", expect, dest)
 	}
 }
+
+func TestRegexpMappingValidation(t *testing.T) {
+	m := &Mapping{
+		Key:         "^/products/([0-9]+",
+		Destination: "/products/{{ index .Match 1 }}",
+		Type:        RegexpMapping,
+	}
+
+	if err := m.Validate(); err == nil {
+		t.Errorf("Expected mapping validation to fail for invalid regexp")
+	}
+
+	m.Key = "^/products/([0-9]+)$"
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Expected validation to pass, got '%v'", err)
+	}
+
+	m.Type = "glob"
+	if err := m.Validate(); err != UnknownMappingTypeError {
+		t.Errorf("Expected mapping validation to fail with %T, got '%v'", UnknownMappingTypeError, err)
+	}
+}
+
+func TestMappingStatus(t *testing.T) {
+	m := &Mapping{
+		Key:         "/test",
+		Destination: "/okay",
+		Status:      http.StatusOK,
+	}
+
+	if err := m.Validate(); err != UnsupportedStatusError {
+		t.Errorf("Expected mapping validation to fail with %T, got '%v'", UnsupportedStatusError, err)
+	}
+
+	m.Status = http.StatusGone
+	m.Destination = ""
+	if err := m.Validate(); err != nil {
+		t.Errorf("Expected validation to pass without destination for status %v, got '%v'", m.Status, err)
+	}
+}
+
+func TestLegacyMappingStatus(t *testing.T) {
+	// mapping records encoded before the introduction of Mapping.Status
+	type legacyMapping struct {
+		Key         string
+		Destination string
+		Permanent   bool
+		Comment     string
+		IsTemplate  bool
+	}
+
+	b, err := marshallGob(&legacyMapping{Key: "/test", Destination: "/okay", Permanent: true})
+	if err != nil {
+		panic(err)
+	}
+
+	m := &Mapping{}
+	if err := UnmarshallBinary(b, m); err != nil {
+		panic(err)
+	}
+
+	if code := m.StatusCode(); code != http.StatusPermanentRedirect {
+		t.Errorf("Expected status %v for legacy record, got %v", http.StatusPermanentRedirect, code)
+	}
+
+	m = &Mapping{}
+	if err := json.Unmarshal([]byte(`{"key": "/test", "dest": "/okay"}`), m); err != nil {
+		panic(err)
+	}
+
+	if code := m.StatusCode(); code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected status %v for legacy document, got %v", http.StatusTemporaryRedirect, code)
+	}
+}
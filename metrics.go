@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+// Most redirects are served in well under a millisecond.
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+// Outcomes of the key builder of a redirect request.
+const (
+	KeyBuilderOK       = "ok"        // candidate keys were built
+	KeyBuilderNotFound = "not_found" // the request has no key, e.g. a missing parameter
+	KeyBuilderError    = "error"
+)
+
+// Metrics records the request and database metrics of a Runtime, which are
+// served in the Prometheus text format by the management listener. A nil
+// *Metrics records nothing.
+type Metrics struct {
+	Requests        *counterVec   // by listener and status code
+	RequestDuration *histogramVec // by listener
+	KeyBuilder      *counterVec   // by outcome
+	LookupDuration  *histogramVec // by database driver
+	TemplateErrors  *counterVec
+
+	mappingsMu sync.Mutex
+	mappings   map[string]int64 // by virtual host, as of the last count
+}
+
+// mappingCountInterval is the time between counts of the mappings of each
+// virtual host. Counting may read every mapping in the database, so scrapes
+// are served the last count instead.
+var mappingCountInterval = time.Minute
+
+// NewMetrics returns a Metrics with all counters at zero.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Requests: newCounterVec(
+			"redirector_http_requests_total",
+			"Number of HTTP requests served, by listener and status code.",
+			"listener", "code"),
+		RequestDuration: newHistogramVec(
+			"redirector_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by listener.",
+			latencyBuckets, "listener"),
+		KeyBuilder: newCounterVec(
+			"redirector_key_builder_results_total",
+			"Number of redirect requests by the outcome of building their mapping keys.",
+			"result"),
+		LookupDuration: newHistogramVec(
+			"redirector_database_lookup_duration_seconds",
+			"Time taken to look up mappings in the database, by driver.",
+			latencyBuckets, "driver"),
+		TemplateErrors: newCounterVec(
+			"redirector_template_errors_total",
+			"Number of destination templates that failed to render."),
+	}
+}
+
+// ObserveRequest records a request served by the named listener.
+func (m *Metrics) ObserveRequest(listener string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if status == 0 {
+		status = http.StatusOK // nothing was written
+	}
+
+	m.Requests.Add(1, listener, strconv.Itoa(status))
+	m.RequestDuration.Observe(d.Seconds(), listener)
+}
+
+// CountMappings counts the mappings of each virtual host in the database of
+// the given runtime.
+func (m *Metrics) CountMappings(rt *Runtime) error {
+	if m == nil {
+		return nil
+	}
+
+	hosts := []string{""}
+	for name := range rt.Config().Hosts {
+		hosts = append(hosts, name)
+	}
+
+	mappings := make(map[string]int64, len(hosts))
+	for _, name := range hosts {
+		db, err := rt.Database.Namespace(name)
+		if err != nil {
+			return err
+		}
+
+		stats, err := db.Stats()
+		if err != nil {
+			return err
+		}
+		mappings[name] = stats.TotalMappings
+	}
+
+	m.mappingsMu.Lock()
+	defer m.mappingsMu.Unlock()
+	m.mappings = mappings
+	return nil
+}
+
+// countMappingsPeriodically calls CountMappings at mappingCountInterval. It
+// blocks indefinitely and should be run in its own goroutine.
+func countMappingsPeriodically(rt *Runtime) {
+	ticker := time.NewTicker(mappingCountInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := rt.Metrics.CountMappings(rt); err != nil {
+			rt.Logger.Errorf("Error counting mappings: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// mappingCounts returns the mappings of each virtual host as of the last
+// count, or nil if they were not counted.
+func (m *Metrics) mappingCounts() map[string]int64 {
+	if m == nil {
+		return nil
+	}
+
+	m.mappingsMu.Lock()
+	defer m.mappingsMu.Unlock()
+	return m.mappings
+}
+
+// ObserveKeyBuilder records the outcome of building the keys of a request.
+func (m *Metrics) ObserveKeyBuilder(result string) {
+	if m == nil {
+		return
+	}
+
+	m.KeyBuilder.Add(1, result)
+}
+
+// ObserveLookup records the time taken by a database lookup.
+func (m *Metrics) ObserveLookup(driver string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.LookupDuration.Observe(d.Seconds(), driver)
+}
+
+// TemplateError records a destination template that failed to render.
+func (m *Metrics) TemplateError() {
+	if m == nil {
+		return
+	}
+
+	m.TemplateErrors.Add(1)
+}
+
+func (m *Metrics) write(w *metricWriter) {
+	if m == nil {
+		return
+	}
+
+	m.Requests.write(w)
+	m.RequestDuration.write(w)
+	m.KeyBuilder.write(w)
+	m.LookupDuration.write(w)
+	m.TemplateErrors.write(w)
+}
+
+// metricWriter writes metrics in the Prometheus text exposition format. The
+// first write error is kept and returned by flush.
+type metricWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newMetricWriter(w io.Writer) *metricWriter {
+	return &metricWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *metricWriter) printf(format string, a ...interface{}) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = fmt.Fprintf(w.w, format, a...)
+}
+
+// header writes the help and type of a metric.
+func (w *metricWriter) header(name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single value of a metric with the given labels.
+func (w *metricWriter) sample(name string, labels, values []string, v float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels, values), formatFloat(v))
+}
+
+func (w *metricWriter) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+
+	return w.err
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the label set of a sample, e.g. {code="200"}.
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelValueReplacer.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// A counterVec is a set of counters of the same metric, partitioned by label
+// values.
+type counterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string][]string
+	counts map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: make(map[string][]string),
+		counts: make(map[string]float64),
+	}
+}
+
+// Add adds v to the counter with the given label values.
+func (c *counterVec) Add(v float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = values
+	}
+	c.counts[key] += v
+}
+
+// Value returns the counter with the given label values.
+func (c *counterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[labelKey(values)]
+}
+
+func (c *counterVec) write(w *metricWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.header(c.Name, c.Help, "counter")
+	if len(c.Labels) == 0 {
+		w.sample(c.Name, nil, nil, c.counts[""])
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		w.sample(c.Name, c.Labels, c.values[key], c.counts[key])
+	}
+}
+
+// histogram is the state of a single histogram of a histogramVec.
+type histogram struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// A histogramVec is a set of histograms of the same metric, partitioned by
+// label values.
+type histogramVec struct {
+	Name    string
+	Help    string
+	Buckets []float64 // upper bounds, in increasing order
+	Labels  []string
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		Name:       name,
+		Help:       help,
+		Buckets:    buckets,
+		Labels:     labels,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// Observe adds a value to the histogram with the given label values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{values: values, counts: make([]uint64, len(h.Buckets))}
+		h.histograms[key] = hist
+	}
+
+	if i := sort.SearchFloat64s(h.Buckets, v); i < len(h.Buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// Count returns the number of values observed by the histogram with the given
+// label values.
+func (h *histogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hist, ok := h.histograms[labelKey(values)]; ok {
+		return hist.count
+	}
+
+	return 0
+}
+
+func (h *histogramVec) write(w *metricWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w.header(h.Name, h.Help, "histogram")
+	labels := append(append([]string{}, h.Labels...), "le")
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.histograms[key]
+		values := append(append([]string{}, hist.values...), "")
+
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += hist.counts[i]
+			values[len(values)-1] = formatFloat(le)
+			w.sample(h.Name+"_bucket", labels, values, float64(cumulative))
+		}
+
+		values[len(values)-1] = "+Inf"
+		w.sample(h.Name+"_bucket", labels, values, float64(hist.count))
+		w.sample(h.Name+"_sum", h.Labels, hist.values, hist.sum)
+		w.sample(h.Name+"_count", h.Labels, hist.values, float64(hist.count))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeRuntimeMetrics writes the Go runtime metrics of the process.
+func writeRuntimeMetrics(w *metricWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauges := []struct {
+		Name  string
+		Help  string
+		Value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(ms.Sys)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse)},
+		{"go_memstats_next_gc_bytes", "Number of heap bytes when the next garbage collection will take place.", float64(ms.NextGC)},
+	}
+
+	for _, g := range gauges {
+		w.header(g.Name, g.Help, "gauge")
+		w.sample(g.Name, nil, nil, g.Value)
+	}
+
+	w.header("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", "counter")
+	w.sample("go_memstats_alloc_bytes_total", nil, nil, float64(ms.TotalAlloc))
+	w.header("go_gc_cycles_total", "Number of completed garbage collection cycles.", "counter")
+	w.sample("go_gc_cycles_total", nil, nil, float64(ms.NumGC))
+	w.header("go_gc_pause_seconds_total", "Total time spent in garbage collection pauses.", "counter")
+	w.sample("go_gc_pause_seconds_total", nil, nil, float64(ms.PauseTotalNs)/1e9)
+
+	w.header("go_info", "Information about the Go environment.", "gauge")
+	w.sample("go_info", []string{"version"}, []string{runtime.Version()}, 1)
+}
+
+// getMetricsHandler writes the metrics of the runtime, the last count of the
+// mappings of each virtual host, cache statistics and Go runtime metrics in the
+// Prometheus text format.
+func (c *mgmtHandler) getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	rt := c.Runtime
+	mappings := rt.Metrics.mappingCounts()
+	hosts := make([]string, 0, len(mappings))
+	for name := range mappings {
+		hosts = append(hosts, name)
+	}
+	sort.Strings(hosts)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := newMetricWriter(w)
+
+	mw.header("redirector_info", "Information about the redirector server.", "gauge")
+	mw.sample("redirector_info", []string{"version", "driver"}, []string{PACKAGE_VERSION, rt.Config().DatabaseDriver}, 1)
+	mw.header("redirector_start_time_seconds", "Start time of the server since the Unix epoch.", "gauge")
+	mw.sample("redirector_start_time_seconds", nil, nil, float64(startTime.UnixNano())/1e9)
+
+	mw.header("redirector_mappings", "Number of mappings in the database, by virtual host.", "gauge")
+	for _, name := range hosts {
+		mw.sample("redirector_mappings", []string{"host"}, []string{name}, float64(mappings[name]))
+	}
+
+	if db, ok := rt.Database.(*CachedDatabase); ok {
+		stats := db.CacheStats()
+		cache := []struct {
+			Name  string
+			Help  string
+			Type  string
+			Value int64
+		}{
+			{"redirector_cache_entries", "Number of lookups in the cache.", "gauge", int64(stats.Size)},
+			{"redirector_cache_hits_total", "Number of lookups answered from the cache.", "counter", stats.Hits},
+			{"redirector_cache_negative_hits_total", "Number of cache hits for mappings cached as missing.", "counter", stats.NegativeHits},
+			{"redirector_cache_misses_total", "Number of lookups passed to the database.", "counter", stats.Misses},
+		}
+
+		for _, m := range cache {
+			mw.header(m.Name, m.Help, m.Type)
+			mw.sample(m.Name, nil, nil, float64(m.Value))
+		}
+	}
+
+	rt.Metrics.write(mw)
+	writeRuntimeMetrics(mw)
+	if err := mw.flush(); err != nil {
+		rt.Logger.Errorf("Error writing metrics: %v", err)
+	}
+}
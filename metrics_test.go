@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "code")
+	c.Add(1, "200")
+	c.Add(2, "200")
+	c.Add(1, `a"b`)
+
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.1, "get")
+	h.Observe(5, "get")
+
+	b := &bytes.Buffer{}
+	w := newMetricWriter(b)
+	c.write(w)
+	h.write(w)
+	if err := w.flush(); err != nil {
+		panic(err)
+	}
+
+	expect := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{code="200"} 3
+test_total{code="a\"b"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="get",le="0.1"} 2
+test_seconds_bucket{op="get",le="1"} 2
+test_seconds_bucket{op="get",le="+Inf"} 3
+test_seconds_sum{op="get"} 5.15
+test_seconds_count{op="get"} 3
+`
+	if b.String() != expect {
+		t.Errorf("Expected metrics:\n%v\ngot:\n%v", expect, b.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		rt.Metrics = NewMetrics()
+		rt.Config().DatabaseDriver = "bolt"
+
+		for _, path := range []string{"/permanent", "/does/not/exist"} {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+			res.Body.Close()
+		}
+
+		if err := rt.Metrics.CountMappings(rt); err != nil {
+			panic(err)
+		}
+
+		w := httptest.NewRecorder()
+		ManagementHandler(rt).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %v, got %v", http.StatusOK, w.Code)
+		}
+
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Errorf("Expected Prometheus text format, got %v", ct)
+		}
+
+		body := w.Body.String()
+		for _, line := range []string{
+			`redirector_http_requests_total{listener="redirect",code="308"} 1`,
+			`redirector_http_requests_total{listener="redirect",code="404"} 1`,
+			`redirector_key_builder_results_total{result="ok"} 2`,
+			`redirector_database_lookup_duration_seconds_bucket{driver="bolt",le="+Inf"} `,
+			`redirector_mappings{host=""} `,
+			`redirector_template_errors_total 0`,
+			`go_goroutines `,
+		} {
+			if !strings.Contains(body, "\n"+line) {
+				t.Errorf("Expected metric %v, got:\n%v", line, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Miss records requests for a key that matched no mapping.
+type Miss struct {
+	Key      string    `json:"key"`
+	Count    int64     `json:"count"`
+	Referer  string    `json:"referer,omitempty"` // most recent referer
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Merge adds the requests recorded in v to m.
+func (m *Miss) Merge(v *Miss) {
+	if !v.LastSeen.Before(m.LastSeen) {
+		m.LastSeen = v.LastSeen
+		if v.Referer != "" {
+			m.Referer = v.Referer
+		}
+	}
+
+	m.Count += v.Count
+}
+
+// sortMisses sorts misses by descending request count and then by key.
+func sortMisses(misses []*Miss) {
+	sort.SliceStable(misses, func(i, j int) bool {
+		if misses[i].Count != misses[j].Count {
+			return misses[i].Count > misses[j].Count
+		}
+		return misses[i].Key < misses[j].Key
+	})
+}
+
+// MissRecorder accumulates missing keys in memory so they may be written to a
+// Database in batches, away from the request path.
+type MissRecorder struct {
+	db    Database
+	max   int
+	mu    sync.Mutex
+	batch map[string]map[string]*Miss // keyed by namespace and key
+}
+
+// NewMissRecorder returns a MissRecorder that retains at most max of the most
+// recently seen missing keys in each namespace of the given database.
+func NewMissRecorder(db Database, max int) *MissRecorder {
+	return &MissRecorder{
+		db:    db,
+		max:   max,
+		batch: make(map[string]map[string]*Miss),
+	}
+}
+
+// Miss records a request for a missing key in the given database namespace at
+// the given time.
+func (c *MissRecorder) Miss(ns, key, referer string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch, ok := c.batch[ns]
+	if !ok {
+		batch = make(map[string]*Miss)
+		c.batch[ns] = batch
+	}
+
+	if m, ok := batch[key]; ok {
+		m.Merge(&Miss{Count: 1, Referer: referer, LastSeen: t})
+		return
+	}
+
+	// bound memory use between flushes
+	if len(batch) >= c.max {
+		return
+	}
+
+	batch[key] = &Miss{
+		Key:      key,
+		Count:    1,
+		Referer:  referer,
+		LastSeen: t,
+	}
+}
+
+// Flush writes all accumulated misses to the database.
+func (c *MissRecorder) Flush() error {
+	c.mu.Lock()
+	batches := c.batch
+	c.batch = make(map[string]map[string]*Miss, len(batches))
+	c.mu.Unlock()
+
+	for ns, batch := range batches {
+		misses := make([]*Miss, 0, len(batch))
+		for _, m := range batch {
+			misses = append(misses, m)
+		}
+
+		db, err := c.db.Namespace(ns)
+		if err != nil {
+			return err
+		}
+
+		if err := db.AddMisses(misses, c.max); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
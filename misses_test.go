@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMissRecorder(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		rt.Misses = NewMissRecorder(rt.Database, 10)
+		for _, path := range []string{"/missing", "/temporary", "/missing", "/also/missing"} {
+			req, err := http.NewRequest("GET", ts.URL+path, nil)
+			if err != nil {
+				panic(err)
+			}
+			req.Header.Set("Referer", "http://referer.test"+path)
+
+			if _, err := testHttpClient().Do(req); err != nil {
+				panic(err)
+			}
+		}
+
+		if err := rt.Misses.Flush(); err != nil {
+			panic(err)
+		}
+
+		misses, err := rt.Database.GetMisses(0)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(misses) != 2 {
+			t.Fatalf("Expected 2 missing keys, got %v", len(misses))
+		}
+
+		if misses[0].Key != "/missing" || misses[0].Count != 2 {
+			t.Errorf("Expected /missing with count 2, got %v with count %v", misses[0].Key, misses[0].Count)
+		}
+
+		if expect := "http://referer.test/missing"; misses[0].Referer != expect {
+			t.Errorf("Expected referer %v, got %v", expect, misses[0].Referer)
+		}
+	})
+}
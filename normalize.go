@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// KeyNormalization configures the canonical form of mapping keys. Request keys
+// are normalized by the configured KeyBuilders and mapping keys are normalized
+// when mappings are stored, so that equivalent keys match.
+type KeyNormalization struct {
+	Lowercase          bool `json:"lowercase"`          // fold keys to lower case
+	StripTrailingSlash bool `json:"stripTrailingSlash"` // remove trailing slashes
+	CollapseSlashes    bool `json:"collapseSlashes"`    // replace repeated slashes with a single slash
+	Decode             bool `json:"decode"`             // percent-decode keys
+}
+
+// Enabled returns true if any normalization option is set.
+func (n KeyNormalization) Enabled() bool {
+	return n.Lowercase || n.StripTrailingSlash || n.CollapseSlashes || n.Decode
+}
+
+// Key returns the normalized form of the given request key.
+func (n KeyNormalization) Key(key string) string {
+	return n.key(key, n.StripTrailingSlash)
+}
+
+// key returns the normalized form of the given key, optionally stripping
+// trailing slashes.
+func (n KeyNormalization) key(key string, stripTrailingSlash bool) string {
+	if n.Decode {
+		if s, err := url.PathUnescape(key); err == nil {
+			key = s
+		}
+	}
+
+	if n.CollapseSlashes {
+		for strings.Contains(key, "//") {
+			key = strings.Replace(key, "//", "/", -1)
+		}
+	}
+
+	if stripTrailingSlash {
+		if s := strings.TrimRight(key, "/"); s != "" {
+			key = s
+		} else if key != "" {
+			key = "/"
+		}
+	}
+
+	if n.Lowercase {
+		key = strings.ToLower(key)
+	}
+
+	return key
+}
+
+// MappingKey returns the normalized key of the given mapping. Trailing slashes
+// are significant in prefix mappings and are not stripped. Regexp mapping keys
+// are not normalized.
+func (n KeyNormalization) MappingKey(m *Mapping) string {
+	switch m.Type {
+	case RegexpMapping:
+		return m.Key
+
+	case PrefixMapping:
+		return n.key(m.Key, false)
+	}
+
+	return n.Key(m.Key)
+}
+
+// LookupKeys returns the keys that a mapping given by the unnormalized key may
+// be stored with, in order: the key itself, its normalized form as a prefix
+// mapping key and its normalized form as an exact mapping key.
+func (n KeyNormalization) LookupKeys(key string) []string {
+	keys := []string{key}
+	for _, k := range []string{n.key(key, false), n.Key(key)} {
+		if k != keys[len(keys)-1] {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// normalizedKeyBuilder is a MultiKeyBuilder that normalizes the keys of
+// another KeyBuilder.
+type normalizedKeyBuilder struct {
+	kb KeyBuilder
+	n  KeyNormalization
+}
+
+// NormalizedKeyBuilder returns a KeyBuilder that normalizes all keys returned
+// by the given KeyBuilder.
+func NormalizedKeyBuilder(kb KeyBuilder, n KeyNormalization) KeyBuilder {
+	return &normalizedKeyBuilder{kb: kb, n: n}
+}
+
+func (c *normalizedKeyBuilder) Parse(r *http.Request) (string, error) {
+	key, err := c.kb.Parse(r)
+	if err != nil {
+		return "", err
+	}
+
+	return c.n.Key(key), nil
+}
+
+func (c *normalizedKeyBuilder) ParseAll(r *http.Request) ([]string, error) {
+	keys, err := parseKeys(c.kb, r)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]string, len(keys))
+	for i, key := range keys {
+		v[i] = c.n.Key(key)
+	}
+
+	return v, nil
+}
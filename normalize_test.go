@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyNormalization(t *testing.T) {
+	n := KeyNormalization{
+		Lowercase:          true,
+		StripTrailingSlash: true,
+		CollapseSlashes:    true,
+		Decode:             true,
+	}
+
+	tests := map[string]string{
+		"":                 "",
+		"/":                "/",
+		"//":               "/",
+		"/promo":           "/promo",
+		"/Promo/":          "/promo",
+		"/promo//":         "/promo",
+		"//some///Path//":  "/some/path",
+		"/caf%C3%A9":       "/café",
+		"/%50romo%2F":      "/promo",
+		"/bad%zzescape/":   "/bad%zzescape",
+		"http://A.test//b": "http:/a.test/b",
+	}
+	for key, expect := range tests {
+		if v := n.Key(key); v != expect {
+			t.Errorf("Expected key '%v' to normalize to '%v', got '%v'", key, expect, v)
+		}
+	}
+
+	if v := (KeyNormalization{}).Key("//Some/Path/"); v != "//Some/Path/" {
+		t.Errorf("Expected key to be unmodified without normalization, got '%v'", v)
+	}
+
+	mappings := map[*Mapping]string{
+		{Key: "/Exact/"}:                          "/exact",
+		{Key: "/Prefix//", Type: PrefixMapping}:   "/prefix/",
+		{Key: "^/Regexp//$", Type: RegexpMapping}: "^/Regexp//$",
+	}
+	for m, expect := range mappings {
+		if v := n.MappingKey(m); v != expect {
+			t.Errorf("Expected %v mapping key '%v' to normalize to '%v', got '%v'", m.Type, m.Key, expect, v)
+		}
+	}
+
+	if v := n.LookupKeys("/Some//Path/"); len(v) != 3 || v[0] != "/Some//Path/" || v[1] != "/some/path/" || v[2] != "/some/path" {
+		t.Errorf("Unexpected lookup keys for '/Some//Path/': %v", v)
+	}
+
+	if v := n.LookupKeys("/path"); len(v) != 1 {
+		t.Errorf("Expected only the given lookup key for a normalized key, got %v", v)
+	}
+}
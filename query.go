@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// QueryPolicy determines how the query string of a request is passed through
+// to the destination URL of a redirect.
+type QueryPolicy string
+
+const (
+	// QueryDefault defers to the server-wide query policy.
+	QueryDefault QueryPolicy = ""
+
+	// QueryDrop discards the request query string.
+	QueryDrop QueryPolicy = "drop"
+
+	// QueryAppend appends all request query parameters to the destination
+	// query string, including any parameters that already exist in the
+	// destination.
+	QueryAppend QueryPolicy = "append"
+
+	// QueryMerge adds request query parameters to the destination query
+	// string, unless the destination already defines a parameter with the same
+	// name.
+	QueryMerge QueryPolicy = "merge"
+
+	// QueryOverride adds request query parameters to the destination query
+	// string, replacing any destination parameters with the same name.
+	QueryOverride QueryPolicy = "override"
+)
+
+var UnknownQueryPolicyError = fmt.Errorf("Unknown query policy")
+
+// Validate returns UnknownQueryPolicyError if p is not a known query policy.
+func (p QueryPolicy) Validate() error {
+	switch p {
+	case QueryDefault, QueryDrop, QueryAppend, QueryMerge, QueryOverride:
+		return nil
+	}
+
+	return UnknownQueryPolicyError
+}
+
+// queryParam is a single, raw "key=value" query parameter and its decoded
+// name.
+type queryParam struct {
+	Name string
+	Raw  string
+}
+
+// parseQuery splits a raw query string into its parameters, preserving order,
+// duplicates and the original encoding of each parameter.
+func parseQuery(query string) []queryParam {
+	params := make([]queryParam, 0)
+	for _, raw := range strings.FieldsFunc(query, func(r rune) bool {
+		return r == '&' || r == ';'
+	}) {
+		name := raw
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if s, err := url.QueryUnescape(name); err == nil {
+			name = s
+		}
+
+		params = append(params, queryParam{Name: name, Raw: raw})
+	}
+
+	return params
+}
+
+// Apply returns the given destination URL with the given raw request query
+// string applied according to the policy. Any existing query string or
+// fragment in the destination is preserved.
+func (p QueryPolicy) Apply(dest, query string) string {
+	if query == "" || p == QueryDefault || p == QueryDrop {
+		return dest
+	}
+
+	fragment := ""
+	if i := strings.Index(dest, "#"); i >= 0 {
+		dest, fragment = dest[:i], dest[i:]
+	}
+
+	destQuery := ""
+	if i := strings.Index(dest, "?"); i >= 0 {
+		dest, destQuery = dest[:i], dest[i+1:]
+	}
+
+	destParams := parseQuery(destQuery)
+	reqParams := parseQuery(query)
+	names := func(params []queryParam) map[string]bool {
+		v := make(map[string]bool, len(params))
+		for _, param := range params {
+			v[param.Name] = true
+		}
+		return v
+	}
+
+	params := make([]queryParam, 0, len(destParams)+len(reqParams))
+	switch p {
+	case QueryAppend:
+		params = append(params, destParams...)
+		params = append(params, reqParams...)
+
+	case QueryMerge:
+		params = append(params, destParams...)
+		existing := names(destParams)
+		for _, param := range reqParams {
+			if !existing[param.Name] {
+				params = append(params, param)
+			}
+		}
+
+	case QueryOverride:
+		replaced := names(reqParams)
+		for _, param := range destParams {
+			if !replaced[param.Name] {
+				params = append(params, param)
+			}
+		}
+		params = append(params, reqParams...)
+	}
+
+	raw := make([]string, len(params))
+	for i, param := range params {
+		raw[i] = param.Raw
+	}
+
+	if len(raw) > 0 {
+		dest += "?" + strings.Join(raw, "&")
+	}
+
+	return dest + fragment
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	tests := []struct {
+		Policy QueryPolicy
+		Dest   string
+		Query  string
+		Expect string
+	}{
+		{QueryDefault, "/okay", "a=1", "/okay"},
+		{QueryDrop, "/okay?b=2", "a=1", "/okay?b=2"},
+		{QueryAppend, "/okay", "", "/okay"},
+		{QueryAppend, "/okay", "a=1&a=2", "/okay?a=1&a=2"},
+		{QueryAppend, "/okay?a=0", "a=1", "/okay?a=0&a=1"},
+		{QueryAppend, "/okay?b=2#top", "a=1", "/okay?b=2&a=1#top"},
+		{QueryAppend, "/okay#top", "a=1", "/okay?a=1#top"},
+		{QueryMerge, "/okay?a=0&b=2", "a=1&c=3&c=4", "/okay?a=0&b=2&c=3&c=4"},
+		{QueryMerge, "/okay?a%20b=0", "a+b=1", "/okay?a%20b=0"},
+		{QueryMerge, "/okay?#top", "a=1", "/okay?a=1#top"},
+		{QueryOverride, "/okay?a=0&b=2", "a=1&a=2&c=3", "/okay?b=2&a=1&a=2&c=3"},
+		{QueryOverride, "http://test.local/?a=0#x?y", "a=1", "http://test.local/?a=1#x?y"},
+	}
+
+	for _, test := range tests {
+		if err := test.Policy.Validate(); err != nil {
+			panic(err)
+		}
+
+		dest := test.Policy.Apply(test.Dest, test.Query)
+		if dest != test.Expect {
+			t.Errorf("Expected %v query policy to produce '%v' for '%v' and '%v', got '%v'", test.Policy, test.Expect, test.Dest, test.Query, dest)
+		}
+	}
+
+	if err := QueryPolicy("keep").Validate(); err != UnknownQueryPolicyError {
+		t.Errorf("Expected query policy validation to fail with %T, got '%v'", UnknownQueryPolicyError, err)
+	}
+}
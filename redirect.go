@@ -3,23 +3,165 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
-// getMappingOrDefault returns the requested mapping or the mapping for the
-// default key or MappingNotFoundError if neither are found.
-func getMappingOrDefault(rt *Runtime, key string) (*Mapping, error) {
-	keys := make([]string, 0, 2)
+// getMappingOrDefault returns the mapping for the first of the given
+// candidate keys that has a mapping, or the mapping for the default key or
+// MappingNotFoundError if none are found.
+//
+// For each candidate key, mappings are matched in the following order:
+//
+//  1. exact mapping for the request key
+//  2. first regexp mapping that matches the request key, ordered by ascending
+//     priority and then key
+//  3. prefix mapping with the longest key that prefixes the request key
+//
+// If no candidate key matches, the exact mapping for the default key is
+// returned.
+//
+// Mappings outside of their activation window are skipped, unless the mapping
+// has expired and the given configuration returns 410 Gone for expired
+// mappings.
+//
+// Mappings are read from the database namespace of the given host
+// configuration.
+//
+// The matching candidate key and any values extracted from it, such as regexp
+// capture groups or the unmatched suffix of a prefix mapping, are added to the
+// given ViewBag.
+func getMappingOrDefault(rt *Runtime, cfg *Config, hc *HostConfig, keys []string, vb ViewBag) (*Mapping, error) {
+	vb.Add("Suffix", "")
 
-	if key != "" {
-		keys = append(keys, key)
+	db, err := rt.Database.Namespace(hc.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	if rt.Config.DefaultKey != "" {
-		keys = append(keys, rt.Config.DefaultKey)
+	// with goneOnExpiry, the first matching mapping that expired returns 410
+	// if no active mapping matches
+	now := time.Now()
+	var gone *Mapping
+	active := func(m *Mapping) bool {
+		if m.Active(now) {
+			return true
+		}
+
+		if cfg.GoneOnExpiry && gone == nil && m.Expired(now) {
+			gone = m
+		}
+
+		return false
+	}
+
+	// regexp mappings are read once for all candidate keys
+	var regexps []*Mapping
+	regexpsRead := false
+	lookups := make([]func() (*Mapping, error), 0, 3*len(keys)+2)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		key := key
+		lookups = append(lookups, func() (*Mapping, error) {
+			m, err := db.GetMapping(key)
+			if err == nil && !active(m) {
+				return nil, MappingNotFoundError
+			}
+			if err == nil {
+				vb.Add("Key", key)
+			}
+			return m, err
+		})
+
+		lookups = append(lookups, func() (*Mapping, error) {
+			if !regexpsRead {
+				mappings, err := db.GetRegexpMappings()
+				if err != nil {
+					return nil, err
+				}
+				regexps = mappings
+				regexpsRead = true
+			}
+
+			for _, m := range regexps {
+				re, err := m.Regexp()
+				if err != nil {
+					return nil, err
+				}
+
+				if !re.MatchString(key) || !active(m) {
+					continue
+				}
+
+				if ok, err := m.MatchRegexp(key, vb); err != nil {
+					return nil, err
+				} else if ok {
+					vb.Add("Key", key)
+					return m, nil
+				}
+			}
+
+			return nil, MappingNotFoundError
+		})
+
+		lookups = append(lookups, func() (*Mapping, error) {
+			// with stripTrailingSlash, the root of a prefix mapping has lost the
+			// trailing slash of the mapping key
+			k := key
+			if cfg.Normalize.StripTrailingSlash && !strings.HasSuffix(k, "/") {
+				k += "/"
+			}
+
+			// shorter prefixes of key are all prefixes of an inactive mapping
+			// key, less its last byte
+			for k != "" {
+				m, err := db.GetPrefixMapping(k)
+				if err != nil {
+					return nil, err
+				}
+
+				if active(m) {
+					suffix := ""
+					if len(m.Key) < len(key) {
+						suffix = key[len(m.Key):]
+					}
+
+					vb.Add("Key", key)
+					vb.Add("Suffix", suffix)
+					return m, nil
+				}
+
+				k = m.Key[:len(m.Key)-1]
+			}
+
+			return nil, MappingNotFoundError
+		})
+	}
+
+	lookups = append(lookups, func() (*Mapping, error) {
+		if gone != nil {
+			panic(NewHTTPErrorf(http.StatusGone, "Mapping expired: %v", gone.Key))
+		}
+		return nil, MappingNotFoundError
+	})
+
+	if hc.DefaultKey != "" {
+		lookups = append(lookups, func() (*Mapping, error) {
+			m, err := db.GetMapping(hc.DefaultKey)
+			if err == nil && !active(m) {
+				return nil, MappingNotFoundError
+			}
+			return m, err
+		})
 	}
 
-	for _, k := range keys {
-		m, err := rt.Database.GetMapping(k)
+	for _, lookup := range lookups {
+		start := time.Now()
+		m, err := lookup()
+		rt.Metrics.ObserveLookup(cfg.DatabaseDriver, time.Since(start))
 		if err == nil {
 			if err := m.Validate(); err != nil {
 				return nil, err
@@ -36,42 +178,81 @@ func getMappingOrDefault(rt *Runtime, key string) (*Mapping, error) {
 }
 
 func RedirectHandler(rt *Runtime) http.Handler {
-	return WrapHandler(rt, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key, err := rt.Config.KeyBuilder.Parse(r)
+	return WrapHandler(rt, "redirect", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := rt.Config()
+		hc := cfg.ForHost(r.Host)
+		keys, err := parseKeys(hc.KeyBuilder, r)
 		if err != nil {
 			if status := StatusCodeForError(err); status >= 500 {
+				rt.Metrics.ObserveKeyBuilder(KeyBuilderError)
 				panic(err)
 			}
+			rt.Metrics.ObserveKeyBuilder(KeyBuilderNotFound)
+		} else {
+			rt.Metrics.ObserveKeyBuilder(KeyBuilderOK)
 		}
 
-		m, err := getMappingOrDefault(rt, key)
+		key := ""
+		if len(keys) > 0 {
+			key = keys[0]
+		}
+
+		vb := NewViewBag()
+		for k, v := range hc.ViewBag {
+			vb.Add(k, v)
+		}
+		vb.Add("Key", key)
+		vb.Add("Request", r)
+
+		m, err := getMappingOrDefault(rt, cfg, hc, keys, vb)
 		if err != nil {
+			if rt.Misses != nil && key != "" && StatusCodeForError(err) == http.StatusNotFound {
+				rt.Misses.Miss(hc.Name, key, r.Referer(), time.Now())
+			}
 			panic(err)
 		}
 
-		status := http.StatusTemporaryRedirect
-		if m.Permanent {
-			status = http.StatusPermanentRedirect
+		if rt.Hits != nil {
+			rt.Hits.Hit(hc.Name, m.Key, time.Now())
+		}
+
+		entry := requestAccessLogEntry(r)
+		entry.Key = key
+		entry.Mapping = m.Key
+		entry.MappingType = mappingType(m, hc, keys)
+
+		status := m.StatusCode()
+		if status == http.StatusGone {
+			body, err := BodyForStatus(status)
+			if err != nil {
+				panic(err)
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, body)
+			return
 		}
 
 		dest := m.Destination
 		if m.IsTemplate {
-			vb := NewViewBag()
-			for k, v := range rt.Config.ViewBag {
-				vb.Add(k, v)
-			}
-			vb.Add("Key", key)
-			vb.Add("Request", r)
 			if d, err := m.ComputeDestination(vb); err != nil {
+				rt.Metrics.TemplateError()
 				panic(err)
 			} else {
 				dest = d
 			}
 		}
-		if rt.Config.DestinationPrefix != "" {
-			dest = rt.Config.DestinationPrefix + dest
+		if hc.DestinationPrefix != "" {
+			dest = hc.DestinationPrefix + dest
 		}
 
+		policy := m.Query
+		if policy == QueryDefault {
+			policy = hc.QueryPolicy
+		}
+		dest = policy.Apply(dest, r.URL.RawQuery)
+
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Header().Set("Location", dest)
 		w.WriteHeader(status)
@@ -85,12 +266,21 @@ func RedirectHandler(rt *Runtime) http.Handler {
 	}))
 }
 
-func serve(rt *Runtime) error {
+func serve(rt *Runtime, g *ServerGroup) error {
+	cfg := rt.Config()
 	s := &http.Server{
-		Addr:    rt.Config.ListenAddr,
+		Addr:    cfg.ListenAddr,
 		Handler: RedirectHandler(rt),
 	}
 
-	rt.Logger.Printf("Listening for redirect requests on %v", rt.Config.ListenAddr)
-	return s.ListenAndServe()
+	if cfg.SweepInterval.Duration > 0 {
+		g.Go(sweepMappings)
+	}
+
+	if cfg.StatsFlushInterval.Duration > 0 {
+		g.Go(flushStatsPeriodically)
+	}
+
+	rt.Logger.Infof("Listening for redirect requests on %v", cfg.ListenAddr)
+	return g.Listen("redirect", s, cfg.TLS, cfg.Hosts)
 }
@@ -2,12 +2,12 @@ package main
 
 import (
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // returns a http.Client that does not follow redirects
@@ -28,15 +28,15 @@ func testRedirectServer(fn func(*Runtime, *httptest.Server)) {
 		}
 
 		rt := &Runtime{
-			Config: &Config{
-				ExitOnError: true,
-				KeyBuilder:  RequestURIPathKeyBuilder(),
-				ViewBag:     NewViewBag(),
-			},
 			Database:     db,
-			Logger:       log.New(ioutil.Discard, "", 0),
-			AccessLogger: log.New(ioutil.Discard, "", 0),
+			Logger:       newLogger(ioutil.Discard, TextLog, InfoLevel),
+			AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
 		}
+		rt.SetConfig(&Config{
+			ExitOnError: true,
+			KeyBuilder:  RequestURIPathKeyBuilder(),
+			ViewBag:     NewViewBag(),
+		})
 		InitTemplates()
 
 		ts := httptest.NewServer(RedirectHandler(rt))
@@ -97,6 +97,121 @@ func TestTemporaryKey(t *testing.T) {
 	})
 }
 
+func TestStatusKey(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		res, err := testHttpClient().Get(ts.URL + "/found")
+		if err != nil {
+			panic(err)
+		}
+
+		if res.StatusCode != http.StatusFound {
+			t.Fatalf("Expected mapping with status %v, got %v", http.StatusFound, res.StatusCode)
+		}
+
+		if loc := res.Header.Get("Location"); loc != "/okay" {
+			t.Fatalf("Expected mapping to '%v', got '%v'", "/okay", loc)
+		}
+
+		res, err = testHttpClient().Get(ts.URL + "/gone")
+		if err != nil {
+			panic(err)
+		}
+
+		if res.StatusCode != http.StatusGone {
+			t.Fatalf("Expected mapping with status %v, got %v", http.StatusGone, res.StatusCode)
+		}
+
+		if loc := res.Header.Get("Location"); loc != "" {
+			t.Fatalf("Expected no Location header for status %v, got '%v'", http.StatusGone, loc)
+		}
+	})
+}
+
+func TestActiveWindow(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		past := time.Now().Add(-time.Hour)
+		future := time.Now().Add(time.Hour)
+		mappings := []*Mapping{
+			{Key: "/future", Destination: "/future", NotBefore: &future},
+			{Key: "/expired", Destination: "/expired", NotAfter: &past},
+			{Key: "/active", Destination: "/active", NotBefore: &past, NotAfter: &future},
+			{Key: "/prefix/expired", Destination: "/expired", Type: PrefixMapping, NotAfter: &past},
+		}
+		for _, m := range mappings {
+			if err := rt.Database.AddMapping(m); err != nil {
+				panic(err)
+			}
+		}
+
+		rt.Config().DefaultKey = "default"
+		tests := map[string]string{
+			"/future":           "/okay",
+			"/expired":          "/okay",
+			"/active":           "/active",
+			"/prefix/expired/a": "/prefixed/expired/a",
+		}
+		for path, expect := range tests {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+
+			if loc := res.Header.Get("Location"); loc != expect {
+				t.Errorf("Expected mapping for '%v' to '%v', got '%v'", path, expect, loc)
+			}
+		}
+
+		rt.Config().GoneOnExpiry = true
+		res, err := testHttpClient().Get(ts.URL + "/expired")
+		if err != nil {
+			panic(err)
+		}
+
+		if res.StatusCode != http.StatusGone {
+			t.Fatalf("Expected expired mapping with status %v, got %v", http.StatusGone, res.StatusCode)
+		}
+	})
+}
+
+func TestGoneOnExpiryFallthrough(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		past := time.Now().Add(-time.Hour)
+		mappings := []*Mapping{
+			{Key: "^/old/.*", Destination: "/old", Type: RegexpMapping, NotAfter: &past},
+			{Key: "/docs/", Destination: "/docs", Type: PrefixMapping},
+			{Key: "/docs/intro/", Destination: "/expired", Type: PrefixMapping, NotAfter: &past},
+			{Key: "^/docs/.*", Destination: "/expired", Type: RegexpMapping, NotAfter: &past},
+		}
+		for _, m := range mappings {
+			if err := rt.Database.AddMapping(m); err != nil {
+				panic(err)
+			}
+		}
+
+		rt.Config().GoneOnExpiry = true
+		tests := []struct {
+			Path     string
+			Status   int
+			Location string
+		}{
+			{"/docs/intro/page", http.StatusTemporaryRedirect, "/docs"},
+			{"/old/page", http.StatusGone, ""},
+			{"/does/not/exist", http.StatusNotFound, ""},
+		}
+		for _, test := range tests {
+			res, err := testHttpClient().Get(ts.URL + test.Path)
+			if err != nil {
+				panic(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.Status || res.Header.Get("Location") != test.Location {
+				t.Errorf("Expected %v to return %v '%v', got %v '%v'", test.Path, test.Status, test.Location, res.StatusCode, res.Header.Get("Location"))
+			}
+		}
+	})
+}
+
 func TestTemplatedKey(t *testing.T) {
 	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
 		dest := "/?key=/template"
@@ -114,7 +229,7 @@ func TestTemplatedKey(t *testing.T) {
 
 func TestViewBag(t *testing.T) {
 	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
-		rt.Config.ViewBag.Add("Foo", "Bar")
+		rt.Config().ViewBag.Add("Foo", "Bar")
 		expect := "/?Foo=Bar"
 		res, err := testHttpClient().Get(ts.URL + "/viewbag")
 		if err != nil {
@@ -127,9 +242,75 @@ func TestViewBag(t *testing.T) {
 	})
 }
 
+func TestPrefixKey(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		tests := map[string]string{
+			"/prefix":            "/prefixed",
+			"/prefix/some/path":  "/prefixed/some/path",
+			"/prefix/longer":     "/longer",
+			"/prefix/longer/a/b": "/longer/a/b",
+			"/prefix/long/path":  "/prefixed/long/path",
+		}
+
+		for path, expect := range tests {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+
+			loc := res.Header.Get("Location")
+			if loc != expect {
+				t.Errorf("Expected mapping for '%v' to '%v', got '%v'", path, expect, loc)
+			}
+		}
+
+		res, err := testHttpClient().Get(ts.URL + "/prefi")
+		if err != nil {
+			panic(err)
+		}
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected missing mapping with status %v, got %v", http.StatusNotFound, res.StatusCode)
+		}
+	})
+}
+
+func TestRegexpKey(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		tests := map[string]string{
+			"/products/123":   "/p/123",
+			"/items/abc/123":  "/i/123/abc",
+			"/items/abc/def":  "/items",
+			"/prefix/regexp":  "/regexp",
+			"/prefix/regexp2": "/prefixed/regexp2",
+		}
+
+		for path, expect := range tests {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+
+			loc := res.Header.Get("Location")
+			if loc != expect {
+				t.Errorf("Expected mapping for '%v' to '%v', got '%v'", path, expect, loc)
+			}
+		}
+
+		res, err := testHttpClient().Get(ts.URL + "/products/abc")
+		if err != nil {
+			panic(err)
+		}
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected missing mapping with status %v, got %v", http.StatusNotFound, res.StatusCode)
+		}
+	})
+}
+
 func TestDestinationPrefix(t *testing.T) {
 	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
-		rt.Config.DestinationPrefix = "http://test.local"
+		rt.Config().DestinationPrefix = "http://test.local"
 		dest := "http://test.local/okay"
 		res, err := testHttpClient().Get(ts.URL + "/temporary")
 		if err != nil {
@@ -143,11 +324,47 @@ func TestDestinationPrefix(t *testing.T) {
 	})
 }
 
+func TestQueryPolicyDefault(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		expect := "/okay"
+		res, err := testHttpClient().Get(ts.URL + "/temporary?utm_source=x")
+		if err != nil {
+			panic(err)
+		}
+
+		if loc := res.Header.Get("Location"); loc != expect {
+			t.Fatalf("Expected mapping to '%v', got '%v'", expect, loc)
+		}
+
+		rt.Config().QueryPolicy = QueryAppend
+		expect = "/okay?utm_source=x"
+		res, err = testHttpClient().Get(ts.URL + "/temporary?utm_source=x")
+		if err != nil {
+			panic(err)
+		}
+
+		if loc := res.Header.Get("Location"); loc != expect {
+			t.Fatalf("Expected mapping to '%v', got '%v'", expect, loc)
+		}
+
+		// mapping policy takes precedence
+		expect = "/okay?b=0&a=1&c=2"
+		res, err = testHttpClient().Get(ts.URL + "/query?a=1&c=2")
+		if err != nil {
+			panic(err)
+		}
+
+		if loc := res.Header.Get("Location"); loc != expect {
+			t.Fatalf("Expected mapping to '%v', got '%v'", expect, loc)
+		}
+	})
+}
+
 func TestDefaultKey(t *testing.T) {
 	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
 		dest := "/okay"
-		rt.Config.DefaultKey = "default"
-		rt.Config.KeyBuilder = RequestURIPathKeyBuilder()
+		rt.Config().DefaultKey = "default"
+		rt.Config().KeyBuilder = RequestURIPathKeyBuilder()
 
 		// test non-existant mapping
 		res, err := testHttpClient().Get(ts.URL + "/does/not/exist")
@@ -166,6 +383,10 @@ func TestDefaultKey(t *testing.T) {
 
 		// test existing mapping still works
 		for _, m := range testMappings {
+			if m.Type == RegexpMapping {
+				continue
+			}
+
 			u, _ := url.Parse(ts.URL)
 			u.Path = filepath.Join(u.Path, m.Key)
 			res, err = testHttpClient().Get(u.String())
@@ -186,3 +407,127 @@ func TestDefaultKey(t *testing.T) {
 		}
 	})
 }
+
+func TestVirtualHost(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		rt.Config().Hosts = HostConfigs{
+			"*.example.test": {
+				DefaultKey:        "default",
+				DestinationPrefix: "http://example.test",
+			},
+		}
+		if err := rt.Config().initializeHosts(); err != nil {
+			panic(err)
+		}
+
+		db, err := rt.Database.Namespace("*.example.test")
+		if err != nil {
+			panic(err)
+		}
+
+		for _, m := range []*Mapping{
+			{Key: "/temporary", Destination: "/virtual"},
+			{Key: "default", Destination: "/home"},
+		} {
+			if err := db.AddMapping(m); err != nil {
+				panic(err)
+			}
+		}
+
+		tests := []struct {
+			Host   string
+			Path   string
+			Expect string
+		}{
+			{"www.example.test", "/temporary", "http://example.test/virtual"},
+			{"www.example.test", "/permanent", "http://example.test/home"},
+			{"other.test", "/temporary", "/okay"},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest("GET", ts.URL+test.Path, nil)
+			if err != nil {
+				panic(err)
+			}
+			req.Host = test.Host
+
+			res, err := testHttpClient().Do(req)
+			if err != nil {
+				panic(err)
+			}
+
+			if loc := res.Header.Get("Location"); loc != test.Expect {
+				t.Errorf("Expected %v%v to map to '%v', got '%v'", test.Host, test.Path, test.Expect, loc)
+			}
+		}
+	})
+}
+
+func TestKeyBuilderChain(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		kb, err := ParseKeyBuilder("param:key,path")
+		if err != nil {
+			panic(err)
+		}
+		rt.Config().KeyBuilder = kb
+
+		tests := map[string]string{
+			"/temporary?key=/template": "/?key=/template",
+			"/temporary?key=/missing":  "/okay",
+			"/template":                "/?key=/template",
+			"/prefix/a?key=/missing":   "/prefixed/a",
+		}
+		for path, expect := range tests {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+
+			if loc := res.Header.Get("Location"); loc != expect {
+				t.Errorf("Expected %v to map to '%v', got '%v'", path, expect, loc)
+			}
+		}
+	})
+}
+
+func TestNormalizedKeys(t *testing.T) {
+	testRedirectServer(func(rt *Runtime, ts *httptest.Server) {
+		rt.Config().Normalize = KeyNormalization{
+			Lowercase:          true,
+			StripTrailingSlash: true,
+			CollapseSlashes:    true,
+		}
+		rt.Config().KeyBuilder = NormalizedKeyBuilder(rt.Config().KeyBuilder, rt.Config().Normalize)
+		rt.Database.(*BoltDatabase).cfg.Normalize = rt.Config().Normalize
+		m := &Mapping{Key: "/Promo/", Destination: "/promo"}
+		if err := rt.Database.AddMapping(m); err != nil {
+			panic(err)
+		}
+
+		if m.Key != "/Promo/" {
+			t.Errorf("Expected added mapping key to be unmodified, got '%v'", m.Key)
+		}
+
+		if err := rt.Database.AddMapping(&Mapping{Key: "/Blog/", Destination: "/news/{{ .Suffix }}", Type: PrefixMapping, IsTemplate: true}); err != nil {
+			panic(err)
+		}
+
+		for path, expect := range map[string]string{
+			"/promo":    "/promo",
+			"/Promo/":   "/promo",
+			"/promo//":  "/promo",
+			"/PROMO":    "/promo",
+			"/blog/":    "/news/",
+			"/Blog":     "/news/",
+			"/blog/a/b": "/news/a/b",
+		} {
+			res, err := testHttpClient().Get(ts.URL + path)
+			if err != nil {
+				panic(err)
+			}
+
+			if loc := res.Header.Get("Location"); loc != expect {
+				t.Errorf("Expected %v to map to '%v', got '%v'", path, expect, loc)
+			}
+		}
+	})
+}
@@ -1,86 +1,438 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// redisScanCount is the number of keys requested from redis in each SCAN or
+// MGET command.
+const redisScanCount = 1000
+
+func init() {
+	RegisterDriver("redis", &Driver{
+		Open:    OpenRedisDatabase,
+		Options: newRedisOptions,
+	})
+}
+
+// RedisOptions are the database options of the redis driver.
+type RedisOptions struct {
+	Address        string   `json:"address"`        // host:port of the redis server
+	MaxIdle        int      `json:"maxIdle"`        // idle connections kept in the pool
+	MaxActive      int      `json:"maxActive"`      // open connections allowed; zero for no limit
+	IdleTimeout    Duration `json:"idleTimeout"`    // time before idle connections are closed
+	ConnectTimeout Duration `json:"connectTimeout"` // zero for no timeout
+	ReadTimeout    Duration `json:"readTimeout"`    // zero for no timeout
+	WriteTimeout   Duration `json:"writeTimeout"`   // zero for no timeout
+	Password       string   `json:"password"`
+	DB             int      `json:"db"`        // database index selected on connect
+	KeyPrefix      string   `json:"keyPrefix"` // prefix of all keys written by redirector
+}
+
+// newRedisOptions returns the default options of the redis driver.
+func newRedisOptions(cfg *Config) interface{} {
+	opts := &RedisOptions{
+		Address:        "localhost:6379",
+		MaxIdle:        8,
+		MaxActive:      64,
+		IdleTimeout:    Duration{5 * time.Minute},
+		ConnectTimeout: Duration{5 * time.Second},
+		ReadTimeout:    Duration{3 * time.Second},
+		WriteTimeout:   Duration{3 * time.Second},
+	}
+
+	if cfg.DatabasePath != "" {
+		opts.Address = cfg.DatabasePath
+	}
+
+	return opts
+}
+
+// migrateRedisConfig merges the deprecated "redis" configuration block into the
+// database options of the redis driver. Options given in databaseOptions take
+// precedence. Unknown settings in either are rejected when the options are
+// validated.
+func migrateRedisConfig(c *Config) error {
+	if len(c.Redis) == 0 || c.DatabaseDriver != "redis" {
+		return nil
+	}
+
+	opts := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(c.Redis, &opts); err != nil {
+		return fmt.Errorf("Invalid redis configuration: %v", err)
+	}
+
+	if len(c.DatabaseOptions) > 0 {
+		override := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(c.DatabaseOptions, &override); err != nil {
+			return fmt.Errorf("Invalid options for database driver redis: %v", err)
+		}
+		for k, v := range override {
+			opts[k] = v
+		}
+	}
+
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	c.DatabaseOptions = DatabaseOptions(b)
+	return nil
+}
+
+// RedisDatabase implements Database to enable storage of URL mappings in a
+// redis server. It is safe for concurrent use.
 type RedisDatabase struct {
-	client redis.Conn
+	cfg    *Config
+	pool   *redis.Pool
+	prefix string // key prefix of all namespaces
+	ns     string // key prefix of the namespace
 }
 
 // returns a redis key for the given mapping
-func redisMappingKey(key string) string {
-	return fmt.Sprintf("mapping::%v", key)
+func (db *RedisDatabase) mappingKey(key string) string {
+	return fmt.Sprintf("%smapping::%v", db.ns, key)
 }
 
-func OpenRedisDatabase(cfg *Config) (Database, error) {
-	client, err := redis.Dial("tcp", cfg.DatabasePath)
+// returns a redis key for the hits hash of the given mapping
+func (db *RedisDatabase) hitsKey(key string) string {
+	return fmt.Sprintf("%shits::%v", db.ns, key)
+}
+
+// returns a redis key for the miss hash of the given missing key
+func (db *RedisDatabase) missKey(key string) string {
+	return fmt.Sprintf("%smiss::%v", db.ns, key)
+}
+
+// returns a redis key for the history stream of the given mapping
+func (db *RedisDatabase) historyKey(key string) string {
+	return fmt.Sprintf("%shistory::%v", db.ns, key)
+}
+
+// returns a redis key for the named index. Indexes are:
+//
+//   - mappings: a sorted set of the keys of all mappings, scored by the time
+//     they expire in milliseconds since the Unix epoch
+//   - version: set once the mappings index is built
+//   - prefixes: a sorted set of the keys of all prefix mappings
+//   - regexps: a set of the keys of all regexp mappings
+//   - misses: a sorted set of all missing keys, scored by time last seen
+//   - history: a stream of the changes to all mappings
+func (db *RedisDatabase) indexKey(name string) string {
+	return fmt.Sprintf("%sindex::%v", db.ns, name)
+}
+
+// redisScore returns the score of a mapping in the mappings index.
+func redisScore(m *Mapping) interface{} {
+	if m.NotAfter == nil {
+		return "+inf"
+	}
+
+	return m.NotAfter.UnixNano() / int64(time.Millisecond)
+}
+
+// redisReplyError returns the first error in the reply of an EXEC command or
+// of a pipeline flushed with Do(""). Do only returns errors of the command
+// itself, not of each queued command.
+func redisReplyError(reply interface{}, err error) error {
 	if err != nil {
+		return err
+	}
+
+	if v, ok := reply.([]interface{}); ok {
+		for _, r := range v {
+			if err, ok := r.(redis.Error); ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redisExec executes a transaction and returns false if it was aborted
+// because a watched key was modified.
+func redisExec(conn redis.Conn) (bool, error) {
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+
+	// EXEC returns nil if a watched key was modified after WATCH
+	if reply == nil {
+		return false, nil
+	}
+
+	return true, redisReplyError(reply, nil)
+}
+
+// redisPattern escapes s for use as a literal in a KEYS or SCAN pattern.
+func redisPattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return r.Replace(s)
+}
+
+func OpenRedisDatabase(cfg *Config) (Database, error) {
+	opts := newRedisOptions(cfg).(*RedisOptions)
+	if err := decodeDatabaseOptions(cfg, opts); err != nil {
+		return nil, err
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		MaxActive:   opts.MaxActive,
+		IdleTimeout: opts.IdleTimeout.Duration,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", opts.Address,
+				redis.DialConnectTimeout(opts.ConnectTimeout.Duration),
+				redis.DialReadTimeout(opts.ReadTimeout.Duration),
+				redis.DialWriteTimeout(opts.WriteTimeout.Duration),
+				redis.DialPassword(opts.Password),
+				redis.DialDatabase(opts.DB),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	// fail early if the server is unavailable
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
 		return nil, err
 	}
 
 	return &RedisDatabase{
-		client: client,
+		cfg:    cfg,
+		pool:   pool,
+		prefix: opts.KeyPrefix,
+		ns:     opts.KeyPrefix,
 	}, nil
 }
 
+// Close closes the redis connection pool of all namespaces.
 func (db *RedisDatabase) Close() error {
-	return db.client.Close()
+	return db.pool.Close()
 }
 
-func (db *RedisDatabase) Stats() (DatabaseStats, error) {
-	// see: https://redis.io/commands/INFO
-	s, err := redis.String(db.client.Do("INFO", "all"))
-	if err != nil {
-		return DatabaseStats{}, nil
+// Namespace returns a view of the database that prefixes all redis keys with
+// the given host name.
+func (db *RedisDatabase) Namespace(name string) (Database, error) {
+	ns := db.prefix
+	if name != "" {
+		ns += fmt.Sprintf("host::%v::", name)
 	}
 
-	rstats := make(map[string]string, 0)
-	lines := strings.Split(s, "\r\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "#") {
-			v := strings.SplitN(line, ":", 2)
-			if len(v) == 2 {
-				rstats[v[0]] = v[1]
+	return &RedisDatabase{
+		cfg:    db.cfg,
+		pool:   db.pool,
+		prefix: db.prefix,
+		ns:     ns,
+	}, nil
+}
+
+// scan calls fn with each batch of keys that match the given pattern. Keys may
+// be repeated across batches if they are modified during the scan.
+func (db *RedisDatabase) scan(conn redis.Conn, pattern string, fn func(keys []string) error) error {
+	cursor := 0
+	for {
+		v, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount))
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(v, &cursor, &keys); err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
 			}
 		}
+
+		if cursor == 0 {
+			return nil
+		}
 	}
+}
 
-	stats := DatabaseStats{}
+// indexMappings builds the mappings index of a namespace that was written by
+// an earlier version, once. The index is maintained by each write after that.
+func (db *RedisDatabase) indexMappings(conn redis.Conn) error {
+	ok, err := redis.Bool(conn.Do("EXISTS", db.indexKey("version")))
+	if err != nil || ok {
+		return err
+	}
 
-	if str, ok := rstats["db0"]; ok {
-		o := strings.Index(str, ":keys=") + 6
-		fmt.Sscanf(str[o:], "%d", &stats.TotalMappings)
+	if err := db.scan(conn, redisPattern(db.mappingKey(""))+"*", func(keys []string) error {
+		mappings, _, err := db.getMappings(conn, keys)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range mappings {
+			conn.Send("ZADD", db.indexKey("mappings"), redisScore(m), m.Key)
+		}
+
+		// flush pipeline and receive all replies
+		return redisReplyError(conn.Do(""))
+	}); err != nil {
+		return err
 	}
 
-	if str, ok := rstats["used_memory"]; ok {
-		fmt.Sscanf(str, "%d", &stats.DiskUsage)
+	_, err = conn.Do("SET", db.indexKey("version"), 1)
+	return err
+}
+
+// Stats returns the number of mappings in the namespace and the memory used by
+// the redis server.
+func (db *RedisDatabase) Stats() (DatabaseStats, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	if err := db.indexMappings(conn); err != nil {
+		return DatabaseStats{}, err
+	}
+
+	n, err := redis.Int64(conn.Do("ZCARD", db.indexKey("mappings")))
+	if err != nil {
+		return DatabaseStats{}, err
+	}
+	stats := DatabaseStats{TotalMappings: n}
+
+	// see: https://redis.io/commands/INFO
+	s, err := redis.String(conn.Do("INFO", "memory"))
+	if err != nil {
+		return DatabaseStats{}, err
+	}
+
+	for _, line := range strings.Split(s, "\r\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			fmt.Sscanf(line[12:], "%d", &stats.DiskUsage)
+		}
 	}
 
 	return stats, nil
 }
 
 func (db *RedisDatabase) AddMapping(m *Mapping) error {
-	b, err := MarshallBinary(m)
-	if err != nil {
-		return err
+	_, err := db.AddMappingIf(m, AnyRevision, "")
+	return err
+}
+
+// watchMapping watches the redis key of a mapping for changes by other
+// clients and returns the stored mapping, or nil if it does not exist.
+func (db *RedisDatabase) watchMapping(conn redis.Conn, key string) (*Mapping, error) {
+	if _, err := conn.Do("WATCH", db.mappingKey(key)); err != nil {
+		return nil, err
 	}
 
-	key := redisMappingKey(m.Key)
-	if res, err := redis.String(db.client.Do("SET", key, b)); err != nil {
-		return err
-	} else if res != "OK" {
-		return fmt.Errorf("Redis failed to set key %v: %v", key, res)
+	m, err := db.getMapping(conn, key)
+	if err == MappingNotFoundError {
+		return nil, nil
+	}
+	if err != nil {
+		conn.Do("UNWATCH")
+		return nil, err
 	}
 
-	return nil
+	return m, nil
 }
 
-func (db *RedisDatabase) GetMapping(key string) (*Mapping, error) {
-	key = redisMappingKey(key)
-	b, err := redis.Bytes(db.client.Do("GET", key))
+// AddMappingIf adds or replaces a mapping if the stored mapping matches the
+// given revision, and records the change in the history streams. The mapping
+// and the change are written in a transaction that is retried if the mapping is
+// modified by another client. The mapping is stored with its normalized key.
+func (db *RedisDatabase) AddMappingIf(m *Mapping, rev int64, actor string) (*MappingChange, error) {
+	key := db.cfg.Normalize.MappingKey(m)
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	for {
+		cur, err := db.watchMapping(conn, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkRevision(cur, rev); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		nextRevision(m, cur)
+		v := *m
+		v.Key = key
+		b, err := MarshallBinary(&v)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		change := newChange(key, cur, &v, actor, *v.Modified)
+		cb, err := MarshallBinary(change)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("SET", db.mappingKey(key), b)
+		conn.Send("ZADD", db.indexKey("mappings"), redisScore(m), key)
+
+		// expired mappings are also purged by redis after the retention period,
+		// in case the sweeper does not run
+		if m.NotAfter != nil {
+			t := m.NotAfter.Add(db.cfg.ExpiredRetention.Duration)
+			conn.Send("PEXPIREAT", db.mappingKey(key), t.UnixNano()/int64(time.Millisecond))
+		}
+
+		// maintain type indexes
+		if m.Type == PrefixMapping {
+			conn.Send("ZADD", db.indexKey("prefixes"), 0, key)
+		} else {
+			conn.Send("ZREM", db.indexKey("prefixes"), key)
+		}
+
+		if m.Type == RegexpMapping {
+			conn.Send("SADD", db.indexKey("regexps"), key)
+		} else {
+			conn.Send("SREM", db.indexKey("regexps"), key)
+		}
+
+		db.sendChange(conn, key, cb)
+
+		// retry if the mapping was modified after WATCH
+		ok, err := redisExec(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return change, nil
+		}
+	}
+}
+
+func (db *RedisDatabase) getMapping(conn redis.Conn, key string) (*Mapping, error) {
+	b, err := redis.Bytes(conn.Do("GET", db.mappingKey(key)))
 	if err == redis.ErrNil {
 		return nil, MappingNotFoundError
 	}
@@ -96,59 +448,820 @@ func (db *RedisDatabase) GetMapping(key string) (*Mapping, error) {
 	return m, nil
 }
 
-func (db *RedisDatabase) GetMappings() ([]*Mapping, error) {
-	values, err := redis.Values(db.client.Do("KEYS", "*"))
+func (db *RedisDatabase) GetMapping(key string) (*Mapping, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	return db.getMapping(conn, key)
+}
+
+// GetPrefixMapping returns the prefix mapping with the longest key that is a
+// prefix of the given key.
+func (db *RedisDatabase) GetPrefixMapping(key string) (*Mapping, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	k := key
+	for len(k) > 0 {
+		// find the greatest indexed key that is less than or equal to k
+		v, err := redis.Strings(conn.Do("ZREVRANGEBYLEX", db.indexKey("prefixes"), "["+k, "-", "LIMIT", 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		if len(v) == 0 {
+			break
+		}
+
+		if strings.HasPrefix(k, v[0]) {
+			m, err := db.getMapping(conn, v[0])
+			if err != MappingNotFoundError {
+				return m, err
+			}
+
+			// mapping expired; remove it from the index and try again
+			if _, err := conn.Do("ZREM", db.indexKey("prefixes"), v[0]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// any shorter match must also be a prefix of the common prefix
+		k = commonPrefix(k, v[0])
+	}
+
+	return nil, MappingNotFoundError
+}
+
+// getMappings returns the mappings stored at the given redis keys. Keys that
+// do not exist are returned in missing.
+func (db *RedisDatabase) getMappings(conn redis.Conn, keys []string) (mappings []*Mapping, missing []string, err error) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	values, err := redis.ByteSlices(conn.Do("MGET", args...))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var keys = make([]string, 0)
-	if err := redis.ScanSlice(values, &keys); err != nil {
+	mappings = make([]*Mapping, 0, len(values))
+	for i, b := range values {
+		if b == nil {
+			missing = append(missing, keys[i])
+			continue
+		}
+
+		m := &Mapping{}
+		if err := UnmarshallBinary(b, m); err != nil {
+			return nil, nil, err
+		}
+
+		mappings = append(mappings, m)
+	}
+
+	return mappings, missing, nil
+}
+
+// GetRegexpMappings returns all regexp mappings in evaluation order.
+func (db *RedisDatabase) GetRegexpMappings() ([]*Mapping, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", db.indexKey("regexps")))
+	if err != nil {
 		return nil, err
 	}
 
-	// TODO: improve performance of RedisDatabase.GetMappings
-	mappings := make([]*Mapping, len(keys))
-	for i, key := range keys {
-		b, err := redis.Bytes(db.client.Do("GET", key))
+	mappings := make([]*Mapping, 0, len(keys))
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > redisScanCount {
+			n = redisScanCount
+		}
+
+		rkeys := make([]string, n)
+		for i, key := range keys[:n] {
+			rkeys[i] = db.mappingKey(key)
+		}
+		keys = keys[n:]
+
+		v, missing, err := db.getMappings(conn, rkeys)
 		if err != nil {
 			return nil, err
 		}
+		mappings = append(mappings, v...)
 
-		m := &Mapping{}
-		if err := UnmarshallBinary(b, m); err != nil {
-			return nil, err
+		// mappings expired; remove them from the index
+		for _, key := range missing {
+			if _, err := conn.Do("SREM", db.indexKey("regexps"), strings.TrimPrefix(key, db.mappingKey(""))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sortRegexpMappings(mappings)
+	return mappings, nil
+}
+
+func (db *RedisDatabase) GetMappings() ([]*Mapping, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	seen := make(map[string]bool)
+	mappings := make([]*Mapping, 0)
+	err := db.scan(conn, redisPattern(db.mappingKey(""))+"*", func(keys []string) error {
+		v, _, err := db.getMappings(conn, keys)
+		if err != nil {
+			return err
 		}
 
-		mappings[i] = m
+		for _, m := range v {
+			if !seen[m.Key] {
+				seen[m.Key] = true
+				mappings = append(mappings, m)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return mappings, nil
 }
 
+// ListMappings returns a page of mappings using SCAN. Mappings are ordered by
+// key within each SCAN batch only, and may be repeated across pages if they
+// are modified while listing. The cursor of the next page is the SCAN cursor
+// of the batch that contains the last mapping in the page, followed by a
+// colon and the key of the mapping.
+func (db *RedisDatabase) ListMappings(opts ListOptions) ([]*Mapping, string, error) {
+	cursor, last := 0, ""
+	if opts.After != "" {
+		i := strings.Index(opts.After, ":")
+		if i < 0 {
+			return nil, "", fmt.Errorf("Invalid cursor: %v", opts.After)
+		}
+
+		n, err := strconv.Atoi(opts.After[:i])
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid cursor: %v", opts.After)
+		}
+		cursor, last = n, opts.After[i+1:]
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	pattern := redisPattern(db.mappingKey(opts.Prefix)) + "*"
+	mappings := make([]*Mapping, 0)
+	for {
+		v, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount))
+		if err != nil {
+			return nil, "", err
+		}
+
+		var next int
+		var keys []string
+		if _, err := redis.Scan(v, &next, &keys); err != nil {
+			return nil, "", err
+		}
+
+		// skip the keys of the batch that were returned in the previous page
+		sort.Strings(keys)
+		if last != "" {
+			i := sort.SearchStrings(keys, db.mappingKey(last)+"\x00")
+			keys, last = keys[i:], ""
+		}
+
+		if len(keys) > 0 {
+			batch, _, err := db.getMappings(conn, keys)
+			if err != nil {
+				return nil, "", err
+			}
+
+			for i, m := range batch {
+				if !opts.Match(m) {
+					continue
+				}
+
+				mappings = append(mappings, m)
+				if opts.Limit > 0 && len(mappings) == opts.Limit {
+					if i < len(batch)-1 || next != 0 {
+						return mappings, fmt.Sprintf("%d:%v", cursor, m.Key), nil
+					}
+
+					return mappings, "", nil
+				}
+			}
+		}
+
+		if next == 0 {
+			return mappings, "", nil
+		}
+		cursor = next
+	}
+}
+
 func (db *RedisDatabase) DeleteMapping(key string) error {
-	key = redisMappingKey(key)
-	i, err := redis.Int(db.client.Do("DEL", key))
+	_, err := db.DeleteMappingIf(key, AnyRevision, "")
+	return err
+}
+
+// DeleteMappingIf deletes a mapping and its recorded hits if the stored
+// mapping matches the given revision, and records the change in the history
+// streams in the same transaction.
+func (db *RedisDatabase) DeleteMappingIf(key string, rev int64, actor string) (*MappingChange, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	for {
+		cur, err := db.watchMapping(conn, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if cur == nil {
+			conn.Do("UNWATCH")
+			return nil, MappingNotFoundError
+		}
+
+		if err := checkRevision(cur, rev); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		change := newChange(key, cur, nil, actor, time.Now())
+		cb, err := MarshallBinary(change)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		conn.Send("MULTI")
+		db.sendDeleteMapping(conn, key)
+		db.sendChange(conn, key, cb)
+
+		// retry if the mapping was modified after WATCH
+		ok, err := redisExec(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return change, nil
+		}
+	}
+}
+
+// sendDeleteMapping queues the commands that delete a mapping, its index
+// entries and its recorded hits.
+func (db *RedisDatabase) sendDeleteMapping(conn redis.Conn, key string) {
+	conn.Send("ZREM", db.indexKey("mappings"), key)
+	conn.Send("ZREM", db.indexKey("prefixes"), key)
+	conn.Send("SREM", db.indexKey("regexps"), key)
+	conn.Send("DEL", db.hitsKey(key))
+	conn.Send("DEL", db.mappingKey(key))
+}
+
+// deleteMappings deletes the stored mappings with the given keys that match
+// the given function, and records their deletion in the history streams, in a
+// transaction that is retried if any of the mappings is modified by another
+// client. Keys without a stored mapping are removed from the mappings index.
+func (db *RedisDatabase) deleteMappings(conn redis.Conn, keys []string, actor string, match func(*Mapping) bool) (int64, error) {
+	rkeys := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		rkeys[i] = db.mappingKey(key)
+		args[i] = rkeys[i]
+	}
+
+	for {
+		if _, err := conn.Do("WATCH", args...); err != nil {
+			return 0, err
+		}
+
+		mappings, missing, err := db.getMappings(conn, rkeys)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+
+		var count int64
+		now := time.Now()
+		conn.Send("MULTI")
+		for _, rkey := range missing {
+			conn.Send("ZREM", db.indexKey("mappings"), strings.TrimPrefix(rkey, db.mappingKey("")))
+		}
+
+		for _, m := range mappings {
+			if !match(m) {
+				continue
+			}
+
+			cb, err := MarshallBinary(newChange(m.Key, m, nil, actor, now))
+			if err != nil {
+				conn.Do("DISCARD")
+				return 0, err
+			}
+
+			db.sendDeleteMapping(conn, m.Key)
+			db.sendChange(conn, m.Key, cb)
+			count++
+		}
+
+		// retry if any mapping was modified after WATCH
+		ok, err := redisExec(conn)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return count, nil
+		}
+	}
+}
+
+// DeleteExpiredMappings deletes all mappings that expired before the given
+// time, using the expiry scores of the mappings index, and records their
+// deletion in the history streams. Mapping keys also expire natively once they
+// have been expired for the expiredRetention that was configured when they
+// were written; redis purges those without history and their index entries are
+// removed here.
+func (db *RedisDatabase) DeleteExpiredMappings(before time.Time, actor string) (int64, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	if err := db.indexMappings(conn); err != nil {
+		return 0, err
+	}
+
+	keys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", db.indexKey("mappings"), "-inf", "("+strconv.FormatInt(before.UnixNano()/int64(time.Millisecond), 10)))
+	if err != nil {
+		return 0, err
+	}
+
+	// skip mappings that were replaced since they were read
+	expired := func(m *Mapping) bool {
+		return m.Expired(before)
+	}
+
+	var count int64
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > redisScanCount {
+			n = redisScanCount
+		}
+
+		c, err := db.deleteMappings(conn, keys[:n], actor, expired)
+		if err != nil {
+			return count, err
+		}
+
+		count += c
+		keys = keys[n:]
+	}
+
+	return count, nil
+}
+
+// deleteKeys deletes all keys that match the given pattern and returns the
+// number of keys deleted.
+func (db *RedisDatabase) deleteKeys(conn redis.Conn, pattern string) (int64, error) {
+	var count int64
+	err := db.scan(conn, pattern, func(keys []string) error {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = key
+		}
+
+		n, err := redis.Int64(conn.Do("DEL", args...))
+		if err != nil {
+			return err
+		}
+
+		count += n
+		return nil
+	})
+
+	return count, err
+}
+
+// MigrateRecords rewrites all legacy gob mapping records in all namespaces in
+// the current record format. Hits and misses are stored as redis hashes and
+// are not affected. Mappings that are modified during the migration are
+// skipped, as they are rewritten in the current format by the modifier.
+func (db *RedisDatabase) MigrateRecords() (int64, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	var count int64
+	patterns := []string{
+		redisPattern(db.prefix) + "mapping::*",
+		redisPattern(db.prefix) + "host::*::mapping::*",
+	}
+
+	for _, pattern := range patterns {
+		if err := db.scan(conn, pattern, func(keys []string) error {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+
+			// values of keys that are not strings are returned as nil
+			values, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return err
+			}
+
+			for i, b := range values {
+				if b == nil {
+					continue
+				}
+
+				vb, err := migrateRecord(b, &Mapping{})
+				if err != nil {
+					return fmt.Errorf("Error decoding mapping record %q: %v", keys[i], err)
+				}
+
+				if vb == nil {
+					continue
+				}
+
+				ok, err := db.replaceRecord(conn, keys[i], b, vb)
+				if err != nil {
+					return err
+				}
+
+				if ok {
+					count++
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// replaceRecord sets the value of the given key to b if its current value is
+// old, and preserves its expiry. It returns false if the value was changed by
+// another client.
+func (db *RedisDatabase) replaceRecord(conn redis.Conn, key string, old, b []byte) (bool, error) {
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return false, err
+	}
+
+	cur, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+
+	if !bytes.Equal(cur, old) {
+		_, err := conn.Do("UNWATCH")
+		return false, err
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+
+	conn.Send("MULTI")
+	if ttl > 0 {
+		conn.Send("SET", key, b, "PX", ttl)
+	} else {
+		conn.Send("SET", key, b)
+	}
+
+	return redisExec(conn)
+}
+
+// DeleteMappings deletes all mappings in the namespace and their recorded
+// hits, and records their deletion in the history streams. Mappings are deleted
+// in transactions of each page of keys returned by SCAN.
+func (db *RedisDatabase) DeleteMappings(actor string) (int64, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	all := func(m *Mapping) bool {
+		return true
+	}
+
+	var count int64
+	prefix := db.mappingKey("")
+	if err := db.scan(conn, redisPattern(prefix)+"*", func(rkeys []string) error {
+		keys := make([]string, len(rkeys))
+		for i, rkey := range rkeys {
+			keys[i] = strings.TrimPrefix(rkey, prefix)
+		}
+
+		n, err := db.deleteMappings(conn, keys, actor, all)
+		count += n
+		return err
+	}); err != nil {
+		return count, err
+	}
+
+	// hits recorded for keys without a mapping
+	if _, err := db.deleteKeys(conn, redisPattern(db.hitsKey(""))+"*"); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// AddHits adds the given hits to the recorded hits of each mapping.
+func (db *RedisDatabase) AddHits(hits []*MappingHits) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	for _, h := range hits {
+		key := db.hitsKey(h.Key)
+		conn.Send("HINCRBY", key, "count", h.Count)
+		conn.Send("HSETNX", key, "first", h.FirstHit.UnixNano())
+		conn.Send("HSET", key, "last", h.LastHit.UnixNano())
+	}
+
+	// flush pipeline and receive all replies
+	return redisReplyError(conn.Do(""))
+}
+
+// GetHits returns the recorded hits of the mappings with the given keys, or
+// of all mappings that have been hit if no keys are given.
+func (db *RedisDatabase) GetHits(keys ...string) ([]*MappingHits, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	seen := make(map[string]bool)
+	hits := make([]*MappingHits, 0)
+	get := func(keys []string) error {
+		for _, key := range keys {
+			conn.Send("HGETALL", key)
+		}
+
+		// flush pipeline and receive all replies
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			v, err := redis.Int64Map(conn.Receive())
+			if err != nil {
+				return err
+			}
+
+			if len(v) == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			hits = append(hits, &MappingHits{
+				Key:      strings.TrimPrefix(key, db.hitsKey("")),
+				Count:    v["count"],
+				FirstHit: time.Unix(0, v["first"]),
+				LastHit:  time.Unix(0, v["last"]),
+			})
+		}
+
+		return nil
+	}
+
+	if len(keys) == 0 {
+		if err := db.scan(conn, redisPattern(db.hitsKey(""))+"*", get); err != nil {
+			return nil, err
+		}
+
+		return hits, nil
+	}
+
+	hitsKeys := make([]string, len(keys))
+	for i, key := range keys {
+		hitsKeys[i] = db.hitsKey(key)
+	}
+
+	if err := get(hitsKeys); err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+// AddMisses adds the given misses to the recorded misses of each key. Only the
+// max most recently seen keys are retained.
+func (db *RedisDatabase) AddMisses(misses []*Miss, max int) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	for _, m := range misses {
+		key := db.missKey(m.Key)
+		conn.Send("HINCRBY", key, "count", m.Count)
+		conn.Send("HSET", key, "last", m.LastSeen.UnixNano())
+		if m.Referer != "" {
+			conn.Send("HSET", key, "referer", m.Referer)
+		}
+		conn.Send("ZADD", db.indexKey("misses"), m.LastSeen.UnixNano()/int64(time.Millisecond), m.Key)
+	}
+
+	// flush pipeline and receive all replies
+	if err := redisReplyError(conn.Do("")); err != nil {
+		return err
+	}
+
+	// evict the least recently seen keys
+	n, err := redis.Int(conn.Do("ZCARD", db.indexKey("misses")))
 	if err != nil {
 		return err
 	}
 
-	if i != 1 {
-		return fmt.Errorf("Expected to delete 1 mapping, got %v", i)
+	if n <= max {
+		return nil
+	}
+
+	keys, err := redis.Strings(conn.Do("ZRANGE", db.indexKey("misses"), 0, n-max-1))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := db.deleteMiss(conn, key); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (db *RedisDatabase) DeleteMappings() (int64, error) {
-	stats, err := db.Stats()
+// GetMisses returns up to limit of the most requested missing keys. If limit
+// is zero, all missing keys are returned.
+func (db *RedisDatabase) GetMisses(limit int) ([]*Miss, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("ZRANGE", db.indexKey("misses"), 0, -1))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	if _, err := db.client.Do("FLUSHDB"); err != nil {
-		return 0, err
+	for _, key := range keys {
+		conn.Send("HGETALL", db.missKey(key))
+	}
+
+	// flush pipeline and receive all replies
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	misses := make([]*Miss, 0, len(keys))
+	for _, key := range keys {
+		v, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		m := &Miss{
+			Key:     key,
+			Referer: v["referer"],
+		}
+		fmt.Sscanf(v["count"], "%d", &m.Count)
+
+		var last int64
+		fmt.Sscanf(v["last"], "%d", &last)
+		m.LastSeen = time.Unix(0, last)
+
+		misses = append(misses, m)
+	}
+
+	sortMisses(misses)
+	if limit > 0 && len(misses) > limit {
+		misses = misses[:limit]
+	}
+
+	return misses, nil
+}
+
+func (db *RedisDatabase) deleteMiss(conn redis.Conn, key string) error {
+	if _, err := conn.Do("ZREM", db.indexKey("misses"), key); err != nil {
+		return err
+	}
+
+	_, err := conn.Do("DEL", db.missKey(key))
+	return err
+}
+
+func (db *RedisDatabase) DeleteMiss(key string) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	return db.deleteMiss(conn, key)
+}
+
+// AddChanges appends the given changes to the history stream of each mapping
+// key and to the history index stream.
+func (db *RedisDatabase) AddChanges(changes []*MappingChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, c := range changes {
+		b, err := MarshallBinary(c)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		db.sendChange(conn, c.Key, b)
+	}
+
+	_, err := redisExec(conn)
+	return err
+}
+
+// sendChange queues the commands that append an encoded change to the history
+// stream of its mapping key and to the history index stream.
+func (db *RedisDatabase) sendChange(conn redis.Conn, key string, b []byte) {
+	conn.Send("XADD", db.historyKey(key), "*", "change", b)
+	conn.Send("XADD", db.indexKey("history"), "*", "change", b)
+}
+
+// readChanges decodes the changes in the reply of an XRANGE command.
+func readChanges(reply interface{}, err error) ([]*MappingChange, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*MappingChange, 0, len(entries))
+	for _, entry := range entries {
+		v, err := redis.Values(entry, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(v) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", v)
+		}
+
+		fields, err := redis.StringMap(v[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &MappingChange{}
+		if err := UnmarshallBinary([]byte(fields["change"]), c); err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+// GetHistory returns all changes to the given mapping key in the order they
+// were made.
+func (db *RedisDatabase) GetHistory(key string) ([]*MappingChange, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	return readChanges(conn.Do("XRANGE", db.historyKey(key), "-", "+"))
+}
+
+// redisClockSkew is the allowed difference between the clock of the redis
+// server and the clocks of its clients.
+const redisClockSkew = time.Minute
+
+// GetChanges returns all changes made since the given time, in the order they
+// were made. Stream entry IDs are used to skip earlier changes.
+func (db *RedisDatabase) GetChanges(since time.Time) ([]*MappingChange, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	// entry IDs are the time in milliseconds on the redis server
+	start := since.Add(-redisClockSkew).UnixNano() / int64(time.Millisecond)
+	changes, err := readChanges(conn.Do("XRANGE", db.indexKey("history"), start, "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]*MappingChange, 0, len(changes))
+	for _, c := range changes {
+		if !c.Time.Before(since) {
+			v = append(v, c)
+		}
 	}
 
-	return stats.TotalMappings, nil
+	sortChanges(v)
+	return v, nil
 }
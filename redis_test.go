@@ -1,13 +1,17 @@
 package main
 
 import (
+	"github.com/garyburd/redigo/redis"
 	"testing"
+	"time"
 )
 
 func TestRedis(t *testing.T) {
 	// open database
 	cfg := &Config{
-		DatabasePath: "localhost:6379",
+		DatabaseDriver:   "redis",
+		DatabaseOptions:  DatabaseOptions(`{"address": "localhost:6379"}`),
+		ExpiredRetention: Duration{24 * time.Hour},
 	}
 	db, err := OpenRedisDatabase(cfg)
 	if err != nil {
@@ -21,4 +25,60 @@ func TestRedis(t *testing.T) {
 	}()
 
 	testDB(t, db)
+	testDBNamespaces(t, db)
+	testDBStats(t, db)
+	testDBListMappings(t, db)
+	testDBRevisions(t, db)
+	testDBHistory(t, db)
+	testDBExpiredMappings(t, db)
+	testRedisExpiry(t, db.(*RedisDatabase))
+}
+
+// testRedisExpiry checks that expiring mappings are also purged by redis once
+// the retention period has passed.
+func testRedisExpiry(t *testing.T, db *RedisDatabase) {
+	notAfter := time.Now().Add(time.Hour)
+	if err := db.AddMapping(&Mapping{Key: "/ttl", Destination: "/", NotAfter: &notAfter}); err != nil {
+		panic(err)
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(conn.Do("PTTL", db.mappingKey("/ttl")))
+	if err != nil {
+		panic(err)
+	}
+
+	expect := notAfter.Add(24 * time.Hour).Sub(time.Now())
+	if d := time.Duration(ttl) * time.Millisecond; d <= 0 || d > expect || d < expect-time.Minute {
+		t.Errorf("Bad native expiry %v, expected %v", d, expect)
+	}
+
+	// replacing the mapping without an expiry removes the native expiry
+	if err := db.AddMapping(&Mapping{Key: "/ttl", Destination: "/"}); err != nil {
+		panic(err)
+	}
+
+	if ttl, err := redis.Int64(conn.Do("PTTL", db.mappingKey("/ttl"))); err != nil {
+		panic(err)
+	} else if ttl != -1 {
+		t.Errorf("Expected no native expiry, got %v", ttl)
+	}
+
+	if err := db.DeleteMapping("/ttl"); err != nil {
+		panic(err)
+	}
+}
+
+func TestRedisReplyError(t *testing.T) {
+	if err := redisReplyError([]interface{}{"OK", int64(1)}, nil); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	// errors of queued commands are returned in the reply of EXEC
+	reply := []interface{}{"OK", redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}
+	if err := redisReplyError(reply, nil); err == nil {
+		t.Errorf("Expected error in reply")
+	}
 }
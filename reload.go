@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// restartSettings are the settings that only take effect when the server is
+// restarted. They keep their current values when the configuration is
+// reloaded.
+var restartSettings = map[string]bool{
+	"database":           true,
+	"databasePath":       true,
+	"databaseOptions":    true,
+	"redis":              true,
+	"listenAddr":         true,
+	"mgmtAddr":           true,
+	"tls":                true,
+	"upgradeAddr":        true,
+	"mgmtTLS":            true,
+	"logFile":            true,
+	"logFormat":          true,
+	"accessLogFile":      true,
+	"accessLogFormat":    true,
+	"normalize":          true,
+	"sweepInterval":      true,
+	"statsFlushInterval": true,
+	"maxMisses":          true,
+	"cache":              true,
+}
+
+// secretSettings are the settings whose values are not reported when they
+// change.
+var secretSettings = map[string]bool{
+	"mgmtTokens": true,
+}
+
+// A ConfigChange is a setting that changed when the configuration was
+// reloaded.
+type ConfigChange struct {
+	Setting         string          `json:"setting"`
+	Old             json.RawMessage `json:"old,omitempty"` // omitted for secret settings
+	New             json.RawMessage `json:"new,omitempty"`
+	RestartRequired bool            `json:"restartRequired"` // the running server still uses the old value
+}
+
+func (c *ConfigChange) String() string {
+	s := fmt.Sprintf("%v changed", c.Setting)
+	if c.Old != nil || c.New != nil {
+		s = fmt.Sprintf("%v: %s -> %s", c.Setting, c.Old, c.New)
+	}
+
+	if c.RestartRequired {
+		s += " (restart required)"
+	}
+
+	return s
+}
+
+// configSettings returns the JSON encoding of each setting of a configuration,
+// keyed by name.
+func configSettings(c *Config) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// configField returns the value of the setting of a configuration with the
+// given name.
+func configField(c *Config, name string) interface{} {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == name {
+			return v.Field(i).Interface()
+		}
+	}
+
+	return nil
+}
+
+// diffConfig returns the settings that differ between two configurations,
+// ordered by name.
+func diffConfig(old, new *Config) ([]*ConfigChange, error) {
+	a, err := configSettings(old)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := configSettings(new)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*ConfigChange, 0)
+	for name, v := range b {
+		changed := !bytes.Equal(a[name], v)
+
+		// secret values are redacted in JSON and are compared directly
+		if secretSettings[name] {
+			changed = !reflect.DeepEqual(configField(old, name), configField(new, name))
+		}
+
+		if !changed {
+			continue
+		}
+
+		change := &ConfigChange{
+			Setting:         name,
+			RestartRequired: restartSettings[name],
+		}
+		if !secretSettings[name] {
+			change.Old = a[name]
+			change.New = v
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Setting < changes[j].Setting
+	})
+
+	return changes, nil
+}
+
+// keepRestartSettings copies the settings that require a restart from the
+// running configuration, including the certificates of virtual hosts, which
+// are loaded when the redirect listener starts. It returns the settings that
+// were changed in c.
+func (c *Config) keepRestartSettings(running *Config) ([]*ConfigChange, error) {
+	changes, err := diffConfig(running, c)
+	if err != nil {
+		return nil, err
+	}
+
+	restart := make([]*ConfigChange, 0)
+	for _, change := range changes {
+		if change.RestartRequired {
+			restart = append(restart, change)
+		}
+	}
+
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(running).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		name := strings.Split(dst.Type().Field(i).Tag.Get("json"), ",")[0]
+		if restartSettings[name] {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+
+	// host names are lower-cased when the configuration is initialized
+	for name, hc := range c.Hosts {
+		if hc == nil {
+			continue
+		}
+
+		cur := running.Hosts[strings.ToLower(name)]
+		if cur == nil {
+			cur = &HostConfig{}
+		}
+
+		if hc.CertFile != cur.CertFile || hc.KeyFile != cur.KeyFile {
+			restart = append(restart, &ConfigChange{
+				Setting:         fmt.Sprintf("hosts.%v.certFile", name),
+				Old:             json.RawMessage(fmt.Sprintf("%q", cur.CertFile)),
+				New:             json.RawMessage(fmt.Sprintf("%q", hc.CertFile)),
+				RestartRequired: true,
+			})
+
+			h := *hc
+			h.CertFile = cur.CertFile
+			h.KeyFile = cur.KeyFile
+			c.Hosts[name] = &h
+		}
+	}
+
+	return restart, nil
+}
+
+// ReloadConfig reads the configuration file of the runtime again and replaces
+// the current configuration if the new configuration is valid. Settings that
+// require a restart keep their current values. It returns all changed
+// settings, which are also logged.
+func (rt *Runtime) ReloadConfig() ([]*ConfigChange, error) {
+	rt.reloadMu.Lock()
+	defer rt.reloadMu.Unlock()
+
+	cur := rt.Config()
+	var next *Config
+	var err error
+	if cur.Path != "" {
+		next, err = decodeConfig(cur.Path)
+	} else {
+		next, err = findConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	next.ExitOnError = cur.ExitOnError
+
+	restart, err := next.keepRestartSettings(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := next.initialize(); err != nil {
+		return nil, err
+	}
+
+	changes, err := diffConfig(cur, next)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, restart...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Setting < changes[j].Setting
+	})
+
+	rt.SetConfig(next)
+	rt.Logger.SetLevel(next.LogLevel)
+
+	path := next.Path
+	if path == "" {
+		path = "defaults"
+	}
+	rt.Logger.Infof("Reloaded configuration from %v: %v settings changed", path, len(changes))
+	for _, change := range changes {
+		rt.Logger.Infof("  %v", change)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// tmpConfigFile creates a configuration file for the duration of fn, which is
+// given the path of the file and a function that writes it.
+func tmpConfigFile(fn func(path string, write func(string))) {
+	f, err := ioutil.TempFile("", "redirector_config_")
+	if err != nil {
+		panic(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	fn(f.Name(), func(s string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(s), 0644); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	testManagementServer(func(rt *Runtime, client *ManagementClient) {
+		tmpConfigFile(func(path string, write func(string)) {
+			write(`{"defaultKey": "/a", "listenAddr": ":8080", "hosts": {"example.com": {}}}`)
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				panic(err)
+			}
+			cfg.ExitOnError = true
+			rt.SetConfig(cfg)
+
+			write(`{
+				"defaultKey": "/b",
+				"listenAddr": ":9090",
+				"mgmtTokens": [{"name": "deploy", "sha256": "` + HashToken("secret") + `", "role": "write"}],
+				"hosts": {"Example.com": {"defaultKey": "/c", "certFile": "example.crt", "keyFile": "example.key"}}
+			}`)
+			changes, err := rt.ReloadConfig()
+			if err != nil {
+				t.Fatalf("Error reloading config: %v", err)
+			}
+
+			next := rt.Config()
+			if next.DefaultKey != "/b" {
+				t.Errorf("Expected reloaded defaultKey /b, got %v", next.DefaultKey)
+			}
+
+			if next.ListenAddr != ":8080" {
+				t.Errorf("Expected listenAddr to be kept until restart, got %v", next.ListenAddr)
+			}
+
+			if hc := next.Hosts["example.com"]; hc == nil || hc.DefaultKey != "/c" || hc.CertFile != "" {
+				t.Errorf("Expected reloaded host without certificate, got %+v", hc)
+			}
+
+			expect := map[string]bool{
+				"defaultKey":                 false,
+				"hosts":                      false,
+				"hosts.Example.com.certFile": true,
+				"listenAddr":                 true,
+				"mgmtTokens":                 false,
+			}
+			if len(changes) != len(expect) {
+				t.Errorf("Expected %v changes, got %v", len(expect), changes)
+			}
+
+			for _, change := range changes {
+				restart, ok := expect[change.Setting]
+				if !ok {
+					t.Errorf("Unexpected change: %v", change)
+					continue
+				}
+
+				if change.RestartRequired != restart {
+					t.Errorf("Expected restartRequired=%v for %v", restart, change.Setting)
+				}
+
+				if change.Setting == "mgmtTokens" && (change.Old != nil || change.New != nil) {
+					t.Errorf("Expected values of mgmtTokens to be redacted, got %v", change)
+				}
+			}
+
+			// invalid configurations are not applied
+			write(`{"defaultKey": "/d", "queryPolicy": "invalid"}`)
+			if _, err := rt.ReloadConfig(); err == nil {
+				t.Errorf("Expected error reloading invalid config")
+			}
+
+			if rt.Config() != next {
+				t.Errorf("Expected config to be unchanged after invalid reload")
+			}
+
+			// reload through the management API
+			write(`{"defaultKey": "/e", "mgmtTokens": [{"name": "deploy", "sha256": "` + HashToken("secret") + `", "role": "write"}]}`)
+			client.Token = "secret"
+			if _, err := client.ReloadConfig(); err != nil {
+				t.Errorf("Error reloading config through the management API: %v", err)
+			}
+
+			if key := rt.Config().DefaultKey; key != "/e" {
+				t.Errorf("Expected reloaded defaultKey /e, got %v", key)
+			}
+		})
+	})
+}
+
+func TestDiffSecretSettings(t *testing.T) {
+	old := &Config{MgmtTokens: APITokens{{Name: "deploy", Hash: Secret(HashToken("old")), Role: WriteRole}}}
+	new := &Config{MgmtTokens: APITokens{{Name: "deploy", Hash: Secret(HashToken("new")), Role: WriteRole}}}
+
+	changes, err := diffConfig(old, new)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(changes) != 1 || changes[0].Setting != "mgmtTokens" || changes[0].New != nil {
+		t.Errorf("Expected a redacted change of mgmtTokens, got %v", changes)
+	}
+
+	if changes, err := diffConfig(old, old); err != nil {
+		panic(err)
+	} else if len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
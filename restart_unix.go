@@ -0,0 +1,151 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	restartSignals  = []os.Signal{syscall.SIGUSR2}
+	reloadSignals   = []os.Signal{syscall.SIGHUP}
+)
+
+// inheritListeners returns the listeners passed to this process by its parent
+// on restart, keyed by name.
+func inheritListeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	s := os.Getenv(listenersEnv)
+	if s == "" {
+		return listeners, nil
+	}
+	os.Unsetenv(listenersEnv)
+
+	for i, name := range strings.Split(s, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+
+		listeners[name] = ln
+	}
+
+	return listeners, nil
+}
+
+// isRestarted returns true if this process was started by the restart of a
+// parent process that is still serving.
+func isRestarted() bool {
+	return os.Getenv(listenersEnv) != ""
+}
+
+// notifyParent tells the parent process of a restarted server to shut down, so
+// that this process takes over its listeners.
+func notifyParent() error {
+	return syscall.Kill(os.Getppid(), syscall.SIGTERM)
+}
+
+// waitForParent blocks until the parent process of a restarted server has
+// exited.
+func waitForParent() {
+	ppid := os.Getppid()
+	for os.Getppid() == ppid {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Restart starts a new server process with the same arguments, which inherits
+// the listeners of the group and shuts down this process once it has loaded
+// its configuration. This process continues serving if the new process exits
+// before then.
+func (g *ServerGroup) Restart() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.restarted {
+		return fmt.Errorf("Restart already in progress")
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(g.servers))
+	files := make([]*os.File, 0, len(g.servers))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, s := range g.servers {
+		ln, ok := s.Listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("Listener %v cannot be passed to a new process", s.Name)
+		}
+
+		f, err := ln.File()
+		if err != nil {
+			return err
+		}
+
+		names = append(names, s.Name)
+		files = append(files, f)
+	}
+
+	env := make([]string, 0)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, listenersEnv+"=") {
+			env = append(env, v)
+		}
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(env, listenersEnv+"="+strings.Join(names, ","))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	g.restarted = true
+	g.Runtime.Logger.Infof("Restarting in new process %v", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	go func() {
+		select {
+		case <-g.stopped:
+			return
+
+		case err := <-exited:
+			g.Runtime.Logger.Errorf("Restart failed: process %v exited: %v", cmd.Process.Pid, err)
+
+		case <-time.After(restartTimeout):
+			g.Runtime.Logger.Errorf("Restart failed: process %v did not start within %v", cmd.Process.Pid, restartTimeout)
+			cmd.Process.Kill()
+		}
+
+		g.mu.Lock()
+		g.restarted = false
+		g.mu.Unlock()
+	}()
+
+	return nil
+}
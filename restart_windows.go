@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+var (
+	shutdownSignals = []os.Signal{os.Interrupt}
+	restartSignals  = []os.Signal{}
+	reloadSignals   = []os.Signal{}
+)
+
+// inheritListeners returns no listeners, as restarts are not supported.
+func inheritListeners() (map[string]net.Listener, error) {
+	return make(map[string]net.Listener), nil
+}
+
+func isRestarted() bool {
+	return false
+}
+
+func notifyParent() error {
+	return nil
+}
+
+func waitForParent() {}
+
+// Restart is not supported on Windows.
+func (g *ServerGroup) Restart() error {
+	return RestartNotSupportedError
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 )
 
 // Runtime contains globals for common runtime utilities.
 type Runtime struct {
-	Config       *Config
-	Logger       *log.Logger
-	AccessLogger *log.Logger
+	Logger       *Logger
+	AccessLogger *AccessLogger
 	Database     Database
+	Hits         *HitRecorder  // nil if hit recording is disabled
+	Misses       *MissRecorder // nil if miss recording is disabled
+	Metrics      *Metrics
+
+	config   atomic.Value // *Config
+	reloadMu sync.Mutex
 }
 
 var UnsupportedDatabaseDriverError = fmt.Errorf("Unsupported database driver")
@@ -21,53 +27,99 @@ func NewRuntime() (*Runtime, error) {
 		return nil, err
 	}
 
-	logger, err := NewLogger(cfg.LogFile)
+	rt, err := newRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
-	logger.Printf("Server started (v%v)", PACKAGE_VERSION)
 
-	accessLogger := logger
-	if cfg.AccessLogFile != cfg.LogFile {
-		accessLogger, err = NewLogger(cfg.AccessLogFile)
+	if err := rt.OpenDatabase(); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// newRuntime returns a Runtime for the given configuration, without opening
+// its database.
+func newRuntime(cfg *Config) (*Runtime, error) {
+	logger, err := NewLogger(cfg.LogFile, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Server started (v%v)", PACKAGE_VERSION)
+
+	var accessLogger *AccessLogger
+	if cfg.AccessLogFile == cfg.LogFile {
+		accessLogger = newAccessLogger(logger.out.w, cfg.AccessLogFormat)
+	} else {
+		accessLogger, err = NewAccessLogger(cfg.AccessLogFile, cfg.AccessLogFormat)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	var db Database
-	switch cfg.DatabaseDriver {
-	case "bolt":
-		db, err = OpenBoltDatabase(cfg)
-
-	case "redis":
-		db, err = OpenRedisDatabase(cfg)
-	default:
-		return nil, UnsupportedDatabaseDriverError
+	rt := &Runtime{
+		Logger:       logger,
+		AccessLogger: accessLogger,
+		Metrics:      NewMetrics(),
 	}
+	rt.SetConfig(cfg)
+
+	return rt, nil
+}
 
+// OpenDatabase opens the configured database, and the recorders of hits and
+// misses that write to it. It must be called before the Runtime serves
+// requests.
+func (rt *Runtime) OpenDatabase() error {
+	cfg := rt.Config()
+	db, err := OpenDatabase(cfg)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	dbstats, err := db.Stats()
 	if err != nil {
-		return nil, err
+		db.Close()
+		return err
 	}
 
-	logger.Printf("Connected to database %v://%v", cfg.DatabaseDriver, cfg.DatabasePath)
-	logger.Printf("  Total mappings: %v\n", dbstats.TotalMappings)
-	logger.Printf("  Disk usage: %v bytes\n", dbstats.DiskUsage)
+	rt.Logger.Infof("Connected to %v database", cfg.DatabaseDriver)
+	rt.Logger.Infof("  Total mappings: %v", dbstats.TotalMappings)
+	rt.Logger.Infof("  Disk usage: %v bytes", dbstats.DiskUsage)
 
-	return &Runtime{
-		Config:       cfg,
-		Logger:       logger,
-		AccessLogger: accessLogger,
-		Database:     db,
-	}, nil
+	if cfg.Cache.Size > 0 {
+		db = NewCachedDatabase(db, cfg.Cache)
+		rt.Logger.Infof("  Cache size: %v lookups", cfg.Cache.Size)
+	}
+
+	rt.Database = db
+	if cfg.StatsFlushInterval.Duration > 0 {
+		rt.Hits = NewHitRecorder(db)
+		if cfg.MaxMisses > 0 {
+			rt.Misses = NewMissRecorder(db, cfg.MaxMisses)
+		}
+	}
+
+	return nil
+}
+
+// Config returns the current configuration. The configuration is replaced
+// when it is reloaded and must not be modified, so handlers should read it
+// once for each request.
+func (rt *Runtime) Config() *Config {
+	c, _ := rt.config.Load().(*Config)
+	return c
+}
+
+// SetConfig replaces the current configuration.
+func (rt *Runtime) SetConfig(c *Config) {
+	rt.config.Store(c)
 }
 
 func (rt *Runtime) Close() error {
+	flushStats(rt)
+
 	if rt.Database != nil {
 		if err := rt.Database.Close(); err != nil {
 			return err
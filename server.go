@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// listenersEnv names the listeners passed to a restarted server process, in
+// the order of their file descriptors from 3.
+const listenersEnv = "REDIRECTOR_LISTENERS"
+
+var RestartNotSupportedError = fmt.Errorf("Restarts are not supported on this platform")
+
+// groupServer is a http.Server and its listener.
+type groupServer struct {
+	Name     string
+	Server   *http.Server
+	Listener net.Listener
+
+	err  error
+	done chan struct{} // closed when the server stops accepting connections
+
+	mu    sync.Mutex
+	fresh map[net.Conn]struct{} // connections without a request yet
+}
+
+// trackConn records connections that have been accepted but have not yet sent
+// a request. It is called on each change of connection state.
+func (s *groupServer) trackConn(c net.Conn, state http.ConnState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == http.StateNew {
+		s.fresh[c] = struct{}{}
+	} else {
+		delete(s.fresh, c)
+	}
+}
+
+// waitFresh waits until all accepted connections have sent a request, or until
+// the deadline. A http.Server drops requests that are read after it starts
+// shutting down, so connections accepted just before shutdown must be given
+// a chance to send their request first.
+func (s *groupServer) waitFresh(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.fresh)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *groupServer) serve() error {
+	if s.Server.TLSConfig != nil {
+		return s.Server.ServeTLS(s.Listener, "", "")
+	}
+
+	return s.Server.Serve(s.Listener)
+}
+
+// A ServerGroup serves the listeners of a Runtime until they are shut down
+// together. Listeners are inherited from the parent process if the server was
+// restarted.
+type ServerGroup struct {
+	Runtime *Runtime
+
+	servers   []*groupServer
+	inherited map[string]net.Listener
+	tasks     []func(*Runtime)
+	restarted bool // a new process is taking over the listeners
+
+	mu       sync.Mutex
+	closing  bool // listeners are being closed for shutdown
+	shutdown sync.Once
+	stopped  chan struct{} // closed when shutdown is complete
+}
+
+// NewServerGroup returns a ServerGroup with the listeners inherited from the
+// parent process, if any.
+func NewServerGroup(rt *Runtime) (*ServerGroup, error) {
+	inherited, err := inheritListeners()
+	if err != nil {
+		return nil, fmt.Errorf("Error inheriting listeners: %v", err)
+	}
+
+	return &ServerGroup{
+		Runtime:   rt,
+		inherited: inherited,
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+// Listen adds a named server to the group, listening on the address of the
+// server, or on the listener of the same name inherited from the parent
+// process. The server uses HTTPS if TLS is configured for the listener.
+func (g *ServerGroup) Listen(name string, s *http.Server, tc TLSConfig, hosts HostConfigs) error {
+	if tc.Enabled() {
+		c, err := newTLSConfig(tc, hosts, g.Runtime.Logger)
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = c
+	}
+
+	ln, ok := g.inherited[name]
+	if ok && !sameListenAddr(ln.Addr(), s.Addr) {
+		// the address was changed in the configuration
+		ln.Close()
+		ok = false
+	}
+	delete(g.inherited, name)
+
+	if ok {
+		g.Runtime.Logger.Debugf("Using inherited listener %v on %v", name, ln.Addr())
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", s.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	gs := &groupServer{
+		Name:     name,
+		Server:   s,
+		Listener: ln,
+		done:     make(chan struct{}),
+		fresh:    make(map[net.Conn]struct{}),
+	}
+
+	if s.ErrorLog == nil {
+		s.ErrorLog = g.Runtime.Logger.StdLogger(WarnLevel)
+	}
+
+	connState := s.ConnState
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		gs.trackConn(c, state)
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+
+	g.servers = append(g.servers, gs)
+	return nil
+}
+
+// sameListenAddr returns true if a listener address has the same port as the
+// given address.
+func sameListenAddr(addr net.Addr, s string) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+
+	return port == fmt.Sprintf("%d", tcp.Port)
+}
+
+// Addr returns the address of the named listener, or nil.
+func (g *ServerGroup) Addr(name string) net.Addr {
+	for _, s := range g.servers {
+		if s.Name == name {
+			return s.Listener.Addr()
+		}
+	}
+
+	return nil
+}
+
+// Go runs a background task of the Runtime once the group starts serving.
+func (g *ServerGroup) Go(task func(*Runtime)) {
+	g.tasks = append(g.tasks, task)
+}
+
+// Serve serves all listeners until the group is shut down, or until any server
+// fails and the others are shut down. It returns once shutdown is complete.
+func (g *ServerGroup) Serve() error {
+	// inherited listeners that are no longer configured
+	for name, ln := range g.inherited {
+		g.Runtime.Logger.Infof("Closing inherited listener %v", name)
+		ln.Close()
+	}
+
+	for _, task := range g.tasks {
+		go task(g.Runtime)
+	}
+
+	for _, s := range g.servers {
+		go func(s *groupServer) {
+			defer close(s.done)
+			if err := s.serve(); !g.isClosing() {
+				s.err = err
+				go g.Shutdown()
+			}
+		}(s)
+	}
+
+	<-g.stopped
+	for _, s := range g.servers {
+		if s.err != nil {
+			return fmt.Errorf("Error serving %v listener: %v", s.Name, s.err)
+		}
+	}
+
+	return nil
+}
+
+func (g *ServerGroup) isClosing() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closing
+}
+
+// Shutdown stops all listeners and waits for active requests to complete, for
+// up to the configured shutdown timeout. Remaining connections are closed. It
+// must only be called once the group is serving.
+func (g *ServerGroup) Shutdown() {
+	g.shutdown.Do(func() {
+		defer close(g.stopped)
+
+		timeout := g.Runtime.Config().ShutdownTimeout.Duration
+		g.Runtime.Logger.Infof("Shutting down (timeout: %v)", timeout)
+
+		// stop accepting first, so that connections accepted during shutdown
+		// are tracked by their server before it drains
+		g.mu.Lock()
+		g.closing = true
+		g.mu.Unlock()
+
+		for _, s := range g.servers {
+			s.Listener.Close()
+		}
+
+		for _, s := range g.servers {
+			<-s.done
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		deadline := time.Now().Add(freshConnTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		for _, s := range g.servers {
+			s.waitFresh(deadline)
+		}
+
+		var wg sync.WaitGroup
+		for _, s := range g.servers {
+			wg.Add(1)
+			go func(s *groupServer) {
+				defer wg.Done()
+				if err := s.Server.Shutdown(ctx); err != nil {
+					g.Runtime.Logger.Warnf("Closing %v connections after shutdown timeout: %v", s.Name, err)
+					s.Server.Close()
+				}
+			}(s)
+		}
+		wg.Wait()
+	})
+}
+
+// handleSignals shuts down the group on an interrupt or termination signal,
+// restarts the server in a new process on a restart signal and reloads the
+// configuration on a reload signal.
+func (g *ServerGroup) handleSignals() {
+	signals := append(append(shutdownSignals, restartSignals...), reloadSignals...)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-g.stopped:
+			return
+
+		case sig := <-c:
+			if isSignal(sig, restartSignals) {
+				if err := g.Restart(); err != nil {
+					g.Runtime.Logger.Errorf("Error restarting: %v", err)
+				}
+				continue
+			}
+
+			if isSignal(sig, reloadSignals) {
+				if _, err := g.Runtime.ReloadConfig(); err != nil {
+					g.Runtime.Logger.Errorf("Error reloading configuration: %v", err)
+				}
+				continue
+			}
+
+			g.Runtime.Logger.Infof("Received %v", sig)
+			go g.Shutdown()
+		}
+	}
+}
+
+func isSignal(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if sig == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// freshConnTimeout is the time allowed on shutdown for accepted connections to
+// send their first request before they are closed.
+var freshConnTimeout = time.Second
+
+// restartTimeout is the time allowed for a restarted process to take over the
+// listeners of its parent before the restart is abandoned.
+var restartTimeout = time.Minute
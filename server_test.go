@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testServerGroup serves a handler on a loopback port in a ServerGroup.
+func testServerGroup(timeout time.Duration, h http.Handler, fn func(g *ServerGroup, url string)) {
+	rt := &Runtime{
+		Logger:       newLogger(ioutil.Discard, TextLog, InfoLevel),
+		AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
+	}
+	rt.SetConfig(&Config{ShutdownTimeout: Duration{timeout}})
+
+	g, err := NewServerGroup(rt)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &http.Server{Addr: "127.0.0.1:0", Handler: h}
+	if err := g.Listen("test", s, TLSConfig{}, nil); err != nil {
+		panic(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- g.Serve()
+	}()
+
+	fn(g, "http://"+g.Addr("test").String()+"/")
+
+	g.Shutdown()
+	if err := <-served; err != nil {
+		panic(err)
+	}
+}
+
+func TestServerGroupShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testServerGroup(time.Minute, h, func(g *ServerGroup, url string) {
+		status := make(chan int, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err != nil {
+				t.Errorf("Error completing active request: %v", err)
+				status <- 0
+				return
+			}
+			res.Body.Close()
+			status <- res.StatusCode
+		}()
+
+		<-started
+		stopped := make(chan struct{})
+		go func() {
+			g.Shutdown()
+			close(stopped)
+		}()
+
+		// wait for the listener to close
+		for !g.isClosing() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		<-g.servers[0].done
+
+		select {
+		case <-stopped:
+			t.Errorf("Expected shutdown to wait for active request")
+		default:
+		}
+
+		if _, err := http.Get(url); err == nil {
+			t.Errorf("Expected new connections to be refused during shutdown")
+		}
+
+		close(release)
+		if code := <-status; code != http.StatusNoContent {
+			t.Errorf("Expected status %v for active request, got %v", http.StatusNoContent, code)
+		}
+
+		<-stopped
+	})
+}
+
+func TestServerGroupShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	testServerGroup(100*time.Millisecond, h, func(g *ServerGroup, url string) {
+		failed := make(chan error, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err == nil {
+				res.Body.Close()
+			}
+			failed <- err
+		}()
+
+		<-started
+		start := time.Now()
+		g.Shutdown()
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Expected shutdown within timeout, took %v", d)
+		}
+
+		if err := <-failed; err == nil {
+			t.Errorf("Expected stuck request to be closed after shutdown timeout")
+		}
+	})
+}
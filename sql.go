@@ -0,0 +1,875 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	for name := range sqlDialects {
+		RegisterDriver(name, &Driver{
+			Open:    OpenSQLDatabase,
+			Options: newSQLOptions,
+		})
+	}
+}
+
+// SQLOptions are the database options of the sqlite and postgres drivers.
+type SQLOptions struct {
+	DSN             string   `json:"dsn"`             // data source name, such as a file name or connection string
+	MaxOpenConns    int      `json:"maxOpenConns"`    // zero for the driver default
+	MaxIdleConns    int      `json:"maxIdleConns"`    // zero for the database/sql default
+	ConnMaxLifetime Duration `json:"connMaxLifetime"` // zero for no limit
+}
+
+// newSQLOptions returns the default options of the SQL drivers.
+func newSQLOptions(cfg *Config) interface{} {
+	return &SQLOptions{
+		DSN: cfg.DatabasePath,
+	}
+}
+
+// sqlDialect describes the differences between the SQL databases supported by
+// SQLDatabase.
+type sqlDialect struct {
+	driver       string // database/sql driver name
+	numbered     bool   // placeholders are numbered ($1) instead of ?
+	maxOpenConns int    // default connection limit; zero for no limit
+	sizeQuery    string // returns the size in bytes of the mappings table
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"sqlite": {
+		driver: "sqlite3",
+
+		// sqlite allows only one writer at a time
+		maxOpenConns: 1,
+
+		// sqlite reports the size of the whole database file
+		sizeQuery: "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+	},
+	"postgres": {
+		driver:    "postgres",
+		numbered:  true,
+		sizeQuery: "SELECT pg_total_relation_size('mappings')",
+	},
+}
+
+// sqlMigrations are applied in order to create and upgrade the database
+// schema. The number of applied migrations is stored in the schema_version
+// table. Migrations must never be modified once released; add a new migration
+// instead. All times are stored as nanoseconds since the Unix epoch.
+var sqlMigrations = []string{
+	`CREATE TABLE mappings (
+		ns TEXT NOT NULL,
+		key TEXT NOT NULL,
+		type TEXT NOT NULL,
+		dest TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		perm BOOLEAN NOT NULL,
+		comment TEXT NOT NULL,
+		priority INTEGER NOT NULL,
+		query TEXT NOT NULL,
+		not_before BIGINT,
+		not_after BIGINT,
+		is_template BOOLEAN NOT NULL,
+		PRIMARY KEY (ns, key)
+	)`,
+	`CREATE INDEX mappings_type ON mappings (ns, type)`,
+	`CREATE INDEX mappings_not_after ON mappings (ns, not_after)`,
+	`CREATE TABLE hits (
+		ns TEXT NOT NULL,
+		key TEXT NOT NULL,
+		count BIGINT NOT NULL,
+		first_hit BIGINT NOT NULL,
+		last_hit BIGINT NOT NULL,
+		PRIMARY KEY (ns, key)
+	)`,
+	`CREATE TABLE misses (
+		ns TEXT NOT NULL,
+		key TEXT NOT NULL,
+		count BIGINT NOT NULL,
+		referer TEXT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		PRIMARY KEY (ns, key)
+	)`,
+	`CREATE INDEX misses_last_seen ON misses (ns, last_seen)`,
+	`ALTER TABLE mappings ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE mappings ADD COLUMN modified BIGINT`,
+	`CREATE TABLE history (
+		ns TEXT NOT NULL,
+		key TEXT NOT NULL,
+		time BIGINT NOT NULL,
+		change TEXT NOT NULL
+	)`,
+	`CREATE INDEX history_key ON history (ns, key, time)`,
+	`CREATE INDEX history_time ON history (ns, time)`,
+}
+
+// sqlMappingColumns are the columns of the mappings table, in the order read
+// by scanMapping.
+const sqlMappingColumns = "key, type, dest, status, perm, comment, priority, query, not_before, not_after, is_template, revision, modified"
+
+// SQLDatabase implements Database to enable storage of URL mappings in a SQL
+// database using database/sql. Mappings of all namespaces are stored in the
+// same tables and distinguished by the ns column.
+type SQLDatabase struct {
+	cfg     *Config
+	db      *sql.DB
+	dialect *sqlDialect
+	ns      string // host namespace or empty for the default namespace
+}
+
+// OpenSQLDatabase opens the SQL database named by cfg.DatabaseDriver and
+// applies any outstanding schema migrations.
+func OpenSQLDatabase(cfg *Config) (Database, error) {
+	dialect, ok := sqlDialects[cfg.DatabaseDriver]
+	if !ok {
+		return nil, UnsupportedDatabaseDriverError
+	}
+
+	opts := newSQLOptions(cfg).(*SQLOptions)
+	if err := decodeDatabaseOptions(cfg, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.DSN == "" {
+		return nil, fmt.Errorf("No data source name configured for database driver %v", cfg.DatabaseDriver)
+	}
+
+	sdb, err := sql.Open(dialect.driver, opts.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxOpenConns == 0 {
+		opts.MaxOpenConns = dialect.maxOpenConns
+	}
+	sdb.SetMaxOpenConns(opts.MaxOpenConns)
+
+	// zero idle connections would open a new connection for every query
+	if opts.MaxIdleConns != 0 {
+		sdb.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime.Duration > 0 {
+		sdb.SetConnMaxLifetime(opts.ConnMaxLifetime.Duration)
+	}
+
+	db := &SQLDatabase{
+		cfg:     cfg,
+		db:      sdb,
+		dialect: dialect,
+	}
+
+	if err := db.migrate(); err != nil {
+		sdb.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// migrate applies all schema migrations that have not yet been applied.
+func (db *SQLDatabase) migrate() error {
+	if _, err := db.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version >= len(sqlMigrations) {
+		return nil
+	}
+
+	for _, q := range sqlMigrations[version:] {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(db.rebind("INSERT INTO schema_version (version) VALUES (?)"), len(sqlMigrations)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebind replaces the ? placeholders in q with the placeholders of the SQL
+// dialect.
+func (db *SQLDatabase) rebind(q string) string {
+	if !db.dialect.numbered {
+		return q
+	}
+
+	b := &strings.Builder{}
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func (db *SQLDatabase) Close() error {
+	return db.db.Close()
+}
+
+// Namespace returns a view of the database in which all mappings are stored
+// with the given host name in the ns column.
+func (db *SQLDatabase) Namespace(name string) (Database, error) {
+	return &SQLDatabase{
+		cfg:     db.cfg,
+		db:      db.db,
+		dialect: db.dialect,
+		ns:      name,
+	}, nil
+}
+
+// Stats returns the number of mappings in the namespace and the size of the
+// mappings table.
+func (db *SQLDatabase) Stats() (DatabaseStats, error) {
+	stats := DatabaseStats{}
+	if err := db.db.QueryRow(db.rebind("SELECT COUNT(*) FROM mappings WHERE ns = ?"), db.ns).Scan(&stats.TotalMappings); err != nil {
+		return DatabaseStats{}, err
+	}
+
+	if err := db.db.QueryRow(db.dialect.sizeQuery).Scan(&stats.DiskUsage); err != nil {
+		return DatabaseStats{}, err
+	}
+
+	return stats, nil
+}
+
+// nanos returns t as nanoseconds since the Unix epoch or NULL if t is nil.
+func nanos(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// scanMapping reads a mapping from the columns listed in sqlMappingColumns.
+func scanMapping(row interface {
+	Scan(dest ...interface{}) error
+}) (*Mapping, error) {
+	m := &Mapping{}
+	var notBefore, notAfter, modified sql.NullInt64
+	if err := row.Scan(&m.Key, &m.Type, &m.Destination, &m.Status, &m.Permanent, &m.Comment, &m.Priority, &m.Query, &notBefore, &notAfter, &m.IsTemplate, &m.Revision, &modified); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, MappingNotFoundError
+		}
+		return nil, err
+	}
+
+	if notBefore.Valid {
+		t := time.Unix(0, notBefore.Int64)
+		m.NotBefore = &t
+	}
+
+	if notAfter.Valid {
+		t := time.Unix(0, notAfter.Int64)
+		m.NotAfter = &t
+	}
+
+	if modified.Valid {
+		t := time.Unix(0, modified.Int64)
+		m.Modified = &t
+	}
+
+	return m, nil
+}
+
+// queryMappings returns all mappings returned by the given query.
+func (db *SQLDatabase) queryMappings(q string, args ...interface{}) ([]*Mapping, error) {
+	return db.queryTxMappings(db.db, q, args...)
+}
+
+// queryTxMappings returns all mappings returned by the given query of a
+// database or transaction.
+func (db *SQLDatabase) queryTxMappings(tx interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, q string, args ...interface{}) ([]*Mapping, error) {
+	rows, err := tx.Query(db.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappings := make([]*Mapping, 0)
+	for rows.Next() {
+		m, err := scanMapping(rows)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+
+	return mappings, rows.Err()
+}
+
+func (db *SQLDatabase) AddMapping(m *Mapping) error {
+	_, err := db.AddMappingIf(m, AnyRevision, "")
+	return err
+}
+
+// AddMappingIf adds or replaces a mapping if the stored mapping matches the
+// given revision, and records the change in the history table in the same
+// transaction. The mapping is only written if it was not modified since it was
+// read, and the transaction is retried otherwise. The mapping is stored with
+// its normalized key.
+func (db *SQLDatabase) AddMappingIf(m *Mapping, rev int64, actor string) (*MappingChange, error) {
+	key := db.cfg.Normalize.MappingKey(m)
+	for {
+		change, err := db.withTx(func(tx *sql.Tx) (*MappingChange, error) {
+			return db.addMapping(tx, m, key, rev, actor)
+		})
+		if err == errSQLModified {
+			continue
+		}
+
+		return change, err
+	}
+}
+
+// errSQLModified is returned within a transaction if a mapping was modified by
+// another client after it was read.
+var errSQLModified = fmt.Errorf("Mapping was modified concurrently")
+
+// withTx calls fn within a transaction that is committed if fn succeeds.
+func (db *SQLDatabase) withTx(fn func(tx *sql.Tx) (*MappingChange, error)) (*MappingChange, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	change, err := fn(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return change, tx.Commit()
+}
+
+// getMapping returns the stored mapping with the given key within the given
+// transaction, or nil if it does not exist.
+func (db *SQLDatabase) getMapping(tx *sql.Tx, key string) (*Mapping, error) {
+	m, err := scanMapping(tx.QueryRow(db.rebind("SELECT "+sqlMappingColumns+" FROM mappings WHERE ns = ? AND key = ?"), db.ns, key))
+	if err == MappingNotFoundError {
+		return nil, nil
+	}
+
+	return m, err
+}
+
+// addMapping writes a mapping with the given key and records the change within
+// the given transaction.
+func (db *SQLDatabase) addMapping(tx *sql.Tx, m *Mapping, key string, rev int64, actor string) (*MappingChange, error) {
+	cur, err := db.getMapping(tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRevision(cur, rev); err != nil {
+		return nil, err
+	}
+
+	nextRevision(m, cur)
+	args := []interface{}{string(m.Type), m.Destination, m.Status, m.Permanent, m.Comment, m.Priority, string(m.Query), nanos(m.NotBefore), nanos(m.NotAfter), m.IsTemplate, nanos(m.Modified), m.Revision, db.ns, key}
+
+	var q string
+	if cur == nil {
+		q = `INSERT INTO mappings (type, dest, status, perm, comment, priority, query, not_before, not_after, is_template, modified, revision, ns, key)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (ns, key) DO NOTHING`
+	} else {
+		q = `UPDATE mappings SET
+				type = ?,
+				dest = ?,
+				status = ?,
+				perm = ?,
+				comment = ?,
+				priority = ?,
+				query = ?,
+				not_before = ?,
+				not_after = ?,
+				is_template = ?,
+				modified = ?,
+				revision = ?
+			WHERE ns = ? AND key = ? AND revision = ?`
+		args = append(args, cur.Revision)
+	}
+
+	res, err := tx.Exec(db.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		if rev == AnyRevision {
+			return nil, errSQLModified
+		}
+		return nil, RevisionMismatchError
+	}
+
+	v := *m
+	v.Key = key
+	change := newChange(key, cur, &v, actor, *v.Modified)
+	return change, db.addChange(tx, change)
+}
+
+func (db *SQLDatabase) GetMapping(key string) (*Mapping, error) {
+	row := db.db.QueryRow(db.rebind("SELECT "+sqlMappingColumns+" FROM mappings WHERE ns = ? AND key = ?"), db.ns, key)
+	return scanMapping(row)
+}
+
+// GetPrefixMapping returns the prefix mapping with the longest key that is a
+// prefix of the given key.
+func (db *SQLDatabase) GetPrefixMapping(key string) (*Mapping, error) {
+	// compare all prefixes of key, as the ordering of text columns depends on
+	// the collation of the database
+	args := []interface{}{db.ns, string(PrefixMapping)}
+	for i := len(key); i > 0; i-- {
+		if i == len(key) || utf8.RuneStart(key[i]) {
+			args = append(args, key[:i])
+		}
+	}
+
+	if len(args) == 2 {
+		return nil, MappingNotFoundError
+	}
+
+	q := "SELECT " + sqlMappingColumns + " FROM mappings WHERE ns = ? AND type = ? AND key IN (?" +
+		strings.Repeat(", ?", len(args)-3) + ") ORDER BY LENGTH(key) DESC LIMIT 1"
+
+	return scanMapping(db.db.QueryRow(db.rebind(q), args...))
+}
+
+// GetRegexpMappings returns all regexp mappings in evaluation order.
+func (db *SQLDatabase) GetRegexpMappings() ([]*Mapping, error) {
+	mappings, err := db.queryMappings("SELECT "+sqlMappingColumns+" FROM mappings WHERE ns = ? AND type = ?", db.ns, string(RegexpMapping))
+	if err != nil {
+		return nil, err
+	}
+
+	sortRegexpMappings(mappings)
+	return mappings, nil
+}
+
+func (db *SQLDatabase) GetMappings() ([]*Mapping, error) {
+	return db.queryMappings("SELECT "+sqlMappingColumns+" FROM mappings WHERE ns = ? ORDER BY key", db.ns)
+}
+
+// sqlLikeEscaper escapes the wildcards of a LIKE pattern.
+var sqlLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListMappings returns a page of mappings in key order. The cursor of the next
+// page is the key of the last mapping in the page.
+func (db *SQLDatabase) ListMappings(opts ListOptions) ([]*Mapping, string, error) {
+	q := "SELECT " + sqlMappingColumns + " FROM mappings WHERE ns = ? AND key > ?"
+	args := []interface{}{db.ns, opts.After}
+	if opts.Prefix != "" {
+		q += " AND SUBSTR(key, 1, ?) = ?"
+		args = append(args, utf8.RuneCountInString(opts.Prefix), opts.Prefix)
+	}
+
+	if opts.Search != "" {
+		q += ` AND (LOWER(dest) LIKE ? ESCAPE '\' OR LOWER(comment) LIKE ? ESCAPE '\')`
+		pattern := "%" + sqlLikeEscaper.Replace(strings.ToLower(opts.Search)) + "%"
+		args = append(args, pattern, pattern)
+	}
+
+	q += " ORDER BY key"
+	if opts.Limit > 0 {
+		// fetch one more row to detect the last page
+		q += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	mappings, err := db.queryMappings(q, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.Limit > 0 && len(mappings) > opts.Limit {
+		mappings = mappings[:opts.Limit]
+		return mappings, mappings[len(mappings)-1].Key, nil
+	}
+
+	return mappings, "", nil
+}
+
+func (db *SQLDatabase) DeleteMapping(key string) error {
+	_, err := db.DeleteMappingIf(key, AnyRevision, "")
+	return err
+}
+
+// DeleteMappingIf deletes a mapping and its recorded hits if the stored
+// mapping matches the given revision, and records the change in the history
+// table in the same transaction.
+func (db *SQLDatabase) DeleteMappingIf(key string, rev int64, actor string) (*MappingChange, error) {
+	for {
+		change, err := db.withTx(func(tx *sql.Tx) (*MappingChange, error) {
+			cur, err := db.getMapping(tx, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if cur == nil {
+				return nil, MappingNotFoundError
+			}
+
+			if err := checkRevision(cur, rev); err != nil {
+				return nil, err
+			}
+
+			change := newChange(key, cur, nil, actor, time.Now())
+			if ok, err := db.removeMapping(tx, change); err != nil {
+				return nil, err
+			} else if !ok {
+				if rev == AnyRevision {
+					return nil, errSQLModified
+				}
+				return nil, RevisionMismatchError
+			}
+
+			return change, nil
+		})
+		if err == errSQLModified {
+			continue
+		}
+
+		return change, err
+	}
+}
+
+// removeMapping deletes the previous mapping of a delete change, if it was not
+// modified since it was read, and its recorded hits, and records the change
+// within the given transaction. It returns false if the mapping was modified.
+func (db *SQLDatabase) removeMapping(tx *sql.Tx, change *MappingChange) (bool, error) {
+	res, err := tx.Exec(db.rebind("DELETE FROM mappings WHERE ns = ? AND key = ? AND revision = ?"), db.ns, change.Key, change.Previous.Revision)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(db.rebind("DELETE FROM hits WHERE ns = ? AND key = ?"), db.ns, change.Key); err != nil {
+		return false, err
+	}
+
+	return true, db.addChange(tx, change)
+}
+
+// sqlDeletePageSize is the number of mappings deleted in each transaction by
+// DeleteMappings and DeleteExpiredMappings.
+var sqlDeletePageSize = 1000
+
+// deleteMappings deletes the mappings that match the given condition and their
+// recorded hits, and records their deletion in the history table. Mappings are
+// deleted in transactions of up to sqlDeletePageSize mappings.
+func (db *SQLDatabase) deleteMappings(actor, cond string, args ...interface{}) (int64, error) {
+	q := "SELECT " + sqlMappingColumns + " FROM mappings WHERE ns = ?" + cond + " ORDER BY key LIMIT ?"
+	args = append(append([]interface{}{db.ns}, args...), sqlDeletePageSize)
+
+	var count int64
+	for {
+		tx, err := db.db.Begin()
+		if err != nil {
+			return count, err
+		}
+
+		mappings, err := db.queryTxMappings(tx, q, args...)
+		if err != nil {
+			tx.Rollback()
+			return count, err
+		}
+
+		var n int64
+		now := time.Now()
+		for _, m := range mappings {
+			ok, err := db.removeMapping(tx, newChange(m.Key, m, nil, actor, now))
+			if err != nil {
+				tx.Rollback()
+				return count, err
+			}
+
+			// mappings modified since they were read are deleted with the
+			// next page, if they still match
+			if ok {
+				n++
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return count, err
+		}
+
+		count += n
+		if len(mappings) < sqlDeletePageSize {
+			return count, nil
+		}
+	}
+}
+
+// DeleteExpiredMappings deletes all mappings that expired before the given
+// time, and records their deletion in the history table.
+func (db *SQLDatabase) DeleteExpiredMappings(before time.Time, actor string) (int64, error) {
+	return db.deleteMappings(actor, " AND not_after < ?", before.UnixNano())
+}
+
+// DeleteMappings deletes all mappings in the namespace and their recorded
+// hits, and records their deletion in the history table.
+func (db *SQLDatabase) DeleteMappings(actor string) (int64, error) {
+	n, err := db.deleteMappings(actor, "")
+	if err != nil {
+		return n, err
+	}
+
+	// hits recorded for keys without a mapping
+	if _, err := db.db.Exec(db.rebind("DELETE FROM hits WHERE ns = ?"), db.ns); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// AddHits adds the given hits to the recorded hits of each mapping.
+func (db *SQLDatabase) AddHits(hits []*MappingHits) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(db.rebind(`INSERT INTO hits (ns, key, count, first_hit, last_hit)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ns, key) DO UPDATE SET
+			count = hits.count + excluded.count,
+			first_hit = CASE WHEN excluded.first_hit < hits.first_hit THEN excluded.first_hit ELSE hits.first_hit END,
+			last_hit = CASE WHEN excluded.last_hit > hits.last_hit THEN excluded.last_hit ELSE hits.last_hit END`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, h := range hits {
+		if _, err := stmt.Exec(db.ns, h.Key, h.Count, h.FirstHit.UnixNano(), h.LastHit.UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetHits returns the recorded hits of the mappings with the given keys, or
+// of all mappings that have been hit if no keys are given.
+func (db *SQLDatabase) GetHits(keys ...string) ([]*MappingHits, error) {
+	q := "SELECT key, count, first_hit, last_hit FROM hits WHERE ns = ?"
+	args := []interface{}{db.ns}
+	if len(keys) > 0 {
+		q += " AND key IN (?" + strings.Repeat(", ?", len(keys)-1) + ")"
+		for _, key := range keys {
+			args = append(args, key)
+		}
+	}
+
+	rows, err := db.db.Query(db.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := make([]*MappingHits, 0)
+	for rows.Next() {
+		h := &MappingHits{}
+		var first, last int64
+		if err := rows.Scan(&h.Key, &h.Count, &first, &last); err != nil {
+			return nil, err
+		}
+
+		h.FirstHit = time.Unix(0, first)
+		h.LastHit = time.Unix(0, last)
+		hits = append(hits, h)
+	}
+
+	return hits, rows.Err()
+}
+
+// AddMisses adds the given misses to the recorded misses of each key. Only the
+// max most recently seen keys are retained.
+func (db *SQLDatabase) AddMisses(misses []*Miss, max int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(db.rebind(`INSERT INTO misses (ns, key, count, referer, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ns, key) DO UPDATE SET
+			count = misses.count + excluded.count,
+			referer = CASE WHEN excluded.last_seen >= misses.last_seen AND excluded.referer <> '' THEN excluded.referer ELSE misses.referer END,
+			last_seen = CASE WHEN excluded.last_seen > misses.last_seen THEN excluded.last_seen ELSE misses.last_seen END`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, m := range misses {
+		if _, err := stmt.Exec(db.ns, m.Key, m.Count, m.Referer, m.LastSeen.UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	// evict the least recently seen keys
+	var n int
+	if err := tx.QueryRow(db.rebind("SELECT COUNT(*) FROM misses WHERE ns = ?"), db.ns).Scan(&n); err != nil {
+		return err
+	}
+
+	if n > max {
+		if _, err := tx.Exec(db.rebind(`DELETE FROM misses WHERE ns = ? AND key IN (
+			SELECT key FROM misses WHERE ns = ? ORDER BY last_seen, key LIMIT ?)`), db.ns, db.ns, n-max); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetMisses returns up to limit of the most requested missing keys. If limit
+// is zero, all missing keys are returned.
+func (db *SQLDatabase) GetMisses(limit int) ([]*Miss, error) {
+	rows, err := db.db.Query(db.rebind("SELECT key, count, referer, last_seen FROM misses WHERE ns = ?"), db.ns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	misses := make([]*Miss, 0)
+	for rows.Next() {
+		m := &Miss{}
+		var last int64
+		if err := rows.Scan(&m.Key, &m.Count, &m.Referer, &last); err != nil {
+			return nil, err
+		}
+
+		m.LastSeen = time.Unix(0, last)
+		misses = append(misses, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortMisses(misses)
+	if limit > 0 && len(misses) > limit {
+		misses = misses[:limit]
+	}
+
+	return misses, nil
+}
+
+func (db *SQLDatabase) DeleteMiss(key string) error {
+	_, err := db.db.Exec(db.rebind("DELETE FROM misses WHERE ns = ? AND key = ?"), db.ns, key)
+	return err
+}
+
+// AddChanges appends the given changes to the history table. Each change is
+// stored as a JSON document.
+func (db *SQLDatabase) AddChanges(changes []*MappingChange) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range changes {
+		if err := db.addChange(tx, c); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// addChange appends a change to the history table within the given
+// transaction.
+func (db *SQLDatabase) addChange(tx *sql.Tx, c *MappingChange) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(db.rebind("INSERT INTO history (ns, key, time, change) VALUES (?, ?, ?, ?)"), db.ns, c.Key, c.Time.UnixNano(), string(b))
+	return err
+}
+
+// queryChanges returns all changes returned by the given query.
+func (db *SQLDatabase) queryChanges(q string, args ...interface{}) ([]*MappingChange, error) {
+	rows, err := db.db.Query(db.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]*MappingChange, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+
+		c := &MappingChange{}
+		if err := json.Unmarshal([]byte(s), c); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+// GetHistory returns all changes to the given mapping key in the order they
+// were made.
+func (db *SQLDatabase) GetHistory(key string) ([]*MappingChange, error) {
+	return db.queryChanges("SELECT change FROM history WHERE ns = ? AND key = ? ORDER BY time", db.ns, key)
+}
+
+// GetChanges returns all changes made since the given time, in the order they
+// were made.
+func (db *SQLDatabase) GetChanges(since time.Time) ([]*MappingChange, error) {
+	return db.queryChanges("SELECT change FROM history WHERE ns = ? AND time >= ? ORDER BY time", db.ns, since.UnixNano())
+}
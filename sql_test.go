@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tmpSQLiteDB(fn func(Database)) {
+	dbf, err := ioutil.TempFile("", "sqlite_test_")
+	if err != nil {
+		panic(err)
+	}
+	if err := dbf.Close(); err != nil {
+		panic(err)
+	}
+	defer os.Remove(dbf.Name())
+
+	cfg := &Config{
+		DatabaseDriver:  "sqlite",
+		DatabaseOptions: DatabaseOptions(fmt.Sprintf(`{"dsn": %q}`, dbf.Name())),
+	}
+	db, err := OpenSQLDatabase(cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	fn(db)
+}
+
+func TestSQLite(t *testing.T) {
+	// delete mappings in more than one page
+	defer func(n int) { sqlDeletePageSize = n }(sqlDeletePageSize)
+	sqlDeletePageSize = 2
+
+	tmpSQLiteDB(func(db Database) {
+		testDB(t, db)
+		testDBNamespaces(t, db)
+		testDBStats(t, db)
+		testDBListMappings(t, db)
+		testDBRevisions(t, db)
+		testDBHistory(t, db)
+		testDBExpiredMappings(t, db)
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	tmpSQLiteDB(func(db Database) {
+		sdb := db.(*SQLDatabase)
+
+		// migrations are applied once
+		if err := sdb.migrate(); err != nil {
+			t.Fatalf("Error reapplying migrations: %v", err)
+		}
+
+		var version int
+		if err := sdb.db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+			panic(err)
+		}
+
+		if version != len(sqlMigrations) {
+			t.Errorf("Expected schema version %v, got %v", len(sqlMigrations), version)
+		}
+	})
+}
+
+func TestSQLiteMemory(t *testing.T) {
+	// an in-memory database only lives as long as its connection
+	db, err := OpenSQLDatabase(&Config{
+		DatabaseDriver:  "sqlite",
+		DatabaseOptions: DatabaseOptions(`{"dsn": ":memory:"}`),
+	})
+	if err != nil {
+		t.Fatalf("Error opening in-memory database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.AddMapping(&Mapping{Key: "/a", Destination: "/b"}); err != nil {
+		t.Fatalf("Error adding mapping: %v", err)
+	}
+
+	if _, err := db.GetMapping("/a"); err != nil {
+		t.Errorf("Error getting mapping: %v", err)
+	}
+}
+
+func TestSQLRebind(t *testing.T) {
+	db := &SQLDatabase{dialect: sqlDialects["postgres"]}
+	if q := db.rebind("SELECT ? FROM t WHERE a = ? AND b = ?"); q != "SELECT $1 FROM t WHERE a = $2 AND b = $3" {
+		t.Errorf("Bad rebound query: %v", q)
+	}
+
+	db = &SQLDatabase{dialect: sqlDialects["sqlite"]}
+	if q := db.rebind("SELECT ?"); q != "SELECT ?" {
+		t.Errorf("Bad rebound query: %v", q)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+)
+
+// sweeperActor is the actor recorded in the history of mappings deleted by the
+// sweeper.
+const sweeperActor = "sweeper"
+
+// sweepMappings periodically deletes mappings from the database that expired
+// longer ago than the configured retention period. It blocks indefinitely and
+// should be run in its own goroutine.
+func sweepMappings(rt *Runtime) {
+	ticker := time.NewTicker(rt.Config().SweepInterval.Duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cfg := rt.Config()
+		before := time.Now().Add(-cfg.ExpiredRetention.Duration)
+		namespaces := []string{""}
+		for name := range cfg.Hosts {
+			namespaces = append(namespaces, name)
+		}
+
+		for _, ns := range namespaces {
+			db, err := rt.Database.Namespace(ns)
+			if err != nil {
+				rt.Logger.Errorf("Error purging expired mappings: %v", err)
+				continue
+			}
+
+			n, err := db.DeleteExpiredMappings(before, sweeperActor)
+			if err != nil {
+				rt.Logger.Errorf("Error purging expired mappings: %v", err)
+				continue
+			}
+
+			if n > 0 {
+				rt.Logger.Infof("Purged %v mappings that expired before %v", n, before.Format(time.RFC3339))
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"sync"
 )
 
 const (
@@ -23,16 +24,30 @@ var (
 	statusCodes = []int{
 		http.StatusMovedPermanently,
 		http.StatusFound,
+		http.StatusSeeOther,
 		http.StatusTemporaryRedirect,
 		http.StatusPermanentRedirect,
 		http.StatusNotFound,
+		http.StatusGone,
 		http.StatusInternalServerError,
 	}
 
 	bodies = make(map[int]string, 0)
+
+	templatesOnce sync.Once
+	templatesErr  error
 )
 
+// InitTemplates renders the response body for each status code. Bodies are
+// only rendered once, so it is safe to call while requests are served.
 func InitTemplates() error {
+	templatesOnce.Do(func() {
+		templatesErr = initTemplates()
+	})
+	return templatesErr
+}
+
+func initTemplates() error {
 	tmpl, err := template.New("default").Parse(defaultTemplate)
 	if err != nil {
 		return err
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig enables HTTPS on a listener.
+type TLSConfig struct {
+	CertFile     string `json:"certFile"`     // PEM certificate chain; empty disables TLS
+	KeyFile      string `json:"keyFile"`      // PEM private key
+	ClientCAFile string `json:"clientCAFile"` // PEM CA bundle required to sign client certificates; management listener only
+}
+
+// Enabled returns true if a certificate is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// ClientTLSConfig configures the connections of the management client to a
+// management listener with TLS enabled.
+type ClientTLSConfig struct {
+	CAFile     string `json:"caFile"`     // PEM CA bundle that verifies the server; empty for the system roots
+	CertFile   string `json:"certFile"`   // PEM client certificate presented to the server
+	KeyFile    string `json:"keyFile"`    // PEM private key of the client certificate
+	ServerName string `json:"serverName"` // name verified in the server certificate; empty for the host of mgmtAddr
+}
+
+// Enabled returns true if any client TLS setting is configured.
+func (c ClientTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.ServerName != ""
+}
+
+var TLSNotEnabledError = fmt.Errorf("TLS is not enabled")
+
+// certCheckInterval is the minimum interval between checks for changes to
+// certificate files.
+var certCheckInterval = 10 * time.Second
+
+// validateTLS returns an error if the TLS settings of any listener or virtual
+// host are incomplete.
+func (c *Config) validateTLS() error {
+	for name, tc := range map[string]TLSConfig{"tls": c.TLS, "mgmtTLS": c.MgmtTLS} {
+		if tc.Enabled() != (tc.KeyFile != "") {
+			return fmt.Errorf("Both certFile and keyFile must be specified in %v", name)
+		}
+
+		if !tc.Enabled() && tc.ClientCAFile != "" {
+			return fmt.Errorf("%v in %v: clientCAFile requires a certificate", TLSNotEnabledError, name)
+		}
+	}
+
+	if c.TLS.ClientCAFile != "" {
+		return fmt.Errorf("Client certificates are only supported by the management listener")
+	}
+
+	if c.UpgradeAddr != "" && !c.TLS.Enabled() {
+		return fmt.Errorf("%v: upgradeAddr requires a certificate in tls", TLSNotEnabledError)
+	}
+
+	if (c.MgmtClientTLS.CertFile != "") != (c.MgmtClientTLS.KeyFile != "") {
+		return fmt.Errorf("Both certFile and keyFile must be specified in mgmtClientTLS")
+	}
+
+	for name, hc := range c.Hosts {
+		if hc.CertFile == "" && hc.KeyFile == "" {
+			continue
+		}
+
+		if hc.CertFile == "" || hc.KeyFile == "" {
+			return fmt.Errorf("Both certFile and keyFile must be specified for host %v", name)
+		}
+
+		if !c.TLS.Enabled() {
+			return fmt.Errorf("%v: host %v has a certificate but tls has none", TLSNotEnabledError, name)
+		}
+	}
+
+	return nil
+}
+
+// A keyPair is a certificate and private key loaded from files. The files are
+// reloaded when they change, so certificates can be renewed without restarting
+// the server.
+type keyPair struct {
+	CertFile string
+	KeyFile  string
+	Logger   *Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the loaded files
+	checked time.Time // last time the files were checked for changes
+}
+
+// loadKeyPair returns the key pair stored in the given files.
+func loadKeyPair(certFile, keyFile string, logger *Logger) (*keyPair, error) {
+	p := &keyPair{CertFile: certFile, KeyFile: keyFile, Logger: logger}
+	modTime, err := p.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// stat returns the latest modification time of the certificate and key files.
+func (p *keyPair) stat() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{p.CertFile, p.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return modTime, err
+		}
+
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+func (p *keyPair) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading certificate %v: %v", p.CertFile, err)
+	}
+
+	p.cert = &cert
+	p.modTime = modTime
+	p.checked = time.Now()
+	return nil
+}
+
+// Certificate returns the current certificate, reloading it if the files have
+// changed since they were last loaded. The previous certificate is kept if the
+// files cannot be reloaded.
+func (p *keyPair) Certificate() *tls.Certificate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checked) < certCheckInterval {
+		return p.cert
+	}
+	p.checked = time.Now()
+
+	modTime, err := p.stat()
+	if err != nil {
+		p.Logger.Errorf("Error checking certificate %v: %v", p.CertFile, err)
+		return p.cert
+	}
+
+	if modTime.Equal(p.modTime) {
+		return p.cert
+	}
+
+	if err := p.load(modTime); err != nil {
+		p.Logger.Errorf("%v", err)
+		return p.cert
+	}
+
+	p.Logger.Infof("Reloaded certificate %v", p.CertFile)
+	return p.cert
+}
+
+// A certStore selects the certificate of a TLS listener for each connection
+// by the server name given by clients with SNI.
+type certStore struct {
+	Default *keyPair
+	Hosts   HostConfigs
+	Pairs   map[string]*keyPair // keyed by virtual host name
+}
+
+// newCertStore loads the certificate of a listener and the certificates of
+// any virtual hosts.
+func newCertStore(tc TLSConfig, hosts HostConfigs, logger *Logger) (*certStore, error) {
+	def, err := loadKeyPair(tc.CertFile, tc.KeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &certStore{
+		Default: def,
+		Hosts:   hosts,
+		Pairs:   make(map[string]*keyPair),
+	}
+
+	for name, hc := range hosts {
+		if hc.CertFile == "" {
+			continue
+		}
+
+		p, err := loadKeyPair(hc.CertFile, hc.KeyFile, logger)
+		if err != nil {
+			return nil, fmt.Errorf("Error in configuration of host %v: %v", name, err)
+		}
+		s.Pairs[name] = p
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the certificate of the virtual host that matches the
+// server name of a connection, or the certificate of the listener if no host
+// with a certificate matches.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		if hc := s.Hosts.Match(hello.ServerName); hc != nil {
+			if p, ok := s.Pairs[hc.Name]; ok {
+				return p.Certificate(), nil
+			}
+		}
+	}
+
+	return s.Default.Certificate(), nil
+}
+
+// loadCertPool returns a certificate pool of the certificates in a PEM file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificates found in %v", path)
+	}
+
+	return pool, nil
+}
+
+// newTLSConfig returns the TLS configuration of a listener. Virtual host
+// certificates are selected by SNI, and client certificates are required if
+// a client CA bundle is configured.
+func newTLSConfig(tc TLSConfig, hosts HostConfigs, logger *Logger) (*tls.Config, error) {
+	store, err := newCertStore(tc, hosts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if tc.ClientCAFile != "" {
+		pool, err := loadCertPool(tc.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client CA bundle: %v", err)
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+type upgradeHandler struct {
+	Runtime *Runtime
+}
+
+// UpgradeHandler returns a http.Handler that permanently redirects all
+// requests to the same URL on the HTTPS redirect listener.
+func UpgradeHandler(rt *Runtime) http.Handler {
+	return WrapHandler(rt, "upgrade", &upgradeHandler{rt})
+}
+
+func (c *upgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.Trim(normalizeHost(r.Host), "[]")
+	if host == "" {
+		panic(NewHTTPErrorf(http.StatusBadRequest, "No host given"))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Runtime.Config().ListenAddr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 address
+	}
+
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+
+	http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+}
+
+func serveUpgrade(rt *Runtime, g *ServerGroup) error {
+	cfg := rt.Config()
+	s := &http.Server{
+		Addr:    cfg.UpgradeAddr,
+		Handler: UpgradeHandler(rt),
+	}
+
+	rt.Logger.Infof("Redirecting HTTP requests on %v to HTTPS", cfg.UpgradeAddr)
+	return g.Listen("upgrade", s, TLSConfig{}, nil)
+}
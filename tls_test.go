@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key written to files for tests.
+type testCert struct {
+	CertFile string
+	KeyFile  string
+	Cert     *x509.Certificate
+	Key      *ecdsa.PrivateKey
+}
+
+// newTestCert writes a certificate for the given name to dir. The certificate
+// is signed by ca, or is a self-signed CA if ca is nil.
+func newTestCert(dir, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca.Cert, ca.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	c := &testCert{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		Cert:     cert,
+		Key:      key,
+	}
+
+	if err := ioutil.WriteFile(c.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+func tmpCertDir(fn func(dir string)) {
+	dir, err := ioutil.TempDir("", "redirector_tls_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn(dir)
+}
+
+func TestCertificateSNI(t *testing.T) {
+	tmpCertDir(func(dir string) {
+		def := newTestCert(dir, "default.test", nil)
+		host := newTestCert(dir, "go.example.com", nil)
+		wildcard := newTestCert(dir, "sub.example.org", nil)
+
+		cfg := &Config{
+			TLS: TLSConfig{CertFile: def.CertFile, KeyFile: def.KeyFile},
+			Hosts: HostConfigs{
+				"go.example.com": {CertFile: host.CertFile, KeyFile: host.KeyFile},
+				"*.example.org":  {CertFile: wildcard.CertFile, KeyFile: wildcard.KeyFile},
+				"example.net":    {},
+			},
+		}
+		if err := cfg.initializeHosts(); err != nil {
+			panic(err)
+		}
+
+		store, err := newCertStore(cfg.TLS, cfg.Hosts, newLogger(ioutil.Discard, TextLog, InfoLevel))
+		if err != nil {
+			panic(err)
+		}
+
+		tests := map[string]*testCert{
+			"":                def,
+			"go.example.com":  host,
+			"GO.EXAMPLE.COM":  host,
+			"sub.example.org": wildcard,
+			"example.net":     def,
+			"unknown.test":    def,
+		}
+
+		for name, expect := range tests {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+			if err != nil {
+				t.Errorf("Error getting certificate for %q: %v", name, err)
+				continue
+			}
+
+			if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				panic(err)
+			} else if leaf.Subject.CommonName != expect.Cert.Subject.CommonName {
+				t.Errorf("Expected certificate %v for %q, got %v", expect.Cert.Subject.CommonName, name, leaf.Subject.CommonName)
+			}
+		}
+	})
+}
+
+func TestCertificateReload(t *testing.T) {
+	defer func(d time.Duration) { certCheckInterval = d }(certCheckInterval)
+	certCheckInterval = 0
+
+	tmpCertDir(func(dir string) {
+		old := newTestCert(dir, "reload.test", nil)
+		p, err := loadKeyPair(old.CertFile, old.KeyFile, newLogger(ioutil.Discard, TextLog, InfoLevel))
+		if err != nil {
+			panic(err)
+		}
+
+		// renew the certificate with a later modification time
+		renewed := newTestCert(dir, "reload.test", nil)
+		later := time.Now().Add(time.Minute)
+		for _, name := range []string{renewed.CertFile, renewed.KeyFile} {
+			if err := os.Chtimes(name, later, later); err != nil {
+				panic(err)
+			}
+		}
+
+		if leaf, err := x509.ParseCertificate(p.Certificate().Certificate[0]); err != nil {
+			panic(err)
+		} else if leaf.SerialNumber.Cmp(renewed.Cert.SerialNumber) != 0 {
+			t.Errorf("Expected renewed certificate to be loaded")
+		}
+
+		// invalid files keep the current certificate
+		if err := ioutil.WriteFile(renewed.CertFile, []byte("invalid"), 0644); err != nil {
+			panic(err)
+		}
+		later = later.Add(time.Minute)
+		if err := os.Chtimes(renewed.CertFile, later, later); err != nil {
+			panic(err)
+		}
+
+		if leaf, err := x509.ParseCertificate(p.Certificate().Certificate[0]); err != nil {
+			panic(err)
+		} else if leaf.SerialNumber.Cmp(renewed.Cert.SerialNumber) != 0 {
+			t.Errorf("Expected renewed certificate to be kept after invalid reload")
+		}
+	})
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		Config *Config
+		OK     bool
+	}{
+		{&Config{}, true},
+		{&Config{TLS: TLSConfig{CertFile: "a.crt", KeyFile: "a.key"}, UpgradeAddr: ":80"}, true},
+		{&Config{MgmtTLS: TLSConfig{CertFile: "a.crt", KeyFile: "a.key", ClientCAFile: "ca.crt"}}, true},
+		{&Config{TLS: TLSConfig{CertFile: "a.crt"}}, false},
+		{&Config{UpgradeAddr: ":80"}, false},
+		{&Config{TLS: TLSConfig{CertFile: "a.crt", KeyFile: "a.key", ClientCAFile: "ca.crt"}}, false},
+		{&Config{MgmtTLS: TLSConfig{ClientCAFile: "ca.crt"}}, false},
+		{&Config{MgmtClientTLS: ClientTLSConfig{CertFile: "a.crt"}}, false},
+		{&Config{Hosts: HostConfigs{"example.com": {CertFile: "a.crt", KeyFile: "a.key"}}}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.Config.validateTLS(); (err == nil) != test.OK {
+			t.Errorf("Expected valid=%v for config %v, got: %v", test.OK, i, err)
+		}
+	}
+}
+
+func TestUpgradeHandler(t *testing.T) {
+	tests := []struct {
+		ListenAddr string
+		URL        string
+		Expect     string
+	}{
+		{":443", "http://example.com/path?a=b", "https://example.com/path?a=b"},
+		{":8443", "http://example.com:8080/path%2Fescaped", "https://example.com:8443/path%2Fescaped"},
+		{"", "http://Example.COM/", "https://example.com/"},
+		{":8443", "http://[::1]/", "https://[::1]:8443/"},
+	}
+
+	for _, test := range tests {
+		rt := &Runtime{
+			Logger:       newLogger(ioutil.Discard, TextLog, InfoLevel),
+			AccessLogger: newAccessLogger(ioutil.Discard, AccessLogFormat{}),
+		}
+		rt.SetConfig(&Config{ListenAddr: test.ListenAddr})
+
+		w := httptest.NewRecorder()
+		UpgradeHandler(rt).ServeHTTP(w, httptest.NewRequest("GET", test.URL, nil))
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("Expected status %v for %v, got %v", http.StatusPermanentRedirect, test.URL, w.Code)
+		}
+
+		if loc := w.Header().Get("Location"); loc != test.Expect {
+			t.Errorf("Expected redirect from %v to %v, got %v", test.URL, test.Expect, loc)
+		}
+	}
+}
+
+func TestManagementClientTLS(t *testing.T) {
+	tmpCertDir(func(dir string) {
+		ca := newTestCert(dir, "ca.test", nil)
+		server := newTestCert(dir, "mgmt.test", ca)
+		client := newTestCert(dir, "deploy.test", ca)
+		other := newTestCert(dir, "other.test", nil)
+
+		testManagementServer(func(rt *Runtime, _ *ManagementClient) {
+			rt.Config().MgmtTLS = TLSConfig{CertFile: server.CertFile, KeyFile: server.KeyFile, ClientCAFile: ca.CertFile}
+			tc, err := newTLSConfig(rt.Config().MgmtTLS, nil, rt.Logger)
+			if err != nil {
+				panic(err)
+			}
+
+			ts := httptest.NewUnstartedServer(ManagementHandler(rt))
+			ts.TLS = tc
+			ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // rejected handshakes
+			ts.StartTLS()
+			defer ts.Close()
+
+			newClient := func(cert *testCert) *ManagementClient {
+				cfg := &Config{
+					MgmtAddr:      strings.TrimPrefix(ts.URL, "https://"),
+					MgmtClientTLS: ClientTLSConfig{CAFile: ca.CertFile, ServerName: "mgmt.test"},
+				}
+				if cert != nil {
+					cfg.MgmtClientTLS.CertFile = cert.CertFile
+					cfg.MgmtClientTLS.KeyFile = cert.KeyFile
+				}
+
+				return &ManagementClient{Config: cfg}
+			}
+
+			if err := newClient(client).AddMapping(&Mapping{Key: "/tls", Destination: "/okay"}); err != nil {
+				t.Errorf("Error adding mapping with client certificate: %v", err)
+			}
+
+			if _, err := newClient(nil).GetMapping("/tls"); err == nil {
+				t.Errorf("Expected error without client certificate")
+			}
+
+			if _, err := newClient(other).GetMapping("/tls"); err == nil {
+				t.Errorf("Expected error with untrusted client certificate")
+			}
+		})
+	})
+}